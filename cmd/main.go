@@ -34,8 +34,10 @@ import (
 	pl_sleep "github.com/coredhcp/coredhcp/plugins/sleep"
 	pl_staticroute "github.com/coredhcp/coredhcp/plugins/staticroute"
 
+	"dhcpserver/diagoption"
 	"dhcpserver/requeststats"
 	"dhcpserver/responsestats"
+	"dhcpserver/statsutil"
 
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
@@ -72,6 +74,7 @@ var desiredPlugins = []*plugins.Plugin{
 	// these plugins are DHCPv4 and DHCPv6
 	&requeststats.Plugin,
 	&responsestats.Plugin,
+	&diagoption.Plugin,
 	&pl_serverid.Plugin,
 	&pl_sleep.Plugin,
 	&pl_dns.Plugin,
@@ -137,11 +140,14 @@ func main() {
 	if *flagPromport > 0 {
 		go func () {
 			http.Handle("/metrics", promhttp.Handler())
+			http.HandleFunc("/toptalkers", requeststats.ServeTopTalkers)
+			http.HandleFunc("/unsatisfied", responsestats.ServeTopUnsatisfied)
 			http.ListenAndServe(fmt.Sprintf(":%d", *flagPromport), nil)
 		}()
 	}
 	if err := srv.Wait(); err != nil {
 		log.Print(err)
 	}
+	statsutil.CloseAll()
 	time.Sleep(time.Second)
 }
@@ -9,8 +9,15 @@ package main
  */
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/insomniacslk/dhcp/dhcpv6"
@@ -18,24 +25,266 @@ import (
 	"github.com/insomniacslk/dhcp/iana"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/client4"
+
+	"dhcpserver/statsutil"
 )
 
 var log = logger.GetLogger("main")
 
+var (
+	flagRequestOptions = flag.String("request-options", "", "comma-separated option codes to request via ORO/PRL, e.g. 6,15,23")
+	flagConcurrency    = flag.Int("concurrency", 1, "run this many clients in parallel, each with a distinct MAC")
+	flagExpectSubnet   = flag.String("expect-subnet", "", "exit nonzero unless allocations are in this CIDR (whichever family it is)")
+	flagExpectV4Subnet = flag.String("expect-v4-subnet", "", "exit nonzero unless the DHCPv4 allocation is in this CIDR")
+	flagExpectV6Prefix = flag.String("expect-v6-prefix", "", "exit nonzero unless the DHCPv6 IA addresses are in this prefix")
+	flagTA             = flag.Bool("ta", false, "also request an IA_TA (temporary addresses) in DHCPv6")
+	flagNoNA           = flag.Bool("no-na", false, "don't request an IA_NA in DHCPv6; stops after the Advertise since a Request needs one")
+	flagReplay         = flag.String("replay", "", "decode and print the request/response pairs in this capture file, then exit")
+)
+
+// replay prints the request/response pairs recorded in a capture file.
+func replay(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	for {
+		rec, err := statsutil.ReadRecord(rd)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch rec.Family {
+		case 4:
+			for _, data := range [][]byte{rec.Request, rec.Response} {
+				p, err := dhcpv4.FromBytes(data)
+				if err != nil {
+					return err
+				}
+				log.Print(p.Summary())
+			}
+		case 6:
+			for _, data := range [][]byte{rec.Request, rec.Response} {
+				p, err := dhcpv6.FromBytes(data)
+				if err != nil {
+					return err
+				}
+				log.Print(p.Summary())
+			}
+		default:
+			return fmt.Errorf("record has unknown family %d", rec.Family)
+		}
+	}
+}
+
+// the subnets allocations must come from, if not nil
+var expectV4Subnet, expectV6Prefix *net.IPNet
+
+// parseExpectations sets expectV4Subnet and expectV6Prefix from the flags.
+func parseExpectations() error {
+	for _, f := range []struct {
+		name, value string
+		v4          bool
+	}{
+		{"expect-subnet", *flagExpectSubnet, false},
+		{"expect-v4-subnet", *flagExpectV4Subnet, true},
+		{"expect-v6-prefix", *flagExpectV6Prefix, false},
+	} {
+		if len(f.value) == 0 {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(f.value)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %v", f.name, err)
+		}
+		if subnet.IP.To4() != nil {
+			expectV4Subnet = subnet
+		} else if f.v4 {
+			return fmt.Errorf("-%s %s is not an IPv4 subnet", f.name, f.value)
+		} else {
+			expectV6Prefix = subnet
+		}
+	}
+	return nil
+}
+
+// checkAllocated returns an error unless there is at least one allocated
+// address and all of them are in subnet.
+func checkAllocated(addrs []net.IP, subnet *net.IPNet) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("expected an allocation in %s but got none", subnet)
+	}
+	for _, addr := range addrs {
+		if !subnet.Contains(addr) {
+			return fmt.Errorf("allocated %s is not in expected %s", addr, subnet)
+		}
+	}
+	return nil
+}
+
+// parseOptionCodes parses a comma-separated list of option codes.
+func parseOptionCodes(s string) ([]uint16, error) {
+	var codes []uint16
+	if len(s) == 0 {
+		return codes, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		code, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid option code %q: %v", field, err)
+		}
+		codes = append(codes, uint16(code))
+	}
+	return codes, nil
+}
+
+// returnedOptions splits requested into the codes the reply carried
+// and the codes it omitted.
+func returnedOptions(requested []uint16, has func(uint16) bool) (returned, missing []uint16) {
+	for _, code := range requested {
+		if has(code) {
+			returned = append(returned, code)
+		} else {
+			missing = append(missing, code)
+		}
+	}
+	return returned, missing
+}
+
 func main() {
 	flag.Parse()
 
+	if len(*flagReplay) > 0 {
+		if err := replay(*flagReplay); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	requested, err := parseOptionCodes(*flagRequestOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := parseExpectations(); err != nil {
+		log.Fatal(err)
+	}
+
 	var macString string
 	if len(flag.Args()) > 0 {
 		macString = flag.Arg(0)
 	} else {
 		macString = "00:11:22:33:44:55"
 	}
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagConcurrency > 1 {
+		t := runWorkers(*flagConcurrency, mac, func(mac net.HardwareAddr) error {
+			// concurrent workers can't all bind the DHCPv6 client port
+			if err := do_dhcp6(mac, 0, requested); err != nil {
+				return err
+			}
+			return do_dhcp4(mac, requested)
+		})
+		log.Printf("%d workers: %d succeeded, %d failed", *flagConcurrency, t.succeeded, t.failed)
+		if t.failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := do_dhcp6(mac, dhcpv6.DefaultClientPort, requested); err != nil {
+		log.Fatal(err)
+	}
+	if err := do_dhcp4(mac, requested); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// tally counts the exchanges that succeeded and failed across workers.
+type tally struct {
+	sync.Mutex
+	succeeded int
+	failed    int
+}
+
+func (t *tally) record(err error) {
+	t.Lock()
+	defer t.Unlock()
+	if err != nil {
+		t.failed++
+	} else {
+		t.succeeded++
+	}
+}
+
+// workerMAC returns base with id added to it, so that each worker looks
+// like a distinct client.
+func workerMAC(base net.HardwareAddr, id int) net.HardwareAddr {
+	mac := make(net.HardwareAddr, len(base))
+	copy(mac, base)
+	carry := id
+	for i := len(mac) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(mac[i]) + carry
+		mac[i] = byte(sum)
+		carry = sum >> 8
+	}
+	return mac
+}
+
+// runWorkers runs exchange in n goroutines, each with its own MAC, and
+// returns how many succeeded and failed. Failures are logged with the
+// worker's number.
+func runWorkers(n int, base net.HardwareAddr, exchange func(mac net.HardwareAddr) error) *tally {
+	var t tally
+	var wg sync.WaitGroup
+	for id := 0; id < n; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			err := exchange(workerMAC(base, id))
+			if err != nil {
+				log.Errorf("worker %d: %v", id, err)
+			}
+			t.record(err)
+		}(id)
+	}
+	wg.Wait()
+	return &t
+}
+
+// withoutIANA removes the IA_NA that NewSolicit always adds.
+func withoutIANA(d dhcpv6.DHCPv6) {
+	if msg, ok := d.(*dhcpv6.Message); ok {
+		msg.Options.Del(dhcpv6.OptionIANA)
+	}
+}
+
+// iaModifiers returns the modifiers that make a Solicit from mac request
+// an IA_NA if na and an IA_TA if ta.
+func iaModifiers(mac net.HardwareAddr, na, ta bool) []dhcpv6.Modifier {
+	var modifiers []dhcpv6.Modifier
+	if !na {
+		modifiers = append(modifiers, withoutIANA)
+	}
+	if ta {
+		// the same IAID as NewSolicit gives the IA_NA
+		var iaid [4]byte
+		copy(iaid[:], mac[len(mac)-4:])
+		modifiers = append(modifiers, dhcpv6.WithIATA(iaid))
+	}
+	return modifiers
+}
+
+func do_dhcp6(mac net.HardwareAddr, localPort int, requested []uint16) error {
 	c := client6.NewClient()
 	c.LocalAddr = &net.UDPAddr{
 		IP:   net.ParseIP("::1"),
-		Port: 546,
+		Port: localPort,
 	}
 	c.RemoteAddr = &net.UDPAddr{
 		IP:   net.ParseIP("::1"),
@@ -45,10 +294,6 @@ func main() {
 	c.RelayOptions = []dhcpv6.Option {dhcpv6.OptInterfaceID([]byte("router1.us-ca-sfba.prod.example.com:Eth12/1(Port12)")) }
 	log.Printf("%+v", c)
 
-	mac, err := net.ParseMAC(macString)
-	if err != nil {
-		log.Fatal(err)
-	}
 	duid := dhcpv6.Duid{
 		Type:          dhcpv6.DUID_LLT,
 		HwType:        iana.HWTypeEthernet,
@@ -56,7 +301,28 @@ func main() {
 		LinkLayerAddr: mac,
 	}
 
-	conv, err := c.Exchange("eth0", dhcpv6.WithClientID(duid))
+	modifiers := []dhcpv6.Modifier{dhcpv6.WithClientID(duid)}
+	if len(requested) > 0 {
+		var codes []dhcpv6.OptionCode
+		for _, code := range requested {
+			codes = append(codes, dhcpv6.OptionCode(code))
+		}
+		modifiers = append(modifiers, dhcpv6.WithRequestedOptions(codes...))
+	}
+	modifiers = append(modifiers, iaModifiers(mac, !*flagNoNA, *flagTA)...)
+	var conv []dhcpv6.DHCPv6
+	var err error
+	if *flagNoNA {
+		var solicit, advertise dhcpv6.DHCPv6
+		solicit, advertise, err = c.Solicit("eth0", modifiers...)
+		for _, p := range []dhcpv6.DHCPv6{solicit, advertise} {
+			if p != nil {
+				conv = append(conv, p)
+			}
+		}
+	} else {
+		conv, err = c.Exchange("eth0", modifiers...)
+	}
 	for _, p := range conv {
 		log.Print(p.Summary())
 		if p.IsRelay() {
@@ -70,32 +336,93 @@ func main() {
 		}
 	}
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if len(requested) > 0 && len(conv) > 0 {
+		reply, err := conv[len(conv)-1].GetInnerMessage()
+		if err != nil {
+			return err
+		}
+		returned, missing := returnedOptions(requested, func(code uint16) bool {
+			return reply.GetOneOption(dhcpv6.OptionCode(code)) != nil
+		})
+		log.Printf("DHCPv6 reply returned requested options %v, omitted %v", returned, missing)
+	}
+	if *flagTA && len(conv) > 0 {
+		reply, err := conv[len(conv)-1].GetInnerMessage()
+		if err != nil {
+			return err
+		}
+		for _, iata := range reply.Options.IATA() {
+			for _, addr := range iata.Options.Addresses() {
+				log.Printf("DHCPv6 temporary address %s", addr.IPv6Addr)
+			}
+		}
+	}
+	if expectV6Prefix != nil && len(conv) > 0 {
+		reply, err := conv[len(conv)-1].GetInnerMessage()
+		if err != nil {
+			return err
+		}
+		var addrs []net.IP
+		for _, iana := range reply.Options.IANA() {
+			for _, addr := range iana.Options.Addresses() {
+				addrs = append(addrs, addr.IPv6Addr)
+			}
+		}
+		if err := checkAllocated(addrs, expectV6Prefix); err != nil {
+			return fmt.Errorf("DHCPv6: %v", err)
+		}
 	}
-	do_dhcp4(macString)
+	return nil
 }
 
-func do_dhcp4(macString string) {
+func do_dhcp4(mac net.HardwareAddr, requested []uint16) error {
 	//giaddr := net.ParseIP("0.0.0.0")   // use this if we want to get a response
 	giaddr := net.ParseIP("10.99.99.1")  // use this if we want the server to allocate us an IP
 	c := client4.NewClient()
 
 	log.Printf("%+v", c)
 
-	mac, err := net.ParseMAC(macString)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	rai := dhcpv4.OptRelayAgentInfo(
 		dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("router1.us-ca-sfba.prod.example.com:Eth12/1(Port12)")),
 	)
 
-	conv, err := c.Exchange("eth0", dhcpv4.WithHwAddr(mac), dhcpv4.WithGatewayIP(giaddr), dhcpv4.WithOption(rai))
+	modifiers := []dhcpv4.Modifier{dhcpv4.WithHwAddr(mac), dhcpv4.WithGatewayIP(giaddr), dhcpv4.WithOption(rai)}
+	var v4requested []uint16
+	if len(requested) > 0 {
+		var codes []dhcpv4.OptionCode
+		for _, code := range requested {
+			if code > 255 {
+				continue
+			}
+			v4requested = append(v4requested, code)
+			codes = append(codes, dhcpv4.GenericOptionCode(code))
+		}
+		modifiers = append(modifiers, dhcpv4.WithRequestedOptions(codes...))
+	}
+	conv, err := c.Exchange("eth0", modifiers...)
 	for _, p := range conv {
 		log.Print(p.Summary())
 	}
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if len(v4requested) > 0 && len(conv) > 0 {
+		reply := conv[len(conv)-1]
+		returned, missing := returnedOptions(v4requested, func(code uint16) bool {
+			return reply.Options.Has(dhcpv4.GenericOptionCode(code))
+		})
+		log.Printf("DHCPv4 reply returned requested options %v, omitted %v", returned, missing)
+	}
+	if expectV4Subnet != nil && len(conv) > 0 {
+		var addrs []net.IP
+		if yiaddr := conv[len(conv)-1].YourIPAddr; len(yiaddr) > 0 && !yiaddr.IsUnspecified() {
+			addrs = append(addrs, yiaddr)
+		}
+		if err := checkAllocated(addrs, expectV4Subnet); err != nil {
+			return fmt.Errorf("DHCPv4: %v", err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,214 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func TestParseOptionCodes(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    []uint16
+		wantErr bool
+	}{
+		{s: "", want: nil},
+		{s: "6", want: []uint16{6}},
+		{s: "6,15,23", want: []uint16{6, 15, 23}},
+		{s: " 6 , 15", want: []uint16{6, 15}},
+		{s: "65535", want: []uint16{65535}},
+		{s: "65536", wantErr: true},
+		{s: "6,dns", wantErr: true},
+		{s: "6,", wantErr: true},
+		{s: "-1", wantErr: true},
+	} {
+		got, err := parseOptionCodes(tc.s)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseOptionCodes(%q) error = %v, want error %v", tc.s, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseOptionCodes(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestReturnedOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name                      string
+		requested, present        []uint16
+		wantReturned, wantMissing []uint16
+	}{
+		{name: "none requested", present: []uint16{6}},
+		{name: "all returned", requested: []uint16{6, 15}, present: []uint16{6, 15, 23}, wantReturned: []uint16{6, 15}},
+		{name: "all missing", requested: []uint16{6, 15}, wantMissing: []uint16{6, 15}},
+		{name: "some missing", requested: []uint16{6, 15, 23}, present: []uint16{15}, wantReturned: []uint16{15}, wantMissing: []uint16{6, 23}},
+	} {
+		has := func(code uint16) bool {
+			for _, c := range tc.present {
+				if c == code {
+					return true
+				}
+			}
+			return false
+		}
+		returned, missing := returnedOptions(tc.requested, has)
+		if !reflect.DeepEqual(returned, tc.wantReturned) || !reflect.DeepEqual(missing, tc.wantMissing) {
+			t.Errorf("%s: returnedOptions = %v, %v, want %v, %v", tc.name, returned, missing, tc.wantReturned, tc.wantMissing)
+		}
+	}
+}
+
+func TestExpectSubnet(t *testing.T) {
+	for _, tc := range []struct {
+		subnet  string
+		addrs   []string
+		wantV4  bool
+		wantErr bool
+	}{
+		{subnet: "10.99.99.0/24", addrs: []string{"10.99.99.5"}, wantV4: true},
+		{subnet: "10.99.99.0/24", addrs: []string{"10.99.100.5"}, wantV4: true, wantErr: true},
+		{subnet: "10.99.99.0/24", wantV4: true, wantErr: true},
+		{subnet: "2001:db8::/64", addrs: []string{"2001:db8::1", "2001:db8::2"}},
+		{subnet: "2001:db8::/64", addrs: []string{"2001:db8::1", "2001:db8:1::2"}, wantErr: true},
+		{subnet: "2001:db8::/64", wantErr: true},
+	} {
+		expectV4Subnet, expectV6Prefix = nil, nil
+		if err := flag.Set("expect-subnet", tc.subnet); err != nil {
+			t.Fatal(err)
+		}
+		if err := parseExpectations(); err != nil {
+			t.Fatalf("-expect-subnet %s: %v", tc.subnet, err)
+		}
+		subnet := expectV6Prefix
+		if tc.wantV4 {
+			subnet = expectV4Subnet
+		}
+		if subnet == nil || subnet.String() != tc.subnet {
+			t.Fatalf("-expect-subnet %s set v4 %v, v6 %v", tc.subnet, expectV4Subnet, expectV6Prefix)
+		}
+		var addrs []net.IP
+		for _, a := range tc.addrs {
+			addrs = append(addrs, net.ParseIP(a))
+		}
+		if err := checkAllocated(addrs, subnet); (err != nil) != tc.wantErr {
+			t.Errorf("checkAllocated(%v, %s) = %v, want error %v", tc.addrs, tc.subnet, err, tc.wantErr)
+		}
+	}
+	flag.Set("expect-subnet", "")
+	expectV4Subnet, expectV6Prefix = nil, nil
+}
+
+func TestParseExpectationsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+	}{
+		{"expect-subnet", "10.99.99.0"},
+		{"expect-v4-subnet", "2001:db8::/64"},
+		{"expect-v6-prefix", "bogus"},
+	} {
+		if err := flag.Set(tc.name, tc.value); err != nil {
+			t.Fatal(err)
+		}
+		if err := parseExpectations(); err == nil {
+			t.Errorf("-%s %s: expected error", tc.name, tc.value)
+		}
+		flag.Set(tc.name, "")
+	}
+	expectV4Subnet, expectV6Prefix = nil, nil
+}
+
+func TestWorkerMAC(t *testing.T) {
+	for _, tc := range []struct {
+		base string
+		id   int
+		want string
+	}{
+		{"00:11:22:33:44:55", 0, "00:11:22:33:44:55"},
+		{"00:11:22:33:44:55", 1, "00:11:22:33:44:56"},
+		{"00:11:22:33:44:ff", 1, "00:11:22:33:45:00"},
+		{"00:11:22:33:ff:ff", 2, "00:11:22:34:00:01"},
+		{"00:11:22:33:44:55", 256, "00:11:22:33:45:55"},
+	} {
+		mac, _ := net.ParseMAC(tc.base)
+		if got := workerMAC(mac, tc.id).String(); got != tc.want {
+			t.Errorf("workerMAC(%s, %d) = %s, want %s", tc.base, tc.id, got, tc.want)
+		}
+		if mac.String() != tc.base {
+			t.Errorf("workerMAC(%s, %d) modified its base to %s", tc.base, tc.id, mac)
+		}
+	}
+}
+
+func TestRunWorkers(t *testing.T) {
+	const n = 300
+	base, _ := net.ParseMAC("00:11:22:33:44:f0")
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	tally := runWorkers(n, base, func(mac net.HardwareAddr) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[mac.String()] = true
+		if mac[len(mac)-1]%10 == 0 {
+			return errors.New("declined")
+		}
+		return nil
+	})
+	if len(seen) != n {
+		t.Errorf("%d workers used %d distinct MACs", n, len(seen))
+	}
+	if tally.succeeded+tally.failed != n {
+		t.Errorf("tally %d succeeded + %d failed, want %d", tally.succeeded, tally.failed, n)
+	}
+	failed := 0
+	for mac := range seen {
+		hw, _ := net.ParseMAC(mac)
+		if hw[len(hw)-1]%10 == 0 {
+			failed++
+		}
+	}
+	if tally.failed != failed {
+		t.Errorf("tally %d failed, want %d", tally.failed, failed)
+	}
+}
+
+func TestIAModifiers(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	wantIAID := [4]byte{0x22, 0x33, 0x44, 0x55}
+	for _, tc := range []struct {
+		na, ta bool
+	}{
+		{na: true},
+		{na: true, ta: true},
+		{ta: true},
+		{},
+	} {
+		solicit, err := dhcpv6.NewSolicit(mac, iaModifiers(mac, tc.na, tc.ta)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iana := solicit.Options.OneIANA()
+		if (iana != nil) != tc.na {
+			t.Errorf("na %v, ta %v: Solicit has IA_NA %v", tc.na, tc.ta, iana)
+		}
+		iata := solicit.Options.OneIATA()
+		if (iata != nil) != tc.ta {
+			t.Errorf("na %v, ta %v: Solicit has IA_TA %v", tc.na, tc.ta, iata)
+		}
+		if iana != nil && iana.IaId != wantIAID {
+			t.Errorf("na %v, ta %v: IA_NA IAID %x, want %x", tc.na, tc.ta, iana.IaId, wantIAID)
+		}
+		if iata != nil && iata.IaId != wantIAID {
+			t.Errorf("na %v, ta %v: IA_TA IAID %x, want %x", tc.na, tc.ta, iata.IaId, wantIAID)
+		}
+	}
+}
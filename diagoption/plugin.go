@@ -0,0 +1,154 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// This plugin adds a synthetic vendor-specific option (option 125 for
+// DHCPv4, option 17 for DHCPv6) to responses to requests from a magic
+// circuit ID or interface ID, so we can test our monitoring agents.
+//
+//   - diagoption: match=<circuit ID or interface ID> [enterprise=32473] [data=diagoption]
+
+package diagoption
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger("plugins/diagoption")
+
+var Plugin = plugins.Plugin{
+	Name:   "diagoption",
+	Setup6: setup6,
+	Setup4: setup4,
+}
+
+// the enterprise number reserved for documentation (RFC 5612)
+const defaultEnterprise = 32473
+
+// the vendor suboption code that carries our data
+const dataSubOption = 1
+
+type PluginState struct {
+	Match      string
+	Enterprise uint32
+	Data       []byte
+}
+
+// circuitID returns the circuit ID (or failing that the remote ID) of a
+// relayed DHCPv4 request, or "" if there is none.
+func circuitID(req *dhcpv4.DHCPv4) string {
+	rai := req.RelayAgentInfo()
+	if rai == nil {
+		return ""
+	}
+	intfstr := dhcpv4.GetString(dhcpv4.AgentCircuitIDSubOption, (*rai).Options)
+	if len(intfstr) == 0 {
+		intfstr = dhcpv4.GetString(dhcpv4.AgentRemoteIDSubOption, (*rai).Options)
+	}
+	return intfstr
+}
+
+// interfaceID returns the InterfaceID of the innermost relay of a
+// DHCPv6 request, or "" if there is none.
+func interfaceID(req dhcpv6.DHCPv6) string {
+	if !req.IsRelay() {
+		return ""
+	}
+	innermsg, err := dhcpv6.DecapsulateRelayIndex(req, -1)
+	if err != nil {
+		return ""
+	}
+	inner, ok := innermsg.(*dhcpv6.RelayMessage)
+	if !ok {
+		return ""
+	}
+	return string(inner.Options.InterfaceID())
+}
+
+// vivso returns the payload of a DHCPv4 Vendor-Identifying Vendor-Specific
+// option (RFC 3925) carrying our data as a single suboption.
+func (state *PluginState) vivso() []byte {
+	b := make([]byte, 4, 4+1+2+len(state.Data))
+	binary.BigEndian.PutUint32(b, state.Enterprise)
+	b = append(b, byte(2+len(state.Data)), dataSubOption, byte(len(state.Data)))
+	return append(b, state.Data...)
+}
+
+func (state *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil || interfaceID(req) != state.Match {
+		return resp, false
+	}
+	resp.AddOption(&dhcpv6.OptVendorOpts{
+		EnterpriseNumber: state.Enterprise,
+		VendorOpts: dhcpv6.Options{
+			&dhcpv6.OptionGeneric{OptionCode: dataSubOption, OptionData: state.Data},
+		},
+	})
+	log.Debugf("added diagnostic vendor option for interface %s", state.Match)
+	return resp, false
+}
+
+func (state *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || circuitID(req) != state.Match {
+		return resp, false
+	}
+	resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorIdentifyingVendorSpecific, state.vivso()))
+	log.Debugf("added diagnostic vendor option for circuit %s", state.Match)
+	return resp, false
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	var state PluginState
+	if err := state.FromArgs(args...); err != nil {
+		return nil, err
+	}
+	return state.Handler6, nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	var state PluginState
+	if err := state.FromArgs(args...); err != nil {
+		return nil, err
+	}
+	return state.Handler4, nil
+}
+
+func (state *PluginState) FromArgs(args ...string) error {
+	state.Enterprise = defaultEnterprise
+	state.Data = []byte("diagoption")
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "match":
+			state.Match = value
+		case "enterprise":
+			en, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid enterprise number %q: %v", value, err)
+			}
+			state.Enterprise = uint32(en)
+		case "data":
+			state.Data = []byte(value)
+		default:
+			return fmt.Errorf("unknown argument %q", arg)
+		}
+	}
+	if len(state.Match) == 0 {
+		return fmt.Errorf("diagoption requires match=<circuit ID or interface ID>")
+	}
+	// the whole DHCPv4 option, including enterprise number and
+	// suboption header, must fit in 255 bytes
+	if len(state.Data) > 248 {
+		return fmt.Errorf("data is %d bytes, at most 248 allowed", len(state.Data))
+	}
+	return nil
+}
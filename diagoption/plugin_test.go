@@ -0,0 +1,224 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package diagoption
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var testMAC = net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+func TestFromArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    PluginState
+		wantErr string
+	}{
+		{[]string{"match=diag"}, PluginState{"diag", defaultEnterprise, []byte("diagoption")}, ""},
+		{[]string{"match=ge-0/0/1", "enterprise=2636", "data=probe"}, PluginState{"ge-0/0/1", 2636, []byte("probe")}, ""},
+		{[]string{"match=diag", "data="}, PluginState{"diag", defaultEnterprise, []byte{}}, ""},
+		{[]string{"match=diag", "data=" + strings.Repeat("x", 248)}, PluginState{"diag", defaultEnterprise, []byte(strings.Repeat("x", 248))}, ""},
+		{nil, PluginState{}, "requires match"},
+		{[]string{"enterprise=2636"}, PluginState{}, "requires match"},
+		{[]string{"match=diag", "enterprise=acme"}, PluginState{}, "invalid enterprise number"},
+		{[]string{"match=diag", "enterprise=4294967296"}, PluginState{}, "invalid enterprise number"},
+		{[]string{"match=diag", "colour=blue"}, PluginState{}, "unknown argument"},
+		{[]string{"match=diag", "data=" + strings.Repeat("x", 249)}, PluginState{}, "at most 248"},
+	}
+	for _, tt := range tests {
+		var state PluginState
+		err := state.FromArgs(tt.args...)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("FromArgs(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FromArgs(%q) error = %v", tt.args, err)
+			continue
+		}
+		if state.Match != tt.want.Match || state.Enterprise != tt.want.Enterprise || !bytes.Equal(state.Data, tt.want.Data) {
+			t.Errorf("FromArgs(%q) = %+v, want %+v", tt.args, state, tt.want)
+		}
+	}
+}
+
+// discover returns a DHCPv4 DISCOVER carrying the given relay agent
+// suboptions, or no relay agent information if there are none.
+func discover(t *testing.T, subopts ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+	t.Helper()
+	var mods []dhcpv4.Modifier
+	if len(subopts) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subopts...)))
+	}
+	req, err := dhcpv4.NewDiscovery(testMAC, mods...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestCircuitID(t *testing.T) {
+	circuit := dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("ge-0/0/1"))
+	remote := dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte("olt-7"))
+	tests := []struct {
+		name    string
+		subopts []dhcpv4.Option
+		want    string
+	}{
+		{"unrelayed", nil, ""},
+		{"circuit ID", []dhcpv4.Option{circuit}, "ge-0/0/1"},
+		{"circuit ID preferred", []dhcpv4.Option{circuit, remote}, "ge-0/0/1"},
+		{"remote ID fallback", []dhcpv4.Option{remote}, "olt-7"},
+		{"neither", []dhcpv4.Option{dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, []byte{192, 0, 2, 0})}, ""},
+	}
+	for _, tt := range tests {
+		if got := circuitID(discover(t, tt.subopts...)); got != tt.want {
+			t.Errorf("%s: circuitID = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// relayed returns a SOLICIT encapsulated in one relay per interface ID,
+// outermost first; an empty ID means the relay adds no InterfaceID.
+func relayed(t *testing.T, ids ...string) dhcpv6.DHCPv6 {
+	t.Helper()
+	var msg dhcpv6.DHCPv6
+	msg, err := dhcpv6.NewSolicit(testMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		relay, err := dhcpv6.EncapsulateRelay(msg, dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids[i] != "" {
+			relay.AddOption(dhcpv6.OptInterfaceID([]byte(ids[i])))
+		}
+		msg = relay
+	}
+	return msg
+}
+
+func TestInterfaceID(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		want string
+	}{
+		{"unrelayed", nil, ""},
+		{"one relay", []string{"eth0"}, "eth0"},
+		{"innermost relay", []string{"uplink", "eth0"}, "eth0"},
+		{"innermost relay without ID", []string{"uplink", ""}, ""},
+	}
+	for _, tt := range tests {
+		if got := interfaceID(relayed(t, tt.ids...)); got != tt.want {
+			t.Errorf("%s: interfaceID = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVIVSO(t *testing.T) {
+	tests := []struct {
+		state PluginState
+		want  []byte
+	}{
+		{PluginState{Enterprise: defaultEnterprise, Data: []byte("hi")}, []byte{0, 0, 0x7e, 0xd9, 4, dataSubOption, 2, 'h', 'i'}},
+		{PluginState{Enterprise: 0x01020304, Data: []byte{}}, []byte{1, 2, 3, 4, 2, dataSubOption, 0}},
+	}
+	for _, tt := range tests {
+		if got := tt.state.vivso(); !bytes.Equal(got, tt.want) {
+			t.Errorf("vivso(%d, %q) = %v, want %v", tt.state.Enterprise, tt.state.Data, got, tt.want)
+		}
+	}
+}
+
+func TestHandler4(t *testing.T) {
+	state := PluginState{Match: "ge-0/0/1", Enterprise: defaultEnterprise, Data: []byte("diagoption")}
+	tests := []struct {
+		name    string
+		circuit string
+		want    bool
+	}{
+		{"matching circuit", "ge-0/0/1", true},
+		{"other circuit", "ge-0/0/2", false},
+		{"unrelayed", "", false},
+	}
+	for _, tt := range tests {
+		var req *dhcpv4.DHCPv4
+		if tt.circuit == "" {
+			req = discover(t)
+		} else {
+			req = discover(t, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte(tt.circuit)))
+		}
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, stop := state.Handler4(req, resp)
+		if stop {
+			t.Errorf("%s: Handler4 stopped the chain", tt.name)
+		}
+		opt := got.GetOneOption(dhcpv4.OptionVendorIdentifyingVendorSpecific)
+		if (opt != nil) != tt.want {
+			t.Errorf("%s: vendor option = %v, want present %v", tt.name, opt, tt.want)
+		} else if tt.want && !bytes.Equal(opt, state.vivso()) {
+			t.Errorf("%s: vendor option = %v, want %v", tt.name, opt, state.vivso())
+		}
+	}
+	if got, _ := state.Handler4(discover(t, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("ge-0/0/1"))), nil); got != nil {
+		t.Errorf("Handler4 with no response = %v, want nil", got)
+	}
+}
+
+func TestHandler6(t *testing.T) {
+	state := PluginState{Match: "eth0", Enterprise: defaultEnterprise, Data: []byte("diagoption")}
+	tests := []struct {
+		name string
+		ids  []string
+		want bool
+	}{
+		{"matching interface", []string{"eth0"}, true},
+		{"matching outer relay only", []string{"eth0", "eth1"}, false},
+		{"other interface", []string{"eth1"}, false},
+		{"unrelayed", nil, false},
+	}
+	for _, tt := range tests {
+		req := relayed(t, tt.ids...)
+		resp, err := dhcpv6.NewMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, stop := state.Handler6(req, resp)
+		if stop {
+			t.Errorf("%s: Handler6 stopped the chain", tt.name)
+		}
+		opts := got.(*dhcpv6.Message).Options.VendorOpts()
+		if (len(opts) == 1) != tt.want {
+			t.Errorf("%s: %d vendor options, want present %v", tt.name, len(opts), tt.want)
+			continue
+		}
+		if !tt.want {
+			continue
+		}
+		if opts[0].EnterpriseNumber != state.Enterprise {
+			t.Errorf("%s: enterprise = %d, want %d", tt.name, opts[0].EnterpriseNumber, state.Enterprise)
+		}
+		if data := opts[0].VendorOpts.GetOne(dataSubOption); data == nil || !bytes.Equal(data.ToBytes(), state.Data) {
+			t.Errorf("%s: vendor suboption = %v, want %q", tt.name, data, state.Data)
+		}
+	}
+	if got, _ := state.Handler6(relayed(t, "eth0"), nil); got != nil {
+		t.Errorf("Handler6 with no response = %v, want nil", got)
+	}
+}
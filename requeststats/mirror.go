@@ -0,0 +1,121 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package requeststats
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"dhcpserver/statsutil"
+)
+
+// at most this many summaries wait to be mirrored; we drop the rest
+const mirrorQueueDepth = 1024
+
+var (
+	mirrorsent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcp_mirror_sent_total",
+		Help: "Total number of request summaries mirrored to the collector",
+	})
+	mirrordropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcp_mirror_dropped_total",
+		Help: "Total number of request summaries dropped because the mirror queue was full",
+	})
+	mirrorerrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcp_mirror_errors_total",
+		Help: "Total number of request summaries the collector did not accept",
+	})
+)
+
+// RequestSummary is the JSON we POST to the collector for each sampled request.
+type RequestSummary struct {
+	Time      time.Time `json:"time"`
+	Family    string    `json:"family"`
+	Type      string    `json:"type"`
+	Client    string    `json:"client,omitempty"`
+	Relay     string    `json:"relay,omitempty"`
+	Interface string    `json:"interface,omitempty"`
+}
+
+// Mirror POSTs request summaries to a collector without ever blocking
+// the caller.
+type Mirror struct {
+	URL    string
+	Client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewMirror returns a Mirror that POSTs to url from a background goroutine
+// until CloseAll closes it.
+func NewMirror(url string) *Mirror {
+	m := &Mirror{
+		URL:    url,
+		Client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan []byte, mirrorQueueDepth),
+		done:   make(chan struct{}),
+	}
+	statsutil.RegisterCloser(m)
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+// Close stops mirroring, waiting for any POST in progress. Summaries still
+// queued are dropped.
+func (m *Mirror) Close() error {
+	m.once.Do(func() { close(m.done) })
+	m.wg.Wait()
+	return nil
+}
+
+// Send queues summary for delivery, dropping it if the queue is full.
+func (m *Mirror) Send(summary RequestSummary) {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		log.Errorf("could not marshal request summary: %v", err)
+		return
+	}
+	select {
+	case m.queue <- body:
+	default:
+		mirrordropped.Inc()
+	}
+}
+
+func (m *Mirror) run() {
+	defer m.wg.Done()
+	for {
+		var body []byte
+		select {
+		case <-m.done:
+			return
+		case body = <-m.queue:
+		}
+		resp, err := m.Client.Post(m.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			mirrorerrors.Inc()
+			log.Debugf("could not mirror to %s: %v", m.URL, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			mirrorerrors.Inc()
+			log.Debugf("mirror to %s: %s", m.URL, resp.Status)
+			continue
+		}
+		mirrorsent.Inc()
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package requeststats
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestMirror(t *testing.T) {
+	received := make(chan RequestSummary, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary RequestSummary
+		if err := json.NewDecoder(r.Body).Decode(&summary); err != nil {
+			t.Errorf("collector received bad JSON: %v", err)
+		}
+		received <- summary
+	}))
+	defer collector.Close()
+	state, _ := newTestState(t, "mirror_url="+collector.URL, "sample=1/2")
+	macs := []net.HardwareAddr{
+		{0, 0x11, 0x22, 0x33, 0x44, 0x01},
+		{0, 0x11, 0x22, 0x33, 0x44, 0x02},
+		{0, 0x11, 0x22, 0x33, 0x44, 0x03},
+		{0, 0x11, 0x22, 0x33, 0x44, 0x04},
+	}
+	for _, mac := range macs {
+		req, err := dhcpv4.NewDiscovery(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.Handler4(req, nil)
+	}
+	// one in two requests is sampled, starting with the first
+	for _, want := range []net.HardwareAddr{macs[0], macs[2]} {
+		select {
+		case summary := <-received:
+			if summary.Family != "v4" || summary.Type != "DISCOVER" || summary.Client != want.String() {
+				t.Errorf("mirrored %+v, want a v4 DISCOVER from %s", summary, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("summary for %s never arrived", want)
+		}
+	}
+	select {
+	case summary := <-received:
+		t.Errorf("mirrored unsampled request %+v", summary)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorClose(t *testing.T) {
+	received := make(chan RequestSummary, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- RequestSummary{}
+	}))
+	defer collector.Close()
+	m := NewMirror(collector.URL)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// closing twice, as CloseAll may, is harmless
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m.Send(RequestSummary{Family: "v4"})
+	select {
+	case <-received:
+		t.Error("closed mirror still POSTs summaries")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
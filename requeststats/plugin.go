@@ -7,6 +7,20 @@
 package requeststats
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
         "github.com/prometheus/client_golang/prometheus"
         "github.com/prometheus/client_golang/prometheus/promauto"
 
@@ -15,6 +29,8 @@ import (
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"dhcpserver/statsutil"
 )
 
 var log = logger.GetLogger("plugins/requeststats")
@@ -26,14 +42,114 @@ var Plugin = plugins.Plugin{
 }
 
 var (
+	handled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_requests_handled_total",
+		Help: "Handler invocations for requests, by family {v4, v6} X outcome {ok, error, dropped}; a DHCPv4 error is a request that isn't a BootRequest",
+	}, []string{"family", "outcome"})
+	perminute = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dhcp_requests_per_minute",
+		Help: "Requests received in the most recent whole minute, by family {v4, v6}",
+	}, []string{"family"})
+	monitorrequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_monitor_requests_total",
+		Help: "Requests from the monitor_mac or monitor_duid client, left out of every other request metric, by family {v4, v6}",
+	}, []string{"family"})
+	ignoredtypes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_ignored_messages_total",
+		Help: "Requests of an ignore_types message type, left out of the per-type counters, by family {v4, v6}",
+	}, []string{"family"})
+	nilresp = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_nil_response_seen_total",
+		Help: "Requests for which an earlier plugin left a nil response, by family {v4, v6}",
+	}, []string{"family"})
+	userclass = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_requests_by_user_class_total",
+		Help: "Requests carrying a User Class option, by family {v4, v6} X user class",
+	}, []string{"family", "class"})
 	v4types = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dhcpv4_requests_total",
 		Help: "DHCPv4 requests received, by message type",
 	}, []string{"type"})
+	v4ignoredopcode = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_ignored_opcode_total",
+		Help: "DHCPv4 requests ignored because they aren't BootRequests, by numeric op code",
+	}, []string{"opcode"})
+	v4bootp = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_bootp_requests_total",
+		Help: "Total number of legacy BOOTP requests (BootRequests without a DHCP message type)",
+	})
+	v4oversizedprl = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_oversized_prl_total",
+		Help: "Total number of DHCPv4 requests with a Parameter Request List longer than max_prl",
+	})
+	v4clientarch = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_client_arch_total",
+		Help: "DHCPv4 requests with a Client System Architecture option, by architecture",
+	}, []string{"arch"})
+	v4invalidchaddr = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_invalid_chaddr_total",
+		Help: "Total number of DHCPv4 requests with an empty or all-zero client hardware address",
+	})
+	v4noclientid = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_missing_client_id_total",
+		Help: "Total number of DHCPv4 requests without a Client Identifier option, identified only by chaddr",
+	})
+	v4ouiclass = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_requests_by_oui_class_total",
+		Help: "DHCPv4 requests, by whether the client MAC's OUI is in oui_allowlist {approved, other}",
+	}, []string{"class"})
+	v4clientidmismatch = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_clientid_chaddr_mismatch_total",
+		Help: "Total number of DHCPv4 requests whose Ethernet client identifier doesn't match chaddr",
+	})
+	v4newclients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_new_clients_total",
+		Help: "Total number of DHCPv4 DISCOVERs from clients not seen within new_client_grace",
+	})
+	v4autoconfigure = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_autoconfigure_requests_total",
+		Help: "DHCPv4 requests carrying an Auto-Configure option, by value {AutoConfigure, DoNotAutoConfigure, invalid}",
+	}, []string{"value"})
+	v4initreboot = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_init_reboot_total",
+		Help: "Total number of DHCPv4 REQUESTs in INIT-REBOOT state, with a requested IP but no server identifier",
+	})
+	v4raivendor = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_rai_vendor_specific_total",
+		Help: "Total number of relayed DHCPv4 requests with a Vendor-Specific Information RAI sub-option",
+	})
+	v4vlan = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_requests_by_vlan_total",
+		Help: "Relayed DHCPv4 requests, by the VLAN the circuit_regex vlan group extracts from the circuit ID",
+	}, []string{"vlan"})
+	v4silentrelays = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dhcpv4_silent_relays",
+		Help: "Number of relays seen within the last day but silent for longer than relay_silence_timeout",
+	})
+	v4relaysubnet = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_requests_by_relay_subnet_total",
+		Help: "DHCPv4 requests received from a relay, by giaddr truncated to relay_subnet_mask",
+	}, []string{"subnet"})
+	v4outofscope = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_requested_ip_out_of_scope_total",
+		Help: "Total number of DHCPv4 requests for an IP (option 50) outside the served subnets",
+	})
+	v4discoverhint = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_discover_with_requested_ip_total",
+		Help: "Total number of DHCPv4 DISCOVERs hinting at an IP with option 50",
+	})
+	v4binarycircuitid = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_binary_circuit_id_total",
+		Help: "Total number of relayed DHCPv4 requests whose circuit ID is not valid UTF-8",
+	})
 	v4relay = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "dhcpv4_from_relays_total",
 		Help: "Total number of DHCPv4 requests recieved from a relay",
 	})
+	v4relaylastseen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dhcpv4_relay_last_seen_timestamp_seconds",
+		Help: "Unix time of the most recent DHCPv4 request from each relay, by giaddr",
+	}, []string{"relay"})
 	v4raimissingsuboptions = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dhcpv4_rai_missing_suboptions_total",
 		Help: "DHCPv4 missing Relay Agent Information suboptions in request, by missing suboption",
@@ -42,78 +158,993 @@ var (
 		Name: "dhcpv6_requests_total",
 		Help: "DHCPv6 requests received, by message type",
 	}, []string{"type"})
+	v6unhandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_unhandled_message_type_total",
+		Help: "DHCPv6 requests of a valid message type that a server does not handle, by message type",
+	}, []string{"type"})
+	v6unexpected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_unexpected_client_message_total",
+		Help: "DHCPv6 requests carrying a message type only servers send, by message type",
+	}, []string{"type"})
+	v6txidanomaly = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_txid_anomaly_total",
+		Help: "Total number of DHCPv6 requests whose client message has an all-zero transaction ID",
+	})
+	v6unspecifiedlink = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_relay_unspecified_link_total",
+		Help: "Total number of relayed DHCPv6 requests whose innermost relay sent an unspecified link address",
+	})
+	v6badinterfaceid = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_malformed_interfaceid_total",
+		Help: "Total number of relayed DHCPv6 requests whose Interface-ID doesn't match interfaceid_regex",
+	})
+	v6extractfailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_inner_message_extract_failures_total",
+		Help: "Total number of DHCPv6 relay messages whose inner message could not be extracted (also counted as type error)",
+	})
 	v6rapidcommit = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "dhcpv6_solicit_rapid_commit_total",
 		Help: "Total number of DHCPv6 Solicit requests with Rapid Commit option",
 	})
+	v6noelapsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_missing_elapsed_time_total",
+		Help: "DHCPv6 requests without the Elapsed Time option, by message type",
+	}, []string{"type"})
+	v6renewrebind = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_renew_rebind_total",
+		Help: "DHCPv6 lease extension requests, by kind {renew, rebind}",
+	}, []string{"kind"})
 	v6relay = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "dhcpv6_from_relays_total",
 		Help: "Total number of DHCPv6 requests received from a relay",
 	})
+	v6maxhops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_max_hops_exceeded_total",
+		Help: "Total number of DHCPv6 requests dropped for passing through more than max_hops relays",
+	})
+	v6interfacerate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dhcpv6_interface_request_rate",
+		Help: "Relayed DHCPv6 requests in the last minute, by the innermost relay's Interface-ID",
+	}, []string{"interface"})
+	v6direct = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_direct_requests_total",
+		Help: "Total number of DHCPv6 requests received directly from a client rather than from a relay",
+	})
+	v6relaypeer = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_requests_by_relay_peer_total",
+		Help: "DHCPv6 requests received from a relay, by the outermost relay's peer address",
+	}, []string{"peer"})
 	v6ia = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dhcpv6_requested_ias_total",
 		Help: "DHCPv6 Identity Associations requested, by type {IA_NA, IA_TA, IA_PD}",
 	}, []string{"type"})
+	v6enterprise = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_requests_by_enterprise_total",
+		Help: "DHCPv6 Vendor Class options in requests, by enterprise number",
+	}, []string{"enterprise"})
+	v6fqdn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_client_fqdn_total",
+		Help: "DHCPv6 requests carrying a Client FQDN option, by whether the client wants the server to update DNS {true, false}",
+	}, []string{"server_update"})
+	v6requestingdns = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_clients_requesting_dns_total",
+		Help: "Total number of DHCPv6 requests whose ORO includes DNS Recursive Name Server",
+	})
+	v6pdtoolarge = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_pd_hint_too_large_total",
+		Help: "Total number of DHCPv6 requests hinting at a delegated prefix shorter than max_pd_len",
+	})
+	v6foreignaddr = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_foreign_ia_address_total",
+		Help: "Total number of DHCPv6 requests asserting an IA_NA address outside the configured subnets",
+	})
+)
+
+// histograms are the histograms our buckets_ arguments can override
+var histograms = statsutil.NewHistograms("requeststats")
+
+var v4discovertorequest = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv4_discover_to_request_seconds",
+	Help:    "Delay between a client's DISCOVER and its REQUEST for the same transaction",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 13),
+})
+
+var v4relayinterarrival = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv4_relay_interarrival_seconds",
+	Help:    "Time between consecutive requests from the same relay",
+	Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+})
+
+var v4maxmsgsize = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv4_max_message_size",
+	Help:    "Maximum DHCP message size clients advertise in option 57",
+	Buckets: []float64{576, 1024, 1280, 1500, 2048, 4096, 9000},
+})
+
+// RFC 2132 9.10 doesn't allow a maximum message size below this
+const minMaxMessageSize = 576
+
+var v6relayhops = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv6_relay_hops",
+	Help:    "Number of relays relayed DHCPv6 requests passed through",
+	Buckets: prometheus.LinearBuckets(1, 1, 8),
+})
+
+var v4secs = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv4_client_secs",
+	Help:    "Seconds elapsed since the client began acquiring or renewing a lease, from the secs field",
+	Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256},
+})
+
+var optioncount = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcp_request_option_count",
+	Help:    "Number of options carried in each request (the inner message for relayed DHCPv6)",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+}, "family")
+
+var (
+	v6peerlabel       = statsutil.BoundedLabel("peer", maxRelays)
+	v4userclasslabel  = statsutil.BoundedLabel("v4 user class", 100)
+	v6userclasslabel  = statsutil.BoundedLabel("v6 user class", 100)
+	v6enterpriselabel = statsutil.BoundedLabel("enterprise", 100)
+	v4vlanlabel       = statsutil.BoundedLabel("VLAN", 4096)
+)
+
+// these are the DHCPv6 message types a server expects to receive from clients
+var clientMessageTypes = map[dhcpv6.MessageType]bool{
+	dhcpv6.MessageTypeSolicit:            true,
+	dhcpv6.MessageTypeRequest:            true,
+	dhcpv6.MessageTypeConfirm:            true,
+	dhcpv6.MessageTypeRenew:              true,
+	dhcpv6.MessageTypeRebind:             true,
+	dhcpv6.MessageTypeRelease:            true,
+	dhcpv6.MessageTypeDecline:            true,
+	dhcpv6.MessageTypeInformationRequest: true,
+}
+
+// these are the DHCPv6 message types only servers send, so a client
+// sending one is confused rather than asking for something we don't serve
+var serverMessageTypes = map[dhcpv6.MessageType]bool{
+	dhcpv6.MessageTypeAdvertise:   true,
+	dhcpv6.MessageTypeReply:       true,
+	dhcpv6.MessageTypeReconfigure: true,
+}
+
+// validChaddr returns false if mac is empty or all zeros.
+func validChaddr(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOUIs parses a comma-separated list of OUIs, each 6 hex digits.
+func parseOUIs(s string) (map[[3]byte]bool, error) {
+	ouis := make(map[[3]byte]bool)
+	for _, field := range strings.Split(s, ",") {
+		b, err := hex.DecodeString(strings.TrimSpace(field))
+		if err != nil || len(b) != 3 {
+			return nil, fmt.Errorf("invalid OUI %q, expected 6 hex digits", field)
+		}
+		ouis[[3]byte{b[0], b[1], b[2]}] = true
+	}
+	return ouis, nil
+}
+
+// ouiClass returns "approved" if mac's OUI is in ouis and "other" otherwise.
+func ouiClass(ouis map[[3]byte]bool, mac net.HardwareAddr) string {
+	if len(mac) >= 3 && ouis[[3]byte{mac[0], mac[1], mac[2]}] {
+		return "approved"
+	}
+	return "other"
+}
+
+// circuitField returns the value of the named group of re in circuit, if
+// re matches and the group participated in the match.
+func circuitField(re *regexp.Regexp, circuit, group string) (string, bool) {
+	idx := re.SubexpIndex(group)
+	if idx < 0 {
+		return "", false
+	}
+	match := re.FindStringSubmatchIndex(circuit)
+	if match == nil || match[2*idx] < 0 {
+		return "", false
+	}
+	return circuit[match[2*idx]:match[2*idx+1]], true
+}
+
+// clientIDMismatch returns whether clientid is an Ethernet client
+// identifier (type 1, RFC 2132 9.14) for a MAC other than chaddr.
+func clientIDMismatch(clientid []byte, chaddr net.HardwareAddr) bool {
+	if len(clientid) != 7 || clientid[0] != 1 {
+		return false
+	}
+	return !bytes.Equal(clientid[1:], chaddr)
+}
+
+// raiVendorData returns the data for enterprise in a Vendor-Specific
+// Information RAI sub-option, which RFC 4243 defines as a sequence of
+// enterprise number (4 bytes), data length (1 byte) and data.
+func raiVendorData(subopt []byte, enterprise uint32) ([]byte, bool) {
+	for len(subopt) >= 5 {
+		length := int(subopt[4])
+		if len(subopt) < 5+length {
+			break
+		}
+		if binary.BigEndian.Uint32(subopt) == enterprise {
+			return subopt[5 : 5+length], true
+		}
+		subopt = subopt[5+length:]
+	}
+	return nil, false
+}
+
+// autoConfigureLabel returns the label for an Auto-Configure option
+// value (RFC 2563).
+func autoConfigureLabel(value []byte) string {
+	if len(value) != 1 {
+		return "invalid"
+	}
+	switch value[0] {
+	case 0:
+		return "DoNotAutoConfigure"
+	case 1:
+		return "AutoConfigure"
+	}
+	return "invalid"
+}
+
+// isInitReboot returns whether req is a REQUEST from a client verifying a
+// remembered lease without a DISCOVER. RFC 2131 4.3.2 distinguishes it
+// from SELECTING, which names the server, and RENEWING and REBINDING,
+// which fill in ciaddr.
+func isInitReboot(req *dhcpv4.DHCPv4) bool {
+	if req.MessageType() != dhcpv4.MessageTypeRequest {
+		return false
+	}
+	if len(req.ClientIPAddr) > 0 && !req.ClientIPAddr.IsUnspecified() {
+		return false
+	}
+	return req.Options.Has(dhcpv4.OptionRequestedIPAddress) && !req.Options.Has(dhcpv4.OptionServerIdentifier)
+}
+
+// relayHops walks at most this many relays deep, however deep a crafted
+// packet nests them
+const maxRelayChain = 32
+
+// relayHops returns the number of relays req passed through, or
+// maxRelayChain+1 if it's deeper than we walk.
+func relayHops(req dhcpv6.DHCPv6) int {
+	hops := 0
+	for msg := req; msg != nil && msg.IsRelay() && hops <= maxRelayChain; hops++ {
+		relay, ok := msg.(*dhcpv6.RelayMessage)
+		if !ok {
+			break
+		}
+		msg = relay.Options.RelayMessage()
+	}
+	return hops
+}
+
+// we track at most this many relays; relays not seen within
+// relayWindow are pruned to make room for new ones
+const (
+	maxRelays   = 1024
+	relayWindow = 24 * time.Hour
 )
 
+// we track the request rate of at most this many interfaces, lumping the
+// rest into statsutil.OtherLabel
+const maxRateInterfaces = 1024
+
+// rateWindow counts requests in each second of a sliding minute.
+type rateWindow struct {
+	counts [60]uint64
+	// the Unix second counts were last updated for
+	last int64
+}
+
+// advance zeroes the seconds that have passed since the window was
+// last updated.
+func (w *rateWindow) advance(now time.Time) {
+	sec := now.Unix()
+	if sec-w.last >= int64(len(w.counts)) {
+		w.counts = [60]uint64{}
+	} else {
+		for s := w.last + 1; s <= sec; s++ {
+			w.counts[s%int64(len(w.counts))] = 0
+		}
+	}
+	if sec > w.last {
+		w.last = sec
+	}
+}
+
+// add counts a request at now and returns the requests in the minute to now.
+func (w *rateWindow) add(now time.Time) uint64 {
+	w.advance(now)
+	w.counts[w.last%int64(len(w.counts))]++
+	return w.total()
+}
+
+func (w *rateWindow) total() uint64 {
+	var total uint64
+	for _, count := range w.counts {
+		total += count
+	}
+	return total
+}
+
+// interfaceRequest counts a request on intf and updates its rate gauge.
+func (state *PluginState) interfaceRequest(intf string) {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	window, ok := state.interfaceRates[intf]
+	if !ok {
+		if len(state.interfaceRates) >= maxRateInterfaces {
+			intf = statsutil.OtherLabel
+			window, ok = state.interfaceRates[intf]
+		}
+		if !ok {
+			window = &rateWindow{last: now.Unix()}
+			state.interfaceRates[intf] = window
+			statsutil.WindowEntries.Inc()
+		}
+	}
+	v6interfacerate.WithLabelValues(intf).Set(float64(window.add(now)))
+}
+
+// refreshInterfaceRates updates the rate gauges of interfaces that have
+// gone quiet, forgetting those idle for a whole window.
+func (state *PluginState) refreshInterfaceRates() {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	for intf, window := range state.interfaceRates {
+		window.advance(now)
+		total := window.total()
+		if total == 0 {
+			delete(state.interfaceRates, intf)
+			statsutil.WindowEntries.Dec()
+			v6interfacerate.DeleteLabelValues(intf)
+			continue
+		}
+		v6interfacerate.WithLabelValues(intf).Set(float64(total))
+	}
+}
+
+// we remember at most maxClients clients for new_client_grace, forgetting
+// those outside it once per clientPruneInterval
+const (
+	maxClients          = 65536
+	clientPruneInterval = time.Minute
+)
+
+// we remember at most maxPending DISCOVERs, each for at most pendingTimeout
+// plus the pendingSweepInterval until we sweep it
+const (
+	maxPending           = 65536
+	pendingTimeout       = time.Minute
+	pendingSweepInterval = time.Minute
+)
+
+// pendingKey identifies a DISCOVER awaiting its REQUEST
+type pendingKey struct {
+	mac string
+	xid dhcpv4.TransactionID
+}
+
+// parameter request lists longer than this are suspicious
+const defaultMaxPRL = 64
+
+// after logging a request rate spike, we don't log another for this long
+const spikeCooldown = time.Minute
+
 type PluginState struct {
-	// we currently have no state; perhaps we might develop some later?
-	//sync.Mutex
+	sync.Mutex
+	statsutil.Clock
+	statsutil.Snapshotter
+	statsutil.TypeLabeler
+	MaxPRL int
+	// MonitorMAC and MonitorDUID, if not nil, identify our synthetic
+	// monitoring client
+	MonitorMAC  net.HardwareAddr
+	MonitorDUID []byte
+	// IgnoreTypes are the lowercased message types left out of the
+	// per-type counters
+	IgnoreTypes map[string]bool
+	// Subnets, if not nil, are the IPv4 subnets the server serves
+	Subnets statsutil.Subnets
+	// Prefixes, if not nil, are the IPv6 prefixes the server serves
+	Prefixes statsutil.Subnets
+	// RelaySubnetMask, if not nil, aggregates relays into subnets
+	RelaySubnetMask net.IPMask
+	// Mirror, if not nil, receives a summary of each request MirrorSample selects
+	Mirror       *Mirror
+	MirrorSample *statsutil.Sampler
+	// RelaySilenceTimeout, if nonzero, is how long a relay can go
+	// without a request before we consider it silent
+	RelaySilenceTimeout time.Duration
+	// OUIAllowlist, if not nil, are the approved client MAC OUIs
+	OUIAllowlist map[[3]byte]bool
+	// RAIEnterprise, if nonzero, is the enterprise whose RAI
+	// Vendor-Specific Information we log
+	RAIEnterprise uint32
+	// CircuitRegex, if not nil, parses circuit IDs; its named groups
+	// (currently just vlan) feed per-group metrics
+	CircuitRegex *regexp.Regexp
+	// MaxHops, if nonzero, is the most relays a DHCPv6 request can pass
+	// through before we drop it
+	MaxHops int
+	// ExpectRelayed logs DHCPv6 requests that didn't come through a relay
+	ExpectRelayed bool
+	// InterfaceIDRegex, if not nil, is what relay Interface-IDs must match
+	InterfaceIDRegex *regexp.Regexp
+	// MaxPDLen, if nonzero, is the shortest IA_PD prefix length hint we
+	// accept; DropLargePD drops requests hinting at anything shorter
+	MaxPDLen    int
+	DropLargePD bool
+	// SpikeThreshold is the requests per second above which we log a
+	// warning, or 0 to disable spike detection
+	SpikeThreshold uint64
+	// NewClientGrace is how long after we last saw a client its DISCOVER
+	// still doesn't count as a new client
+	NewClientGrace time.Duration
+	clients        map[string]time.Time
+	interfaceRates map[string]*rateWindow
+	relays         map[string]time.Time
+	silentRelays   map[string]bool
+	pending        map[pendingKey]time.Time
+	second         int64
+	secondCount    uint64
+	thisMinute     atomic.Uint64
+	talkers        TopTalkers
+	lastSpikeLog   time.Time
+}
+
+// pdHintTooLarge returns whether any IA_PD prefix hint asks for a prefix
+// shorter than maxLen. A hint of length 0 doesn't constrain the length.
+func pdHintTooLarge(iapds []*dhcpv6.OptIAPD, maxLen int) bool {
+	for _, iapd := range iapds {
+		for _, prefix := range iapd.Options.Prefixes() {
+			if prefix.Prefix == nil {
+				continue
+			}
+			if ones, _ := prefix.Prefix.Mask.Size(); ones > 0 && ones < maxLen {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// messageTypeNames returns the lowercased names of the DHCPv4 and DHCPv6
+// message types, which are the names ignore_types accepts.
+func messageTypeNames() map[string]bool {
+	names := make(map[string]bool)
+	for t := 1; t < 256; t++ {
+		for _, name := range []string{dhcpv4.MessageType(t).String(), dhcpv6.MessageType(t).String()} {
+			if !strings.HasPrefix(name, "unknown") {
+				names[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+// foreignIAAddress returns the first address asserted in an IA_NA that
+// isn't in prefixes, or nil if there is none.
+func foreignIAAddress(ianas []*dhcpv6.OptIANA, prefixes statsutil.Subnets) net.IP {
+	for _, iana := range ianas {
+		for _, addr := range iana.Options.Addresses() {
+			if addr.IPv6Addr != nil && !addr.IPv6Addr.IsUnspecified() && !prefixes.Contains(addr.IPv6Addr) {
+				return addr.IPv6Addr
+			}
+		}
+	}
+	return nil
+}
+
+// sweepPending forgets DISCOVERs older than pendingTimeout, whose REQUESTs
+// we no longer observe.
+func (state *PluginState) sweepPending() {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	for key, seen := range state.pending {
+		if now.Sub(seen) > pendingTimeout {
+			delete(state.pending, key)
+			statsutil.PendingRequests.Dec()
+		}
+	}
+}
+
+// discoverToRequest remembers DISCOVERs and, when the REQUEST for the
+// same transaction arrives, observes the delay between them.
+func (state *PluginState) discoverToRequest(req *dhcpv4.DHCPv4) {
+	key := pendingKey{req.ClientHWAddr.String(), req.TransactionID}
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		if _, ok := state.pending[key]; !ok {
+			if len(state.pending) >= maxPending {
+				// without room until the next sweep, skip it
+				return
+			}
+			statsutil.PendingRequests.Inc()
+		}
+		state.pending[key] = now
+	case dhcpv4.MessageTypeRequest:
+		seen, ok := state.pending[key]
+		if !ok {
+			return
+		}
+		delete(state.pending, key)
+		statsutil.PendingRequests.Dec()
+		if delay := now.Sub(seen); delay <= pendingTimeout {
+			v4discovertorequest.WithLabelValues().Observe(delay.Seconds())
+		}
+	}
+}
+
+// isNewClient records a request from mac and reports whether it's a
+// DISCOVER from a client we haven't seen within NewClientGrace, so a
+// client that retries after a NAK isn't counted again.
+func (state *PluginState) isNewClient(mac string, discover bool) bool {
+	if state.NewClientGrace == 0 {
+		return discover
+	}
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	last, known := state.clients[mac]
+	if !known && len(state.clients) >= maxClients {
+		// without room to remember it, assume the client is new
+		return discover
+	}
+	if !known {
+		statsutil.WindowEntries.Inc()
+	}
+	state.clients[mac] = now
+	return discover && (!known || now.Sub(last) > state.NewClientGrace)
+}
+
+// pruneClients forgets clients not seen within NewClientGrace, whose next
+// DISCOVER counts as new anyway.
+func (state *PluginState) pruneClients() {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	for mac, seen := range state.clients {
+		if now.Sub(seen) > state.NewClientGrace {
+			delete(state.clients, mac)
+			statsutil.WindowEntries.Dec()
+		}
+	}
+}
+
+// checkSpike logs a warning if count, the number of requests in the most
+// recent second, exceeds SpikeThreshold and we haven't logged recently.
+// It returns true if it logged.
+func (state *PluginState) checkSpike(count uint64) bool {
+	if state.SpikeThreshold == 0 || count <= state.SpikeThreshold {
+		return false
+	}
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	if !state.lastSpikeLog.IsZero() && now.Sub(state.lastSpikeLog) < spikeCooldown {
+		return false
+	}
+	state.lastSpikeLog = now
+	log.Warningf("request rate spike: %d requests/second exceeds threshold %d", count, state.SpikeThreshold)
+	return true
+}
+
+// countSecond counts a request in the current second and, when it's the
+// first request of a new second, checks the second before for a spike.
+// A spike keeps requests coming, so we needn't check on a timer.
+func (state *PluginState) countSecond() {
+	now := state.Now().Unix()
+	state.Lock()
+	var ended uint64
+	if now != state.second {
+		ended = state.secondCount
+		state.second = now
+		state.secondCount = 0
+	}
+	state.secondCount++
+	state.Unlock()
+	state.checkSpike(ended)
+}
+
+// updateMinuteRate sets the requests per minute gauge for family to the
+// number of requests counted since the last update.
+func (state *PluginState) updateMinuteRate(family string) {
+	perminute.WithLabelValues(family).Set(float64(state.thisMinute.Swap(0)))
+	state.refreshInterfaceRates()
+}
+
+// sampleMinuteRate updates the requests per minute gauge for family on
+// every tick of a one minute ticker, until CloseAll. Each instance
+// handles one family, so it only updates that family's gauge.
+func (state *PluginState) sampleMinuteRate(family string) *statsutil.Periodic {
+	return statsutil.Every(state.Clock, time.Minute, func() { state.updateMinuteRate(family) })
+}
+
+// relaySeen records a request from relay, updating its last-seen gauge
+// and observing the time since its previous request.
+func (state *PluginState) relaySeen(relay string) {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	last, known := state.relays[relay]
+	if known {
+		v4relayinterarrival.WithLabelValues().Observe(now.Sub(last).Seconds())
+	}
+	if state.silentRelays[relay] {
+		delete(state.silentRelays, relay)
+		log.Infof("relay %s is no longer silent", relay)
+	}
+	if !known && len(state.relays) >= maxRelays {
+		for r, seen := range state.relays {
+			if now.Sub(seen) > relayWindow {
+				delete(state.relays, r)
+				statsutil.WindowEntries.Dec()
+				v4relaylastseen.DeleteLabelValues(r)
+			}
+		}
+		if len(state.relays) >= maxRelays {
+			log.Warningf("tracking too many relays, not tracking %s", relay)
+			return
+		}
+	}
+	if !known {
+		statsutil.WindowEntries.Inc()
+	}
+	state.relays[relay] = now
+	v4relaylastseen.WithLabelValues(relay).Set(float64(now.UnixNano()) / 1e9)
+}
+
+// checkSilentRelays sets the silent relays gauge and logs each relay
+// when it first goes silent. It returns the number of silent relays.
+func (state *PluginState) checkSilentRelays() int {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	silent := make(map[string]bool)
+	for relay, seen := range state.relays {
+		idle := now.Sub(seen)
+		if idle <= state.RelaySilenceTimeout || idle > relayWindow {
+			continue
+		}
+		silent[relay] = true
+		if !state.silentRelays[relay] {
+			log.Warningf("relay %s has been silent for %s", relay, idle.Round(time.Second))
+		}
+	}
+	state.silentRelays = silent
+	v4silentrelays.Set(float64(len(silent)))
+	return len(silent)
+}
+
+// watchRelays checks for silent relays on every tick of a one minute
+// ticker, until CloseAll.
+func (state *PluginState) watchRelays() *statsutil.Periodic {
+	return statsutil.Every(state.Clock, time.Minute, func() { state.checkSilentRelays() })
+}
+
+// isMonitor4 reports whether req comes from the monitor_mac client.
+func (state *PluginState) isMonitor4(req *dhcpv4.DHCPv4) bool {
+	return state.MonitorMAC != nil && bytes.Equal(req.ClientHWAddr, state.MonitorMAC)
+}
+
+// isMonitor6 reports whether req comes from the monitor_duid client. A
+// request we can't decapsulate isn't, so its failure still gets counted.
+func (state *PluginState) isMonitor6(req dhcpv6.DHCPv6) bool {
+	if state.MonitorDUID == nil {
+		return false
+	}
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		return false
+	}
+	duid := msg.Options.ClientID()
+	return duid != nil && bytes.Equal(duid.ToBytes(), state.MonitorDUID)
 }
 
 func (state *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if state.isMonitor6(req) {
+		// synthetic monitoring shouldn't skew our dashboards
+		monitorrequests.WithLabelValues("v6").Inc()
+		return resp, false
+	}
+	outcome := "ok"
+	defer func() { handled.WithLabelValues("v6", outcome).Inc() }()
+	if state.SpikeThreshold > 0 {
+		state.countSecond()
+	}
+	state.thisMinute.Add(1)
+	if resp == nil {
+		// we never dereference resp, so we can keep counting the request
+		nilresp.WithLabelValues("v6").Inc()
+	}
+	var msg *dhcpv6.Message
+	// the innermost relay's Interface-ID, if any
+	var intf []byte
 	if req.IsRelay() {
 		v6relay.Inc()
+		if relay, ok := req.(*dhcpv6.RelayMessage); ok {
+			v6relaypeer.WithLabelValues(v6peerlabel(relay.PeerAddr.String())).Inc()
+		}
+		hops := relayHops(req)
+		if state.MaxHops > 0 && hops > state.MaxHops {
+			// probably a relay loop
+			v6maxhops.Inc()
+			outcome = "dropped"
+			log.Warningf("dropping request relayed through more than %d relays: %s", state.MaxHops, req)
+			return nil, true
+		}
+		v6relayhops.WithLabelValues().Observe(float64(hops))
+		// inner will be the innermost relay message
+		innermsg, err := dhcpv6.DecapsulateRelayIndex(req, -1)
+		if err != nil {
+			v6types.WithLabelValues("error").Inc()
+			outcome = "error"
+			v6extractfailures.Inc()
+			log.Errorf("could not decapsulate: %v", err)
+			return nil, true
+		}
+		inner, ok := innermsg.(*dhcpv6.RelayMessage)
+		if !ok {
+			v6types.WithLabelValues("error").Inc()
+			outcome = "error"
+			log.Errorf("relay message format bug: %v", innermsg)
+			return nil, true
+		}
+		if msg, err = inner.GetInnerMessage(); err != nil {
+			v6types.WithLabelValues("error").Inc()
+			outcome = "error"
+			v6extractfailures.Inc()
+			log.Errorf("could not decapsulate inner message: %v", err)
+			return nil, true
+		}
+		if inner.LinkAddr == nil || inner.LinkAddr.IsUnspecified() {
+			// the server can only select a subnet by Interface-ID
+			v6unspecifiedlink.Inc()
+			log.Infof("relay %s forwarded with an unspecified link address", inner.PeerAddr)
+		}
+		intf = inner.Options.InterfaceID()
+		if state.InterfaceIDRegex != nil && !state.InterfaceIDRegex.Match(intf) {
+			v6badinterfaceid.Inc()
+			log.Warningf("relay for link %s sent malformed Interface-ID %q: %s", inner.LinkAddr, intf, req)
+		}
 	} else {
-		_, ok := req.(*dhcpv6.Message)
+		direct, ok := req.(*dhcpv6.Message)
 		if !ok {
 			v6types.WithLabelValues("error").Inc()
+			outcome = "error"
 			log.Errorf("request message format bug: %v", req)
 			return nil, true
 		}
+		msg = direct
+		v6direct.Inc()
+		if state.ExpectRelayed {
+			// a rogue device or a misconfigured network
+			log.Warningf("unrelayed request: %s", msg)
+		}
 	}
-	// inner will be the innermost relay message
-	innermsg, err := dhcpv6.DecapsulateRelayIndex(req, -1)
-	if err != nil {
-		v6types.WithLabelValues("error").Inc()
-		log.Errorf("could not decapsulate: %v", err)
-		return nil, true
+	// relay messages carry no transaction ID, so only the client's can
+	// be wrong; clients choose it at random, so zero suggests a bug or
+	// tampering
+	if msg.TransactionID == (dhcpv6.TransactionID{}) {
+		v6txidanomaly.Inc()
+		log.Warningf("request with zero transaction ID: %s", msg)
 	}
-	inner, ok := innermsg.(*dhcpv6.RelayMessage)
-	if !ok {
-		v6types.WithLabelValues("error").Inc()
-		log.Errorf("relay message format bug: %v", innermsg)
-		return nil, true
+	// every type counts here, including those we count again below as
+	// unexpected or unhandled
+	if state.IgnoreTypes[strings.ToLower(msg.Type().String())] {
+		ignoredtypes.WithLabelValues("v6").Inc()
+	} else {
+		v6types.WithLabelValues(state.TypeLabel(msg.Type())).Inc()
 	}
-	msg, err := inner.GetInnerMessage()
-	if err != nil {
-		v6types.WithLabelValues("error").Inc()
-		log.Errorf("could not decapsulate inner message: %v", err)
-		return nil, true
+	if serverMessageTypes[msg.Type()] {
+		v6unexpected.WithLabelValues(state.TypeLabel(msg.Type())).Inc()
+		log.Debugf("client sent a %s: %s", msg.Type(), req)
+		return resp, false
+	}
+	if !clientMessageTypes[msg.Type()] {
+		// e.g. LeaseQuery: valid, but not something we serve
+		v6unhandled.WithLabelValues(state.TypeLabel(msg.Type())).Inc()
+		return resp, false
+	}
+	state.talkers.Count("type", state.TypeLabel(msg.Type()))
+	if relay, ok := req.(*dhcpv6.RelayMessage); ok {
+		state.talkers.Count("relay", relay.PeerAddr.String())
+	}
+	if len(intf) > 0 {
+		state.talkers.Count("circuit_id", statsutil.SanitizeLabel(string(intf)))
+		state.interfaceRequest(statsutil.SanitizeLabel(string(intf)))
+	}
+	optioncount.WithLabelValues("v6").Observe(float64(len(msg.Options.Options)))
+	// RFC 8415 requires Elapsed Time in every client message type
+	if msg.GetOneOption(dhcpv6.OptionElapsedTime) == nil {
+		v6noelapsed.WithLabelValues(state.TypeLabel(msg.Type())).Inc()
+	}
+	switch msg.Type() {
+	case dhcpv6.MessageTypeRenew:
+		v6renewrebind.WithLabelValues("renew").Inc()
+	case dhcpv6.MessageTypeRebind:
+		// the client couldn't reach the server that gave it its lease
+		v6renewrebind.WithLabelValues("rebind").Inc()
 	}
-	v6types.WithLabelValues(msg.Type().String()).Inc()
 	if ianas := len(msg.Options.IANA()); ianas > 0 {
 		v6ia.WithLabelValues("IA_NA").Add(float64(ianas))
 	}
+	if state.Prefixes != nil {
+		if addr := foreignIAAddress(msg.Options.IANA(), state.Prefixes); addr != nil {
+			// the server should tell the client it's NotOnLink
+			v6foreignaddr.Inc()
+			log.Debugf("DUID %s asserted address %s we don't serve", msg.Options.ClientID(), addr)
+		}
+	}
 	if iatas := len(msg.Options.IATA()); iatas > 0 {
 		v6ia.WithLabelValues("IA_TA").Add(float64(iatas))
 	}
 	if iapds := len(msg.Options.IAPD()); iapds > 0 {
 		v6ia.WithLabelValues("IA_PD").Add(float64(iapds))
 	}
+	if fqdn := msg.Options.FQDN(); fqdn != nil {
+		// RFC 4704 4.1: the S bit asks the server to update the AAAA RR
+		v6fqdn.WithLabelValues(strconv.FormatBool(fqdn.Flags&0x01 != 0)).Inc()
+	}
+	for _, code := range msg.Options.RequestedOptions() {
+		if code == dhcpv6.OptionDNSRecursiveNameServer {
+			v6requestingdns.Inc()
+			break
+		}
+	}
+	if state.MaxPDLen > 0 && pdHintTooLarge(msg.Options.IAPD(), state.MaxPDLen) {
+		v6pdtoolarge.Inc()
+		if state.DropLargePD {
+			outcome = "dropped"
+			log.Warningf("dropping request with IA_PD hint shorter than /%d: %s", state.MaxPDLen, msg)
+			return nil, true
+		}
+	}
+	for _, class := range msg.Options.UserClasses() {
+		userclass.WithLabelValues("v6", v6userclasslabel(statsutil.SanitizeLabel(string(class)))).Inc()
+	}
+	for _, opt := range msg.Options.Get(dhcpv6.OptionVendorClass) {
+		if vc, ok := opt.(*dhcpv6.OptVendorClass); ok {
+			v6enterprise.WithLabelValues(v6enterpriselabel(strconv.FormatUint(uint64(vc.EnterpriseNumber), 10))).Inc()
+		}
+	}
 	if msg.Type() == dhcpv6.MessageTypeSolicit && msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
 		v6rapidcommit.Inc()
 	}
+	if state.Mirror != nil && state.MirrorSample.Sample() {
+		summary := RequestSummary{
+			Time:      state.Now(),
+			Family:    "v6",
+			Type:      state.TypeLabel(msg.Type()),
+			Interface: string(intf),
+		}
+		if duid := msg.Options.ClientID(); duid != nil {
+			summary.Client = duid.String()
+		}
+		if relay, ok := req.(*dhcpv6.RelayMessage); ok {
+			summary.Relay = relay.PeerAddr.String()
+		}
+		state.Mirror.Send(summary)
+	}
 	return resp, false
 }
 
 func (state *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if state.isMonitor4(req) {
+		// synthetic monitoring shouldn't skew our dashboards
+		monitorrequests.WithLabelValues("v4").Inc()
+		return resp, false
+	}
+	outcome := "ok"
+	defer func() { handled.WithLabelValues("v4", outcome).Inc() }()
+	if state.SpikeThreshold > 0 {
+		state.countSecond()
+	}
+	state.thisMinute.Add(1)
+	if resp == nil {
+		// we never dereference resp, so we can keep counting the request
+		nilresp.WithLabelValues("v4").Inc()
+	}
 	if req.OpCode != dhcpv4.OpcodeBootRequest {
 		v4types.WithLabelValues("ignored").Inc()
+		outcome = "error"
+		// the op code is a byte, which bounds the label's cardinality
+		v4ignoredopcode.WithLabelValues(strconv.Itoa(int(req.OpCode))).Inc()
 		log.Warningf("not a BootRequest, ignoring %d", req.OpCode)
 		return resp, false
 	}
-	v4types.WithLabelValues(req.MessageType().String()).Inc()
+	if req.Options.Has(dhcpv4.OptionDHCPMessageType) {
+		if state.IgnoreTypes[strings.ToLower(req.MessageType().String())] {
+			ignoredtypes.WithLabelValues("v4").Inc()
+		} else {
+			v4types.WithLabelValues(state.TypeLabel(req.MessageType())).Inc()
+		}
+		state.talkers.Count("type", state.TypeLabel(req.MessageType()))
+	} else {
+		v4bootp.Inc()
+	}
+	optioncount.WithLabelValues("v4").Observe(float64(len(req.Options)))
+	v4secs.WithLabelValues().Observe(float64(req.NumSeconds))
+	if size, err := req.MaxMessageSize(); err == nil {
+		v4maxmsgsize.WithLabelValues().Observe(float64(size))
+		if size < minMaxMessageSize {
+			log.Warningf("MAC %s advertised max message size %d, replies may be truncated", req.ClientHWAddr, size)
+		}
+	}
+	if state.Mirror != nil && state.MirrorSample.Sample() {
+		summary := RequestSummary{
+			Time:   state.Now(),
+			Family: "v4",
+			Type:   state.TypeLabel(req.MessageType()),
+			Client: req.ClientHWAddr.String(),
+		}
+		if len(req.GatewayIPAddr) > 0 && !req.GatewayIPAddr.IsUnspecified() {
+			summary.Relay = req.GatewayIPAddr.String()
+		}
+		if rai := req.RelayAgentInfo(); rai != nil {
+			summary.Interface = statsutil.SanitizeLabel(dhcpv4.GetString(dhcpv4.AgentCircuitIDSubOption, (*rai).Options))
+		}
+		state.Mirror.Send(summary)
+	}
+	state.discoverToRequest(req)
+	if state.isNewClient(req.ClientHWAddr.String(), req.MessageType() == dhcpv4.MessageTypeDiscover) {
+		v4newclients.Inc()
+	}
+	if !validChaddr(req.ClientHWAddr) {
+		v4invalidchaddr.Inc()
+		log.Warningf("DHCPv4 request with invalid chaddr %q: %s", req.ClientHWAddr, req)
+	}
+	if state.OUIAllowlist != nil {
+		v4ouiclass.WithLabelValues(ouiClass(state.OUIAllowlist, req.ClientHWAddr)).Inc()
+	}
+	if value := req.Options.Get(dhcpv4.OptionAutoConfigure); value != nil {
+		v4autoconfigure.WithLabelValues(autoConfigureLabel(value)).Inc()
+	}
+	if isInitReboot(req) {
+		v4initreboot.Inc()
+	}
+	if clientid := req.Options.Get(dhcpv4.OptionClientIdentifier); clientid == nil {
+		v4noclientid.Inc()
+		log.Debugf("MAC %s sent no client identifier", req.ClientHWAddr)
+	} else if clientIDMismatch(clientid, req.ClientHWAddr) {
+		v4clientidmismatch.Inc()
+		log.Debugf("MAC %s sent client identifier for %s", req.ClientHWAddr, net.HardwareAddr(clientid[1:]))
+	}
+	if req.MessageType() == dhcpv4.MessageTypeDiscover && req.RequestedIPAddress() != nil {
+		v4discoverhint.Inc()
+	}
+	if ip := req.RequestedIPAddress(); ip != nil && state.Subnets != nil && !state.Subnets.Contains(ip) {
+		// the server should NAK this
+		v4outofscope.Inc()
+	}
+	if prl := len(req.ParameterRequestList()); prl > state.MaxPRL {
+		v4oversizedprl.Inc()
+		log.Warningf("MAC %s sent a Parameter Request List of %d options", req.ClientHWAddr, prl)
+	}
+	for _, class := range req.UserClass() {
+		userclass.WithLabelValues("v4", v4userclasslabel(statsutil.SanitizeLabel(class))).Inc()
+	}
+	// iana.Arch maps unassigned values to "unknown", bounding cardinality
+	for _, arch := range req.ClientArch() {
+		v4clientarch.WithLabelValues(arch.String()).Inc()
+	}
 	rai := req.RelayAgentInfo()
 	giaddr_invalid := len(req.GatewayIPAddr) == 0 || req.GatewayIPAddr.IsUnspecified()
 	if rai == nil || giaddr_invalid {
@@ -134,10 +1165,36 @@ func (state *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bo
 		return resp, false
 	}
 	v4relay.Inc()
+	state.relaySeen(req.GatewayIPAddr.String())
+	state.talkers.Count("relay", req.GatewayIPAddr.String())
+	if state.RelaySubnetMask != nil {
+		subnet := net.IPNet{IP: req.GatewayIPAddr.Mask(state.RelaySubnetMask), Mask: state.RelaySubnetMask}
+		v4relaysubnet.WithLabelValues(subnet.String()).Inc()
+	}
 	if ip := dhcpv4.GetIP(dhcpv4.LinkSelectionSubOption, (*rai).Options); ip == nil {
 		v4raimissingsuboptions.WithLabelValues("LinkSelectionSubOption").Inc()
 	}
+	if vendor := (*rai).Options.Get(dhcpv4.VendorSpecificInformationSubOption); vendor != nil {
+		v4raivendor.Inc()
+		if state.RAIEnterprise != 0 {
+			if data, ok := raiVendorData(vendor, state.RAIEnterprise); ok {
+				log.Debugf("relay %s sent enterprise %d RAI data %q", req.GatewayIPAddr, state.RAIEnterprise, data)
+			}
+		}
+	}
 	intfstr := dhcpv4.GetString(dhcpv4.AgentCircuitIDSubOption, (*rai).Options)
+	if !utf8.ValidString(intfstr) {
+		// statsutil.SanitizeLabel hex-encodes these wherever we use them as labels
+		v4binarycircuitid.Inc()
+	}
+	if len(intfstr) > 0 {
+		state.talkers.Count("circuit_id", statsutil.SanitizeLabel(intfstr))
+		if state.CircuitRegex != nil {
+			if vlan, ok := circuitField(state.CircuitRegex, intfstr, "vlan"); ok {
+				v4vlan.WithLabelValues(v4vlanlabel(statsutil.SanitizeLabel(vlan))).Inc()
+			}
+		}
+	}
 	if len(intfstr) == 0 {
 		if intfstr = dhcpv4.GetString(dhcpv4.AgentRemoteIDSubOption, (*rai).Options); len(intfstr) == 0 {
 			v4raimissingsuboptions.WithLabelValues("AgentIDSubOption").Inc()
@@ -148,10 +1205,220 @@ func (state *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bo
 
 func setup6(args ...string) (handler.Handler6, error) {
 	var state PluginState
+	if err := state.FromArgs(args...); err != nil {
+		return nil, err
+	}
+	state.sampleMinuteRate("v6")
+	instancesMu.Lock()
+	instances = append(instances, &state)
+	instancesMu.Unlock()
 	return state.Handler6, nil
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
 	var state PluginState
+	if err := state.FromArgs(args...); err != nil {
+		return nil, err
+	}
+	state.sampleMinuteRate("v4")
+	if state.RelaySilenceTimeout > 0 {
+		// only DHCPv4 tracks relays
+		state.watchRelays()
+	}
+	// only DHCPv4 times DISCOVERs to REQUESTs
+	statsutil.Every(state.Clock, pendingSweepInterval, state.sweepPending)
+	if state.NewClientGrace > 0 {
+		// only DHCPv4 counts new clients
+		statsutil.Every(state.Clock, clientPruneInterval, state.pruneClients)
+	}
+	instancesMu.Lock()
+	instances = append(instances, &state)
+	instancesMu.Unlock()
 	return state.Handler4, nil
 }
+
+func (state *PluginState) FromArgs(args ...string) error {
+	args, fileKeys, err := statsutil.ExpandConfigArgs(args)
+	if err != nil {
+		return err
+	}
+	if args, err = histograms.ApplyArgs(args); err != nil {
+		return err
+	}
+	state.Clock = statsutil.RealClock
+	state.MaxPRL = defaultMaxPRL
+	state.relays = make(map[string]time.Time)
+	state.clients = make(map[string]time.Time)
+	state.interfaceRates = make(map[string]*rateWindow)
+	state.pending = make(map[pendingKey]time.Time)
+	mirrorURL := ""
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "max_prl":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid max_prl %q", value)
+			}
+			state.MaxPRL = n
+		case "subnets":
+			subnets, err := statsutil.ParseSubnets(value)
+			if err != nil {
+				return fmt.Errorf("invalid subnets %q: %v", value, err)
+			}
+			state.Subnets = subnets.Family(true)
+			state.Prefixes = subnets.Family(false)
+		case "relay_subnet_mask":
+			bits, err := strconv.Atoi(strings.TrimPrefix(value, "/"))
+			if err != nil || bits < 0 || bits > 32 {
+				return fmt.Errorf("invalid relay_subnet_mask %q, expected /0 to /32", value)
+			}
+			state.RelaySubnetMask = net.CIDRMask(bits, 32)
+		case "control_socket":
+			if _, err := statsutil.ServeControlSocket(value); err != nil {
+				return fmt.Errorf("cannot serve control socket %s: %v", value, err)
+			}
+		case "statsd":
+			if _, err := statsutil.OpenStatsD(value); err != nil {
+				return fmt.Errorf("cannot send to statsd %s: %v", value, err)
+			}
+		case "heartbeat":
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return fmt.Errorf("invalid heartbeat %q", value)
+			}
+			statsutil.StartHeartbeat("requeststats", interval, state.Clock)
+		case "mirror_url":
+			if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid mirror_url %q, must be an http or https URL", value)
+			}
+			mirrorURL = value
+		case "sample":
+			sampler, err := statsutil.ParseSampler(value)
+			if err != nil {
+				return err
+			}
+			state.MirrorSample = sampler
+		case "new_client_grace":
+			grace, err := time.ParseDuration(value)
+			if err != nil || grace < 0 {
+				return fmt.Errorf("invalid new_client_grace %q", value)
+			}
+			state.NewClientGrace = grace
+		case "relay_silence_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 || timeout >= relayWindow {
+				return fmt.Errorf("invalid relay_silence_timeout %q, must be positive and under %s", value, relayWindow)
+			}
+			state.RelaySilenceTimeout = timeout
+		case "oui_allowlist":
+			ouis, err := parseOUIs(value)
+			if err != nil {
+				return err
+			}
+			state.OUIAllowlist = ouis
+		case "rai_enterprise":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || n == 0 {
+				return fmt.Errorf("invalid rai_enterprise %q", value)
+			}
+			state.RAIEnterprise = uint32(n)
+		case "circuit_regex":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return fmt.Errorf("invalid circuit_regex %q: %v", value, err)
+			}
+			if re.SubexpIndex("vlan") < 0 {
+				return fmt.Errorf("circuit_regex %q has no vlan group", value)
+			}
+			state.CircuitRegex = re
+		case "monitor_mac":
+			mac, err := net.ParseMAC(value)
+			if err != nil {
+				return fmt.Errorf("invalid monitor_mac %q: %v", value, err)
+			}
+			state.MonitorMAC = mac
+		case "monitor_duid":
+			duid, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+			if err != nil || len(duid) == 0 {
+				return fmt.Errorf("invalid monitor_duid %q, expected hex", value)
+			}
+			state.MonitorDUID = duid
+		case "ignore_types":
+			state.IgnoreTypes = make(map[string]bool)
+			known := messageTypeNames()
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.ToLower(strings.TrimSpace(name)); len(name) > 0 {
+					if !known[name] {
+						return fmt.Errorf("invalid ignore_types %q, %q is not a DHCP message type", value, name)
+					}
+					state.IgnoreTypes[name] = true
+				}
+			}
+		case "max_hops":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxRelayChain {
+				return fmt.Errorf("invalid max_hops %q, expected 1 to %d", value, maxRelayChain)
+			}
+			state.MaxHops = n
+		case "expect_relayed":
+			expect := true
+			if len(value) > 0 {
+				var err error
+				if expect, err = strconv.ParseBool(value); err != nil {
+					return fmt.Errorf("invalid expect_relayed %q", value)
+				}
+			}
+			state.ExpectRelayed = expect
+		case "interfaceid_regex":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return fmt.Errorf("invalid interfaceid_regex %q: %v", value, err)
+			}
+			state.InterfaceIDRegex = re
+		case "max_pd_len":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 128 {
+				return fmt.Errorf("invalid max_pd_len %q, expected 1 to 128", value)
+			}
+			state.MaxPDLen = n
+		case "drop_large_pd":
+			drop := true
+			if len(value) > 0 {
+				var err error
+				if drop, err = strconv.ParseBool(value); err != nil {
+					return fmt.Errorf("invalid drop_large_pd %q", value)
+				}
+			}
+			state.DropLargePD = drop
+		case "spike_threshold":
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid spike_threshold %q", value)
+			}
+			state.SpikeThreshold = n
+		case "label_case":
+			if err := state.SetLabelCase(value); err != nil {
+				return err
+			}
+		default:
+			if fileKeys[key] {
+				return fmt.Errorf("unknown key %q in config file", key)
+			}
+			// we used to ignore every argument, so don't fail on old configs
+			log.Warningf("ignoring unknown argument %q", arg)
+		}
+	}
+	if len(mirrorURL) > 0 {
+		if state.MirrorSample == nil {
+			state.MirrorSample = &statsutil.Sampler{N: 1}
+		}
+		state.Mirror = NewMirror(mirrorURL)
+	} else if state.MirrorSample != nil {
+		return fmt.Errorf("sample requires mirror_url")
+	}
+	if state.DropLargePD && state.MaxPDLen == 0 {
+		return fmt.Errorf("drop_large_pd requires max_pd_len")
+	}
+	return nil
+}
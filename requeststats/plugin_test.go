@@ -0,0 +1,1787 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package requeststats
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+
+	"dhcpserver/statsutil"
+)
+
+// newTestState returns a PluginState configured from args, whose clock
+// is the returned MockClock.
+func newTestState(t *testing.T, args ...string) (*PluginState, *statsutil.MockClock) {
+	t.Helper()
+	var state PluginState
+	if err := state.FromArgs(args...); err != nil {
+		t.Fatalf("FromArgs(%q): %v", args, err)
+	}
+	clock := statsutil.NewMockClock()
+	state.Clock = clock
+	return &state, clock
+}
+
+func TestFromArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"no args", nil, false},
+		{"max_prl", []string{"max_prl=10"}, false},
+		{"max_prl negative", []string{"max_prl=-1"}, true},
+		{"max_prl not a number", []string{"max_prl=many"}, true},
+		{"subnets", []string{"subnets=10.0.0.0/8,2001:db8::/32"}, false},
+		{"subnets invalid", []string{"subnets=10.0.0.0/33"}, true},
+		{"relay_subnet_mask", []string{"relay_subnet_mask=/24"}, false},
+		{"relay_subnet_mask too long", []string{"relay_subnet_mask=/33"}, true},
+		{"heartbeat zero", []string{"heartbeat=0s"}, true},
+		{"sample without mirror_url", []string{"sample=1/10"}, true},
+		{"sample invalid", []string{"sample=2/10"}, true},
+		{"mirror_url", []string{"mirror_url=http://collector.example:8080/requests", "sample=1/10"}, false},
+		{"mirror_url without scheme", []string{"mirror_url=collector.example:8080"}, true},
+		{"mirror_url not http", []string{"mirror_url=ftp://collector.example/"}, true},
+		{"mirror_url without host", []string{"mirror_url=http:///requests"}, true},
+		{"mirror_url malformed", []string{"mirror_url=http://[::1/"}, true},
+		{"new_client_grace negative", []string{"new_client_grace=-1s"}, true},
+		{"relay_silence_timeout too long", []string{"relay_silence_timeout=24h"}, true},
+		{"oui_allowlist", []string{"oui_allowlist=001122,AABBCC"}, false},
+		{"oui_allowlist short", []string{"oui_allowlist=0011"}, true},
+		{"rai_enterprise zero", []string{"rai_enterprise=0"}, true},
+		{"circuit_regex", []string{`circuit_regex=vlan(?P<vlan>\d+)`}, false},
+		{"circuit_regex invalid", []string{"circuit_regex=("}, true},
+		{"circuit_regex without vlan", []string{`circuit_regex=port(\d+)`}, true},
+		{"monitor_mac invalid", []string{"monitor_mac=zz"}, true},
+		{"monitor_duid", []string{"monitor_duid=00:01:02:03"}, false},
+		{"monitor_duid invalid", []string{"monitor_duid=xyz"}, true},
+		{"max_hops zero", []string{"max_hops=0"}, true},
+		{"max_hops too deep", []string{"max_hops=33"}, true},
+		{"expect_relayed", []string{"expect_relayed"}, false},
+		{"expect_relayed invalid", []string{"expect_relayed=maybe"}, true},
+		{"interfaceid_regex invalid", []string{"interfaceid_regex=["}, true},
+		{"max_pd_len too long", []string{"max_pd_len=129"}, true},
+		{"drop_large_pd", []string{"max_pd_len=56", "drop_large_pd"}, false},
+		{"drop_large_pd without max_pd_len", []string{"drop_large_pd"}, true},
+		{"drop_large_pd false without max_pd_len", []string{"drop_large_pd=false"}, false},
+		{"drop_large_pd invalid", []string{"max_pd_len=56", "drop_large_pd=sometimes"}, true},
+		{"spike_threshold negative", []string{"spike_threshold=-1"}, true},
+		{"label_case", []string{"label_case=lower"}, false},
+		{"label_case invalid", []string{"label_case=upper"}, true},
+		{"ignore_types", []string{"ignore_types=Solicit, INFORM,relay-forw"}, false},
+		{"ignore_types unknown", []string{"ignore_types=solicit,hello"}, true},
+		{"unknown bucket histogram", []string{"buckets_dhcp_no_such_histogram=1"}, true},
+		{"buckets", []string{"buckets_dhcpv6_relay_hops=1,2,4,8"}, false},
+		{"responsestats histogram", []string{"buckets_dhcp_amplification_factor=1,2"}, true},
+		// old configs may still carry these
+		{"unknown argument", []string{"no_such_argument=1", "bare"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state PluginState
+			if err := state.FromArgs(tt.args...); (err != nil) != tt.wantErr {
+				t.Errorf("FromArgs(%q) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		config  string
+		inline  []string
+		wantErr bool
+	}{
+		{"known keys", `{"max_prl": 10}`, nil, false},
+		{"unknown key in file", `{"max_prl": 10, "colour": "blue"}`, nil, true},
+		{"unknown inline arg", `{"max_prl": 10}`, []string{"colour=blue"}, false},
+	}
+	for idx, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("config%d.json", idx))
+		if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var state PluginState
+		err := state.FromArgs(append([]string{"config=" + path}, tt.inline...)...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: FromArgs error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOversizedPRL(t *testing.T) {
+	state, _ := newTestState(t, "max_prl=2")
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tests := []struct {
+		name string
+		prl  []dhcpv4.OptionCode
+		want float64
+	}{
+		{"short", []dhcpv4.OptionCode{dhcpv4.OptionRouter}, 0},
+		{"at limit", []dhcpv4.OptionCode{dhcpv4.OptionRouter, dhcpv4.OptionDomainNameServer}, 0},
+		{"over limit", []dhcpv4.OptionCode{dhcpv4.OptionRouter, dhcpv4.OptionDomainNameServer, dhcpv4.OptionNTPServers}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithRequestedOptions(tt.prl...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// NewDiscovery asks for a few options of its own
+			req.UpdateOption(dhcpv4.OptParameterRequestList(tt.prl...))
+			got := statsutil.Delta(func() { state.Handler4(req, nil) })["dhcpv4_oversized_prl_total"]
+			if got != tt.want {
+				t.Errorf("oversized PRLs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidChaddr(t *testing.T) {
+	tests := []struct {
+		name string
+		mac  net.HardwareAddr
+		want bool
+	}{
+		{"nil", nil, false},
+		{"empty", net.HardwareAddr{}, false},
+		{"all zeros", net.HardwareAddr{0, 0, 0, 0, 0, 0}, false},
+		{"ethernet", net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}, true},
+		{"last byte set", net.HardwareAddr{0, 0, 0, 0, 0, 1}, true},
+		{"short", net.HardwareAddr{1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validChaddr(tt.mac); got != tt.want {
+				t.Errorf("validChaddr(%v) = %v, want %v", tt.mac, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSpike(t *testing.T) {
+	state, clock := newTestState(t, "spike_threshold=10")
+	steps := []struct {
+		name    string
+		advance time.Duration
+		count   uint64
+		want    bool
+	}{
+		{"at threshold", 0, 10, false},
+		{"over threshold", 0, 11, true},
+		{"within cooldown", 30 * time.Second, 50, false},
+		{"after cooldown", 30 * time.Second, 11, true},
+		{"quiet after cooldown", 2 * time.Minute, 1, false},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		if got := state.checkSpike(step.count); got != step.want {
+			t.Errorf("%s: checkSpike(%d) = %v, want %v", step.name, step.count, got, step.want)
+		}
+	}
+	disabled, _ := newTestState(t)
+	if disabled.checkSpike(1000) {
+		t.Errorf("checkSpike logged with spike detection disabled")
+	}
+}
+
+func TestCountSecond(t *testing.T) {
+	state, clock := newTestState(t, "spike_threshold=2")
+	for i := 0; i < 3; i++ {
+		state.countSecond()
+	}
+	if !state.lastSpikeLog.IsZero() {
+		t.Fatalf("spike logged before its second ended")
+	}
+	// the first request of the next second checks the one before
+	clock.Advance(time.Second)
+	state.countSecond()
+	if !state.lastSpikeLog.Equal(clock.Now()) {
+		t.Errorf("spike of 3 requests over threshold 2 not logged")
+	}
+	clock.Advance(2 * time.Minute)
+	state.countSecond()
+	if state.lastSpikeLog.Equal(clock.Now()) {
+		t.Errorf("a single request logged as a spike")
+	}
+}
+
+// iaPrefix returns an IA_PD prefix hint for cidr.
+func iaPrefix(t *testing.T, cidr string) *dhcpv6.OptIAPrefix {
+	t.Helper()
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dhcpv6.OptIAPrefix{Prefix: prefix}
+}
+
+func TestPDHintTooLarge(t *testing.T) {
+	iapd := func(prefixes ...*dhcpv6.OptIAPrefix) *dhcpv6.OptIAPD {
+		iapd := &dhcpv6.OptIAPD{}
+		for _, prefix := range prefixes {
+			iapd.Options.Add(prefix)
+		}
+		return iapd
+	}
+	tests := []struct {
+		name  string
+		iapds []*dhcpv6.OptIAPD
+		want  bool
+	}{
+		{"no IA_PD", nil, false},
+		{"no hint", []*dhcpv6.OptIAPD{iapd()}, false},
+		{"unconstrained length", []*dhcpv6.OptIAPD{iapd(iaPrefix(t, "::/0"))}, false},
+		{"nil prefix", []*dhcpv6.OptIAPD{iapd(&dhcpv6.OptIAPrefix{})}, false},
+		{"at limit", []*dhcpv6.OptIAPD{iapd(iaPrefix(t, "2001:db8::/56"))}, false},
+		{"longer", []*dhcpv6.OptIAPD{iapd(iaPrefix(t, "2001:db8::/64"))}, false},
+		{"shorter", []*dhcpv6.OptIAPD{iapd(iaPrefix(t, "2001:db8::/48"))}, true},
+		{"second IA_PD shorter", []*dhcpv6.OptIAPD{iapd(iaPrefix(t, "2001:db8::/60")), iapd(iaPrefix(t, "2001:db8::/32"))}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pdHintTooLarge(tt.iapds, 56); got != tt.want {
+				t.Errorf("pdHintTooLarge = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropLargePD(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tests := []struct {
+		name     string
+		args     []string
+		hint     string
+		wantDrop bool
+	}{
+		{"counted only", []string{"max_pd_len=56"}, "2001:db8::/48", false},
+		{"dropped", []string{"max_pd_len=56", "drop_large_pd"}, "2001:db8::/48", true},
+		{"acceptable hint", []string{"max_pd_len=56", "drop_large_pd"}, "2001:db8::/60", false},
+		{"dropped explicitly", []string{"max_pd_len=56", "drop_large_pd=true"}, "2001:db8::/48", true},
+		{"dropping disabled", []string{"max_pd_len=56", "drop_large_pd=false"}, "2001:db8::/48", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, _ := newTestState(t, tt.args...)
+			req, err := dhcpv6.NewSolicit(mac, dhcpv6.WithIAPD([4]byte{1}, iaPrefix(t, tt.hint)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stop bool
+			dropped := statsutil.Delta(func() {
+				_, stop = state.Handler6(req, nil)
+			})[`dhcp_requests_handled_total{family="v6",outcome="dropped"}`]
+			if stop != tt.wantDrop || (dropped == 1) != tt.wantDrop {
+				t.Errorf("Handler6 stopped %v and counted %v drops, want drop %v", stop, dropped, tt.wantDrop)
+			}
+		})
+	}
+}
+
+func TestIsInitReboot(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	requested := dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 10))
+	server := dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 1))
+	tests := []struct {
+		name      string
+		modifiers []dhcpv4.Modifier
+		want      bool
+	}{
+		{"init-reboot", []dhcpv4.Modifier{dhcpv4.WithOption(requested)}, true},
+		{"selecting", []dhcpv4.Modifier{dhcpv4.WithOption(requested), dhcpv4.WithOption(server)}, false},
+		{"renewing", []dhcpv4.Modifier{dhcpv4.WithOption(requested), dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 10))}, false},
+		{"no requested address", nil, false},
+		{"discover", []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover), dhcpv4.WithOption(requested)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modifiers := append([]dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest)}, tt.modifiers...)
+			req, err := dhcpv4.New(append(modifiers, dhcpv4.WithHwAddr(mac))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isInitReboot(req); got != tt.want {
+				t.Errorf("isInitReboot = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOUIs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    [][3]byte
+		wantErr bool
+	}{
+		{in: "001122", want: [][3]byte{{0x00, 0x11, 0x22}}},
+		{in: "001122, aabbcc", want: [][3]byte{{0x00, 0x11, 0x22}, {0xaa, 0xbb, 0xcc}}},
+		{in: "0011", wantErr: true},
+		{in: "00112233", wantErr: true},
+		{in: "00:11:22", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		ouis, err := parseOUIs(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseOUIs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(ouis) != len(tt.want) {
+			t.Errorf("parseOUIs(%q) has %d OUIs, want %d", tt.in, len(ouis), len(tt.want))
+		}
+		for _, oui := range tt.want {
+			if !ouis[oui] {
+				t.Errorf("parseOUIs(%q) is missing %x", tt.in, oui)
+			}
+		}
+	}
+}
+
+func TestOUIClass(t *testing.T) {
+	ouis, err := parseOUIs("001122")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mac  net.HardwareAddr
+		want string
+	}{
+		{net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}, "approved"},
+		{net.HardwareAddr{0x00, 0x11, 0x23, 0x33, 0x44, 0x55}, "other"},
+		{net.HardwareAddr{0x00, 0x11}, "other"},
+		{nil, "other"},
+	}
+	for _, tt := range tests {
+		if got := ouiClass(ouis, tt.mac); got != tt.want {
+			t.Errorf("ouiClass(%v) = %q, want %q", tt.mac, got, tt.want)
+		}
+	}
+}
+
+func TestCircuitField(t *testing.T) {
+	re := regexp.MustCompile(`^(?:port(?P<port>\d+))?:vlan(?P<vlan>\d+)?$`)
+	tests := []struct {
+		circuit string
+		group   string
+		want    string
+		wantOK  bool
+	}{
+		{"port3:vlan100", "vlan", "100", true},
+		{"port3:vlan100", "port", "3", true},
+		{":vlan100", "port", "", false},
+		{"port3:vlan", "vlan", "", false},
+		{"eth0", "vlan", "", false},
+		{"port3:vlan100", "slot", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := circuitField(re, tt.circuit, tt.group)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("circuitField(%q, %q) = %q, %v, want %q, %v", tt.circuit, tt.group, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// relayed returns msg encapsulated in hops relays.
+func relayed(t *testing.T, msg dhcpv6.DHCPv6, hops int) dhcpv6.DHCPv6 {
+	t.Helper()
+	for i := 0; i < hops; i++ {
+		relay, err := dhcpv6.EncapsulateRelay(msg, dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg = relay
+	}
+	return msg
+}
+
+// relayed4 returns a DISCOVER relayed through giaddr with the given relay
+// agent suboptions.
+func relayed4(t *testing.T, giaddr net.IP, subopts ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+	t.Helper()
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55},
+		dhcpv4.WithGatewayIP(giaddr), dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subopts...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestRelayHops(t *testing.T) {
+	msg, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hops int
+		want int
+	}{
+		{0, 0},
+		{1, 1},
+		{3, 3},
+		{maxRelayChain, maxRelayChain},
+		{maxRelayChain + 5, maxRelayChain + 1},
+	}
+	for _, tt := range tests {
+		if got := relayHops(relayed(t, msg, tt.hops)); got != tt.want {
+			t.Errorf("relayHops through %d relays = %d, want %d", tt.hops, got, tt.want)
+		}
+	}
+}
+
+func TestMaxHops(t *testing.T) {
+	state, _ := newTestState(t, "max_hops=2")
+	msg, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hops     int
+		wantDrop bool
+	}{
+		{0, false},
+		{2, false},
+		{3, true},
+	}
+	for _, tt := range tests {
+		var stop bool
+		dropped := statsutil.Delta(func() {
+			_, stop = state.Handler6(relayed(t, msg, tt.hops), nil)
+		})["dhcpv6_max_hops_exceeded_total"]
+		if stop != tt.wantDrop || (dropped == 1) != tt.wantDrop {
+			t.Errorf("%d hops: Handler6 stopped %v and counted %v drops, want drop %v", tt.hops, stop, dropped, tt.wantDrop)
+		}
+	}
+}
+
+func TestCheckSilentRelays(t *testing.T) {
+	state, clock := newTestState(t, "relay_silence_timeout=5m")
+	steps := []struct {
+		advance time.Duration
+		seen    []string
+		want    int
+	}{
+		{0, []string{"192.0.2.1", "192.0.2.2"}, 0},
+		{3 * time.Minute, []string{"192.0.2.2"}, 0},
+		{3 * time.Minute, nil, 1},
+		{3 * time.Minute, nil, 2},
+		{time.Minute, []string{"192.0.2.1"}, 1},
+		// relays idle for longer than relayWindow are forgotten
+		{relayWindow + time.Minute, nil, 0},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		for _, relay := range step.seen {
+			state.relaySeen(relay)
+		}
+		if got := state.checkSilentRelays(); got != step.want {
+			t.Errorf("step %d: checkSilentRelays = %d, want %d", i, got, step.want)
+		}
+	}
+}
+
+func TestIsNewClient(t *testing.T) {
+	state, clock := newTestState(t, "new_client_grace=10m")
+	steps := []struct {
+		advance  time.Duration
+		mac      string
+		discover bool
+		want     bool
+	}{
+		{0, "00:11:22:33:44:55", true, true},
+		// a retry after a NAK isn't a new client
+		{time.Minute, "00:11:22:33:44:55", true, false},
+		{time.Minute, "00:11:22:33:44:66", false, false},
+		{time.Minute, "00:11:22:33:44:66", true, false},
+		{5 * time.Minute, "00:11:22:33:44:55", false, false},
+		// each request restarts the grace period
+		{9 * time.Minute, "00:11:22:33:44:55", true, false},
+		{11 * time.Minute, "00:11:22:33:44:55", true, true},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if got := state.isNewClient(step.mac, step.discover); got != step.want {
+			t.Errorf("step %d: isNewClient(%s, %v) = %v, want %v", i, step.mac, step.discover, got, step.want)
+		}
+	}
+	// without a grace period every DISCOVER is new
+	state, _ = newTestState(t)
+	for i := 0; i < 2; i++ {
+		if !state.isNewClient("00:11:22:33:44:55", true) {
+			t.Errorf("DISCOVER %d not new without new_client_grace", i)
+		}
+	}
+}
+
+func TestPruneClients(t *testing.T) {
+	state, clock := newTestState(t, "new_client_grace=10m")
+	for i := 0; i < maxClients; i++ {
+		state.isNewClient(fmt.Sprintf("client%d", i), false)
+	}
+	// a full table doesn't stop us counting new clients, but we can't
+	// remember them
+	if !state.isNewClient("00:11:22:33:44:55", true) {
+		t.Error("DISCOVER with a full table not new")
+	}
+	if !state.isNewClient("00:11:22:33:44:55", true) {
+		t.Error("repeated DISCOVER with a full table not new")
+	}
+	clock.Advance(5 * time.Minute)
+	state.pruneClients()
+	if got := len(state.clients); got != maxClients {
+		t.Errorf("pruned within the grace period: %d clients, want %d", got, maxClients)
+	}
+	state.isNewClient("client0", false)
+	clock.Advance(6 * time.Minute)
+	periodic := statsutil.Every(state.Clock, clientPruneInterval, state.pruneClients)
+	clock.Tick()
+	periodic.Close()
+	clock.Wait()
+	if got := len(state.clients); got != 1 {
+		t.Errorf("after the grace period: %d clients, want 1", got)
+	}
+	if !state.isNewClient("00:11:22:33:44:55", true) {
+		t.Error("DISCOVER after pruning not new")
+	}
+	if state.isNewClient("00:11:22:33:44:55", true) {
+		t.Error("DISCOVER remembered after pruning still new")
+	}
+}
+
+func TestClientIDMismatch(t *testing.T) {
+	chaddr := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tests := []struct {
+		name     string
+		clientid []byte
+		want     bool
+	}{
+		{"matching", []byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x55}, false},
+		{"other MAC", []byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x66}, true},
+		{"not ethernet", []byte{0, 0, 0x11, 0x22, 0x33, 0x44, 0x66}, false},
+		{"DUID", []byte{0xff, 0, 0, 0, 1, 0, 1, 0, 1}, false},
+		{"short", []byte{1, 0, 0x11}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientIDMismatch(tt.clientid, chaddr); got != tt.want {
+				t.Errorf("clientIDMismatch(%x) = %v, want %v", tt.clientid, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	w := rateWindow{last: start.Unix()}
+	steps := []struct {
+		at   time.Duration
+		want uint64
+	}{
+		{0, 1},
+		{0, 2},
+		{10 * time.Second, 3},
+		{59 * time.Second, 4},
+		// the first two requests have left the window
+		{60 * time.Second, 3},
+		{70 * time.Second, 3},
+		// a request from the past counts in the current second
+		{65 * time.Second, 4},
+		{3 * time.Minute, 1},
+	}
+	for _, step := range steps {
+		if got := w.add(start.Add(step.at)); got != step.want {
+			t.Errorf("add at %v = %d, want %d", step.at, got, step.want)
+		}
+	}
+	w.advance(start.Add(time.Hour))
+	if got := w.total(); got != 0 {
+		t.Errorf("total after an idle hour = %d, want 0", got)
+	}
+}
+
+func TestRefreshInterfaceRates(t *testing.T) {
+	state, clock := newTestState(t)
+	state.interfaceRequest("eth0")
+	state.interfaceRequest("eth0")
+	clock.Advance(30 * time.Second)
+	state.interfaceRequest("eth1")
+	key := `dhcpv6_interface_request_rate{interface="eth0"}`
+	if got := state.Snapshot()[key]; got != 2 {
+		t.Errorf("%s = %v, want 2", key, got)
+	}
+	clock.Advance(45 * time.Second)
+	state.refreshInterfaceRates()
+	snapshot := state.Snapshot()
+	if _, ok := snapshot[key]; ok {
+		t.Errorf("%s still exported after a quiet minute", key)
+	}
+	if _, ok := state.interfaceRates["eth0"]; ok {
+		t.Errorf("quiet interface still tracked")
+	}
+	if got := snapshot[`dhcpv6_interface_request_rate{interface="eth1"}`]; got != 1 {
+		t.Errorf("eth1 rate = %v, want 1", got)
+	}
+}
+
+func TestMonitorClient(t *testing.T) {
+	monitor := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	other := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}
+	solicit, err := dhcpv6.NewSolicit(monitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duid := hex.EncodeToString(solicit.Options.ClientID().ToBytes())
+	state, _ := newTestState(t, "monitor_mac="+monitor.String(), "monitor_duid="+duid)
+	handle4 := func(mac net.HardwareAddr) func() {
+		return func() {
+			req, err := dhcpv4.NewDiscovery(mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state.Handler4(req, nil)
+		}
+	}
+	handle6 := func(mac net.HardwareAddr, hops int) func() {
+		return func() {
+			req, err := dhcpv6.NewSolicit(mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state.Handler6(relayed(t, req, hops), nil)
+		}
+	}
+	tests := []struct {
+		name        string
+		family      string
+		handle      func()
+		wantMonitor float64
+	}{
+		{"v4 monitor", "v4", handle4(monitor), 1},
+		{"v4 client", "v4", handle4(other), 0},
+		{"v6 monitor", "v6", handle6(monitor, 0), 1},
+		{"v6 relayed monitor", "v6", handle6(monitor, 2), 1},
+		{"v6 client", "v6", handle6(other, 0), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			monitorKey := `dhcp_monitor_requests_total{family="` + tt.family + `"}`
+			handledKey := `dhcp_requests_handled_total{family="` + tt.family + `",outcome="ok"}`
+			before := state.Snapshot()
+			tt.handle()
+			after := state.Snapshot()
+			if got := after[monitorKey] - before[monitorKey]; got != tt.wantMonitor {
+				t.Errorf("monitor requests increased by %v, want %v", got, tt.wantMonitor)
+			}
+			// the monitor's requests are left out of every other counter
+			if got := after[handledKey] - before[handledKey]; got != 1-tt.wantMonitor {
+				t.Errorf("handled requests increased by %v, want %v", got, 1-tt.wantMonitor)
+			}
+		})
+	}
+}
+
+func TestRAIVendorData(t *testing.T) {
+	tests := []struct {
+		name   string
+		subopt []byte
+		want   []byte
+		wantOK bool
+	}{
+		{"match", []byte{0, 0, 0x0d, 0xe9, 2, 'h', 'i'}, []byte("hi"), true},
+		{"second enterprise", []byte{0, 0, 0, 9, 1, 'x', 0, 0, 0x0d, 0xe9, 1, 'y'}, []byte("y"), true},
+		{"empty data", []byte{0, 0, 0x0d, 0xe9, 0}, []byte{}, true},
+		{"other enterprise", []byte{0, 0, 0, 9, 1, 'x'}, nil, false},
+		{"truncated data", []byte{0, 0, 0x0d, 0xe9, 5, 'h', 'i'}, nil, false},
+		{"truncated header", []byte{0, 0, 0x0d}, nil, false},
+		{"empty", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := raiVendorData(tt.subopt, 3561)
+			if ok != tt.wantOK || !bytes.Equal(got, tt.want) {
+				t.Errorf("raiVendorData(%x) = %q, %v, want %q, %v", tt.subopt, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAutoConfigureLabel(t *testing.T) {
+	tests := []struct {
+		value []byte
+		want  string
+	}{
+		{[]byte{0}, "DoNotAutoConfigure"},
+		{[]byte{1}, "AutoConfigure"},
+		{[]byte{2}, "invalid"},
+		{[]byte{1, 1}, "invalid"},
+		{[]byte{}, "invalid"},
+	}
+	for _, tt := range tests {
+		if got := autoConfigureLabel(tt.value); got != tt.want {
+			t.Errorf("autoConfigureLabel(%x) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestForeignIAAddress(t *testing.T) {
+	prefixes, err := statsutil.ParseSubnets("2001:db8::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iana := func(addrs ...string) *dhcpv6.OptIANA {
+		iana := &dhcpv6.OptIANA{}
+		for _, addr := range addrs {
+			iana.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP(addr)})
+		}
+		return iana
+	}
+	tests := []struct {
+		name  string
+		ianas []*dhcpv6.OptIANA
+		want  net.IP
+	}{
+		{"no IA_NA", nil, nil},
+		{"no address", []*dhcpv6.OptIANA{iana()}, nil},
+		{"ours", []*dhcpv6.OptIANA{iana("2001:db8::10")}, nil},
+		{"unspecified", []*dhcpv6.OptIANA{iana("::")}, nil},
+		{"foreign", []*dhcpv6.OptIANA{iana("2001:db8:1::10")}, net.ParseIP("2001:db8:1::10")},
+		{"first foreign", []*dhcpv6.OptIANA{iana("2001:db8::10"), iana("2001:db9::1", "2001:db9::2")}, net.ParseIP("2001:db9::1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := foreignIAAddress(tt.ianas, prefixes); !got.Equal(tt.want) {
+				t.Errorf("foreignIAAddress = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestV6MessageTypes(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		msgType       dhcpv6.MessageType
+		wantUnhandled float64
+		wantUnexpect  float64
+	}{
+		{dhcpv6.MessageTypeSolicit, 0, 0},
+		{dhcpv6.MessageTypeLeaseQuery, 1, 0},
+		{dhcpv6.MessageTypeReply, 0, 1},
+		{dhcpv6.MessageTypeAdvertise, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msgType.String(), func(t *testing.T) {
+			req, err := dhcpv6.NewMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.MessageType = tt.msgType
+			label := `{type="` + tt.msgType.String() + `"}`
+			before := state.Snapshot()
+			state.Handler6(req, nil)
+			after := state.Snapshot()
+			delta := func(name string) float64 {
+				return after[name+label] - before[name+label]
+			}
+			// every type is a request, whether or not we serve it
+			if got := delta("dhcpv6_requests_total"); got != 1 {
+				t.Errorf("requests increased by %v, want 1", got)
+			}
+			if got := delta("dhcpv6_unhandled_message_type_total"); got != tt.wantUnhandled {
+				t.Errorf("unhandled increased by %v, want %v", got, tt.wantUnhandled)
+			}
+			if got := delta("dhcpv6_unexpected_client_message_total"); got != tt.wantUnexpect {
+				t.Errorf("unexpected increased by %v, want %v", got, tt.wantUnexpect)
+			}
+		})
+	}
+}
+
+func TestSampleMinuteRate(t *testing.T) {
+	state, clock := newTestState(t)
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{3, 1, 0} {
+		periodic := state.sampleMinuteRate("v4")
+		for i := 0; i < want; i++ {
+			state.Handler4(req, nil)
+		}
+		clock.Advance(time.Minute)
+		clock.Tick()
+		// the ticker stops only once the update has finished
+		periodic.Close()
+		clock.Wait()
+		if got := state.Snapshot()[`dhcp_requests_per_minute{family="v4"}`]; got != float64(want) {
+			t.Errorf("requests per minute = %v, want %d", got, want)
+		}
+	}
+}
+
+func TestDiscoverToRequest(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tests := []struct {
+		name      string
+		delay     time.Duration
+		sweep     bool
+		sameXID   bool
+		wantCount float64
+	}{
+		{"prompt request", 2 * time.Second, false, true, 1},
+		{"other transaction", 2 * time.Second, false, false, 0},
+		{"late request", 2 * time.Minute, false, true, 0},
+		{"swept discover", 2 * time.Minute, true, true, 0},
+	}
+	for _, tt := range tests {
+		state, clock := newTestState(t)
+		discover, err := dhcpv4.NewDiscovery(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.sameXID {
+			request.TransactionID = discover.TransactionID
+		}
+		delta := statsutil.Delta(func() {
+			state.Handler4(discover, nil)
+			clock.Advance(tt.delay)
+			if tt.sweep {
+				periodic := statsutil.Every(state.Clock, pendingSweepInterval, state.sweepPending)
+				clock.Tick()
+				periodic.Close()
+				clock.Wait()
+				if len(state.pending) != 0 {
+					t.Errorf("%s: %d DISCOVERs pending after the sweep, want 0", tt.name, len(state.pending))
+				}
+			}
+			state.Handler4(request, nil)
+		})
+		if got := delta["dhcpv4_discover_to_request_seconds_count"]; got != tt.wantCount {
+			t.Errorf("%s: observed %v delays, want %v", tt.name, got, tt.wantCount)
+		}
+		if got := delta["dhcpv4_discover_to_request_seconds_sum"]; got != tt.wantCount*tt.delay.Seconds() {
+			t.Errorf("%s: observed %vs of delay, want %vs", tt.name, got, tt.wantCount*tt.delay.Seconds())
+		}
+	}
+}
+
+func TestIgnoreTypes(t *testing.T) {
+	state, _ := newTestState(t, "ignore_types=SOLICIT,inform")
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover, err := dhcpv4.NewDiscovery(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inform, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeInform))
+	if err != nil {
+		t.Fatal(err)
+	}
+	solicit, err := dhcpv6.NewSolicit(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		handle   func()
+		family   string
+		typeKey  string
+		wantSkip bool
+	}{
+		{"discover", func() { state.Handler4(discover, nil) }, "v4", `dhcpv4_requests_total{type="DISCOVER"}`, false},
+		{"inform", func() { state.Handler4(inform, nil) }, "v4", `dhcpv4_requests_total{type="INFORM"}`, true},
+		{"solicit", func() { state.Handler6(solicit, nil) }, "v6", `dhcpv6_requests_total{type="SOLICIT"}`, true},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(tt.handle)
+		wantIgnored, wantType := 0.0, 1.0
+		if tt.wantSkip {
+			wantIgnored, wantType = 1, 0
+		}
+		if got := delta[`dhcp_ignored_messages_total{family="`+tt.family+`"}`]; got != wantIgnored {
+			t.Errorf("%s: ignored messages increased by %v, want %v", tt.name, got, wantIgnored)
+		}
+		if got := delta[tt.typeKey]; got != wantType {
+			t.Errorf("%s: %s increased by %v, want %v", tt.name, tt.typeKey, got, wantType)
+		}
+	}
+}
+
+func TestLabelCase(t *testing.T) {
+	discover, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		labelCase string
+		v4, v6    string
+		notV4     string
+	}{
+		{"lower", "discover", "solicit", "DISCOVER"},
+		{"preserve", "DISCOVER", "SOLICIT", "discover"},
+	}
+	for _, tt := range tests {
+		state, _ := newTestState(t, "label_case="+tt.labelCase)
+		delta := statsutil.Delta(func() {
+			state.Handler4(discover, nil)
+			state.Handler6(solicit, nil)
+		})
+		if got := delta[`dhcpv4_requests_total{type="`+tt.v4+`"}`]; got != 1 {
+			t.Errorf("label_case=%s: v4 type %s increased by %v, want 1", tt.labelCase, tt.v4, got)
+		}
+		if got := delta[`dhcpv4_requests_total{type="`+tt.notV4+`"}`]; got != 0 {
+			t.Errorf("label_case=%s: v4 type %s increased by %v, want 0", tt.labelCase, tt.notV4, got)
+		}
+		if got := delta[`dhcpv6_requests_total{type="`+tt.v6+`"}`]; got != 1 {
+			t.Errorf("label_case=%s: v6 type %s increased by %v, want 1", tt.labelCase, tt.v6, got)
+		}
+	}
+}
+
+func TestHandledOutcomes(t *testing.T) {
+	state, _ := newTestState(t)
+	discover, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := dhcpv4.NewReplyFromRequest(discover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a relay without a Relay Message option can't be decapsulated
+	empty := &dhcpv6.RelayMessage{
+		MessageType: dhcpv6.MessageTypeRelayForward,
+		LinkAddr:    net.ParseIP("2001:db8::1"),
+		PeerAddr:    net.ParseIP("fe80::1"),
+	}
+	tests := []struct {
+		name    string
+		handle  func()
+		family  string
+		outcome string
+	}{
+		{"v4 discover", func() { state.Handler4(discover, nil) }, "v4", "ok"},
+		{"v4 not a BootRequest", func() { state.Handler4(reply, nil) }, "v4", "error"},
+		{"v6 solicit", func() { state.Handler6(solicit, nil) }, "v6", "ok"},
+		{"v6 empty relay", func() { state.Handler6(empty, nil) }, "v6", "error"},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(tt.handle)
+		for _, outcome := range []string{"ok", "error", "dropped"} {
+			want := 0.0
+			if outcome == tt.outcome {
+				want = 1
+			}
+			key := `dhcp_requests_handled_total{family="` + tt.family + `",outcome="` + outcome + `"}`
+			if got := delta[key]; got != want {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestNilResponseSeen(t *testing.T) {
+	state, _ := newTestState(t)
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover, err := dhcpv4.NewDiscovery(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := dhcpv4.NewReplyFromRequest(discover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solicit, err := dhcpv6.NewSolicit(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertise, err := dhcpv6.NewAdvertiseFromSolicit(solicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		handle func()
+		family string
+		want   float64
+	}{
+		{"v4 response", func() { state.Handler4(discover, offer) }, "v4", 0},
+		{"v4 nil response", func() { state.Handler4(discover, nil) }, "v4", 1},
+		{"v6 response", func() { state.Handler6(solicit, advertise) }, "v6", 0},
+		{"v6 nil response", func() { state.Handler6(solicit, nil) }, "v6", 1},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(tt.handle)
+		if got := delta[`dhcp_nil_response_seen_total{family="`+tt.family+`"}`]; got != tt.want {
+			t.Errorf("%s: nil responses increased by %v, want %v", tt.name, got, tt.want)
+		}
+		// the request is still counted
+		if got := delta[`dhcp_requests_handled_total{family="`+tt.family+`",outcome="ok"}`]; got != 1 {
+			t.Errorf("%s: ok outcomes increased by %v, want 1", tt.name, got)
+		}
+	}
+}
+
+func TestDiscoverWithRequestedIP(t *testing.T) {
+	state, _ := newTestState(t)
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	hint := dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 10)))
+	tests := []struct {
+		name string
+		mods []dhcpv4.Modifier
+		want float64
+	}{
+		{"discover", nil, 0},
+		{"discover with requested IP", []dhcpv4.Modifier{hint}, 1},
+		{"request with requested IP", []dhcpv4.Modifier{hint, dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest)}, 0},
+	}
+	for _, tt := range tests {
+		req, err := dhcpv4.NewDiscovery(mac, tt.mods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		if got := delta["dhcpv4_discover_with_requested_ip_total"]; got != tt.want {
+			t.Errorf("%s: DISCOVERs with a requested IP increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRelayLastSeen(t *testing.T) {
+	state, clock := newTestState(t)
+	relay := net.IPv4(192, 0, 2, 1)
+	key := `dhcpv4_relay_last_seen_timestamp_seconds{relay="192.0.2.1"}`
+	for _, advance := range []time.Duration{0, time.Minute} {
+		clock.Advance(advance)
+		state.Handler4(relayed4(t, relay, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0"))), nil)
+		want := float64(clock.Now().Unix())
+		if got := state.Snapshot()[key]; got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	// requests without a giaddr don't come from a relay
+	clock.Advance(time.Minute)
+	state.Handler4(relayed4(t, net.IPv4zero), nil)
+	if got, want := state.Snapshot()[key], float64(clock.Now().Add(-time.Minute).Unix()); got != want {
+		t.Errorf("after an unrelayed request %s = %v, want %v", key, got, want)
+	}
+}
+
+func TestBOOTP(t *testing.T) {
+	state, _ := newTestState(t)
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	bootp, err := dhcpv4.New(dhcpv4.WithHwAddr(mac))
+	if err != nil {
+		t.Fatal(err)
+	}
+	discover, err := dhcpv4.NewDiscovery(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		req  *dhcpv4.DHCPv4
+		want float64
+	}{
+		{"bootp", bootp, 1},
+		{"dhcp", discover, 0},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(func() { state.Handler4(tt.req, nil) })
+		if got := delta["dhcpv4_bootp_requests_total"]; got != tt.want {
+			t.Errorf("%s: BOOTP requests increased by %v, want %v", tt.name, got, tt.want)
+		}
+		// BOOTP requests have no type to count
+		var typed float64
+		for key, value := range delta {
+			if strings.HasPrefix(key, "dhcpv4_requests_total{") {
+				typed += value
+			}
+		}
+		if typed != 1-tt.want {
+			t.Errorf("%s: requests by type increased by %v, want %v", tt.name, typed, 1-tt.want)
+		}
+	}
+}
+
+func TestMissingElapsedTime(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		name    string
+		msgType dhcpv6.MessageType
+		elapsed bool
+		want    float64
+	}{
+		{"solicit with elapsed time", dhcpv6.MessageTypeSolicit, true, 0},
+		{"solicit without elapsed time", dhcpv6.MessageTypeSolicit, false, 1},
+		{"renew without elapsed time", dhcpv6.MessageTypeRenew, false, 1},
+	}
+	for _, tt := range tests {
+		msg, err := dhcpv6.NewMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.MessageType = tt.msgType
+		if tt.elapsed {
+			msg.AddOption(dhcpv6.OptElapsedTime(0))
+		}
+		delta := statsutil.Delta(func() { state.Handler6(msg, nil) })
+		key := `dhcpv6_missing_elapsed_time_total{type="` + tt.msgType.String() + `"}`
+		if got := delta[key]; got != tt.want {
+			t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, tt.want)
+		}
+	}
+}
+
+func TestRelayPeer(t *testing.T) {
+	state, _ := newTestState(t)
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		req  dhcpv6.DHCPv6
+		want float64
+	}{
+		{"direct", solicit, 0},
+		{"relayed", relayed(t, solicit, 1), 1},
+		// only the relay that sent it to us counts
+		{"relayed twice", relayed(t, solicit, 2), 1},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(func() { state.Handler6(tt.req, nil) })
+		var peers float64
+		for key, value := range delta {
+			if strings.HasPrefix(key, "dhcpv6_requests_by_relay_peer_total{") {
+				peers += value
+			}
+		}
+		if got := delta[`dhcpv6_requests_by_relay_peer_total{peer="fe80::1"}`]; got != tt.want || peers != tt.want {
+			t.Errorf("%s: requests from relay peer fe80::1 increased by %v of %v, want %v", tt.name, got, peers, tt.want)
+		}
+	}
+}
+
+func TestClientArch(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		name  string
+		archs []iana.Arch
+	}{
+		{"x86 BIOS", []iana.Arch{iana.INTEL_X86PC}},
+		{"UEFI x64", []iana.Arch{iana.EFI_X86_64}},
+		{"both", []iana.Arch{iana.INTEL_X86PC, iana.EFI_X86_64}},
+		{"none", nil},
+	}
+	for _, tt := range tests {
+		var mods []dhcpv4.Modifier
+		if len(tt.archs) > 0 {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClientArch(tt.archs...)))
+		}
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}, mods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		for _, arch := range []iana.Arch{iana.INTEL_X86PC, iana.EFI_X86_64} {
+			want := 0.0
+			for _, a := range tt.archs {
+				if a == arch {
+					want = 1
+				}
+			}
+			key := `dhcpv4_client_arch_total{arch="` + arch.String() + `"}`
+			if got := delta[key]; got != want {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestUserClass(t *testing.T) {
+	state, _ := newTestState(t)
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithOption(dhcpv4.OptRFC3004UserClass([]string{"iPXE", "kiosk"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	solicit, err := dhcpv6.NewSolicit(mac, dhcpv6.WithUserClass([]byte("kiosk")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := statsutil.Delta(func() {
+		state.Handler4(discover, nil)
+		state.Handler6(solicit, nil)
+	})
+	for key, want := range map[string]float64{
+		`dhcp_requests_by_user_class_total{class="iPXE",family="v4"}`:  1,
+		`dhcp_requests_by_user_class_total{class="kiosk",family="v4"}`: 1,
+		`dhcp_requests_by_user_class_total{class="kiosk",family="v6"}`: 1,
+		`dhcp_requests_by_user_class_total{class="iPXE",family="v6"}`:  0,
+	} {
+		if got := delta[key]; got != want {
+			t.Errorf("%s increased by %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestRelaySubnet(t *testing.T) {
+	circuit := dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0"))
+	tests := []struct {
+		name   string
+		args   []string
+		giaddr net.IP
+		want   string
+	}{
+		{"/24", []string{"relay_subnet_mask=/24"}, net.IPv4(192, 0, 2, 77), "192.0.2.0/24"},
+		{"/16", []string{"relay_subnet_mask=/16"}, net.IPv4(198, 51, 100, 1), "198.51.0.0/16"},
+		{"with subnets", []string{"relay_subnet_mask=/24", "subnets=10.0.0.0/8"}, net.IPv4(10, 1, 2, 3), "10.1.2.0/24"},
+		{"unaggregated", nil, net.IPv4(203, 0, 113, 1), ""},
+	}
+	for _, tt := range tests {
+		state, _ := newTestState(t, tt.args...)
+		delta := statsutil.Delta(func() { state.Handler4(relayed4(t, tt.giaddr, circuit), nil) })
+		var counted float64
+		for key, value := range delta {
+			if strings.HasPrefix(key, "dhcpv4_requests_by_relay_subnet_total{") {
+				counted += value
+			}
+		}
+		if tt.want == "" {
+			if counted != 0 {
+				t.Errorf("%s: requests by relay subnet increased by %v, want 0", tt.name, counted)
+			}
+			continue
+		}
+		key := `dhcpv4_requests_by_relay_subnet_total{subnet="` + tt.want + `"}`
+		if got := delta[key]; got != 1 || counted != 1 {
+			t.Errorf("%s: %s increased by %v of %v, want 1 of 1", tt.name, key, got, counted)
+		}
+	}
+}
+
+func TestBinaryCircuitID(t *testing.T) {
+	state, _ := newTestState(t, `circuit_regex=vlan(?P<vlan>.+)`)
+	tests := []struct {
+		name       string
+		circuit    string
+		wantBinary float64
+		wantVLAN   string
+	}{
+		{"printable", "vlan42", 0, "42"},
+		{"binary", "vlan\xff\x01", 1, "ff01"},
+	}
+	for _, tt := range tests {
+		req := relayed4(t, net.IPv4(192, 0, 2, 1), dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte(tt.circuit)))
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		if got := delta["dhcpv4_binary_circuit_id_total"]; got != tt.wantBinary {
+			t.Errorf("%s: binary circuit IDs increased by %v, want %v", tt.name, got, tt.wantBinary)
+		}
+		key := `dhcpv4_requests_by_vlan_total{vlan="` + tt.wantVLAN + `"}`
+		if got := delta[key]; got != 1 {
+			t.Errorf("%s: %s increased by %v, want 1", tt.name, key, got)
+		}
+	}
+}
+
+func TestInnerMessageExtractFailures(t *testing.T) {
+	state, _ := newTestState(t)
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		req  dhcpv6.DHCPv6
+		want float64
+	}{
+		{"relayed", relayed(t, solicit, 2), 0},
+		// a relay without a Relay Message option
+		{"empty relay", &dhcpv6.RelayMessage{
+			MessageType: dhcpv6.MessageTypeRelayForward,
+			LinkAddr:    net.ParseIP("2001:db8::1"),
+			PeerAddr:    net.ParseIP("fe80::1"),
+		}, 1},
+	}
+	for _, tt := range tests {
+		var got dhcpv6.DHCPv6
+		var stop bool
+		delta := statsutil.Delta(func() { got, stop = state.Handler6(tt.req, nil) })
+		if n := delta["dhcpv6_inner_message_extract_failures_total"]; n != tt.want {
+			t.Errorf("%s: extract failures increased by %v, want %v", tt.name, n, tt.want)
+		}
+		if failed := tt.want > 0; stop != failed || (failed && got != nil) {
+			t.Errorf("%s: Handler6 = %v, %v, want stopped %v", tt.name, got, stop, failed)
+		}
+	}
+}
+
+func TestOptionCount(t *testing.T) {
+	state, _ := newTestState(t)
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover, err := dhcpv4.NewDiscovery(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solicit, err := dhcpv6.NewSolicit(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		handle func()
+		family string
+		want   int
+	}{
+		{"v4", func() { state.Handler4(discover, nil) }, "v4", len(discover.Options)},
+		{"v6", func() { state.Handler6(solicit, nil) }, "v6", len(solicit.Options.Options)},
+		// relays' options aren't the client's
+		{"v6 relayed", func() { state.Handler6(relayed(t, solicit, 1), nil) }, "v6", len(solicit.Options.Options)},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(tt.handle)
+		if got := delta[`dhcp_request_option_count_count{family="`+tt.family+`"}`]; got != 1 {
+			t.Errorf("%s: observed %v requests, want 1", tt.name, got)
+		}
+		if got := delta[`dhcp_request_option_count_sum{family="`+tt.family+`"}`]; got != float64(tt.want) {
+			t.Errorf("%s: observed %v options, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnterprise(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		name        string
+		enterprises []uint32
+	}{
+		{"none", nil},
+		{"one", []uint32{9}},
+		{"two", []uint32{9, 2636}},
+	}
+	for _, tt := range tests {
+		solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, en := range tt.enterprises {
+			solicit.AddOption(&dhcpv6.OptVendorClass{EnterpriseNumber: en, Data: [][]byte{[]byte("class")}})
+		}
+		delta := statsutil.Delta(func() { state.Handler6(solicit, nil) })
+		for _, en := range []uint32{9, 2636} {
+			want := 0.0
+			for _, e := range tt.enterprises {
+				if e == en {
+					want = 1
+				}
+			}
+			key := fmt.Sprintf(`dhcpv6_requests_by_enterprise_total{enterprise="%d"}`, en)
+			if got := delta[key]; got != want {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestMissingClientID(t *testing.T) {
+	state, _ := newTestState(t)
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	clientID := dhcpv4.WithOption(dhcpv4.OptClientIdentifier(append([]byte{1}, mac...)))
+	tests := []struct {
+		name string
+		mods []dhcpv4.Modifier
+		want float64
+	}{
+		{"with client ID", []dhcpv4.Modifier{clientID}, 0},
+		{"without client ID", nil, 1},
+	}
+	for _, tt := range tests {
+		req, err := dhcpv4.NewDiscovery(mac, tt.mods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		if got := delta["dhcpv4_missing_client_id_total"]; got != tt.want {
+			t.Errorf("%s: missing client IDs increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequestingDNS(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		name  string
+		codes []dhcpv6.OptionCode
+		want  float64
+	}{
+		{"no ORO", nil, 0},
+		{"ORO without DNS", []dhcpv6.OptionCode{dhcpv6.OptionDomainSearchList}, 0},
+		{"ORO with DNS", []dhcpv6.OptionCode{dhcpv6.OptionDomainSearchList, dhcpv6.OptionDNSRecursiveNameServer}, 1},
+	}
+	for _, tt := range tests {
+		msg, err := dhcpv6.NewMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.MessageType = dhcpv6.MessageTypeSolicit
+		if len(tt.codes) > 0 {
+			msg.AddOption(dhcpv6.OptRequestedOption(tt.codes...))
+		}
+		delta := statsutil.Delta(func() { state.Handler6(msg, nil) })
+		if got := delta["dhcpv6_clients_requesting_dns_total"]; got != tt.want {
+			t.Errorf("%s: clients requesting DNS increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientSecs(t *testing.T) {
+	state, _ := newTestState(t)
+	for _, secs := range []uint16{0, 4, 30} {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.NumSeconds = secs
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		if got := delta["dhcpv4_client_secs_count"]; got != 1 {
+			t.Errorf("secs %d: observed %v requests, want 1", secs, got)
+		}
+		if got := delta["dhcpv4_client_secs_sum"]; got != float64(secs) {
+			t.Errorf("secs %d: observed %v seconds, want %d", secs, got, secs)
+		}
+	}
+}
+
+func TestMalformedInterfaceID(t *testing.T) {
+	state, _ := newTestState(t, `interfaceid_regex=^eth\d+$`)
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		id   string
+		want float64
+	}{
+		{"well formed", "eth0", 0},
+		{"malformed", "ge-0/0/1", 1},
+	}
+	for _, tt := range tests {
+		relay := relayed(t, solicit, 1).(*dhcpv6.RelayMessage)
+		relay.AddOption(dhcpv6.OptInterfaceID([]byte(tt.id)))
+		delta := statsutil.Delta(func() { state.Handler6(relay, nil) })
+		if got := delta["dhcpv6_malformed_interfaceid_total"]; got != tt.want {
+			t.Errorf("%s: malformed Interface-IDs increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// without interfaceid_regex nothing is malformed
+	state, _ = newTestState(t)
+	relay := relayed(t, solicit, 1).(*dhcpv6.RelayMessage)
+	relay.AddOption(dhcpv6.OptInterfaceID([]byte("ge-0/0/1")))
+	if got := statsutil.Delta(func() { state.Handler6(relay, nil) })["dhcpv6_malformed_interfaceid_total"]; got != 0 {
+		t.Errorf("without interfaceid_regex malformed Interface-IDs increased by %v, want 0", got)
+	}
+}
+
+func TestRelayInterarrival(t *testing.T) {
+	state, clock := newTestState(t)
+	circuit := dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0"))
+	steps := []struct {
+		advance   time.Duration
+		relay     net.IP
+		wantCount float64
+		wantSum   float64
+	}{
+		// the first request from a relay has nothing to follow
+		{0, net.IPv4(192, 0, 2, 1), 0, 0},
+		{30 * time.Second, net.IPv4(192, 0, 2, 1), 1, 30},
+		{10 * time.Second, net.IPv4(192, 0, 2, 2), 0, 0},
+		{5 * time.Second, net.IPv4(192, 0, 2, 1), 1, 15},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		req := relayed4(t, step.relay, circuit)
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		if got := delta["dhcpv4_relay_interarrival_seconds_count"]; got != step.wantCount {
+			t.Errorf("step %d: observed %v interarrivals, want %v", i, got, step.wantCount)
+		}
+		if got := delta["dhcpv4_relay_interarrival_seconds_sum"]; got != step.wantSum {
+			t.Errorf("step %d: observed %vs between requests, want %vs", i, got, step.wantSum)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		name string
+		size uint16
+	}{
+		{"none", 0},
+		{"ethernet", 1500},
+		{"minimum", 576},
+	}
+	for _, tt := range tests {
+		var mods []dhcpv4.Modifier
+		wantCount := 0.0
+		if tt.size > 0 {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(tt.size)))
+			wantCount = 1
+		}
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}, mods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		if got := delta["dhcpv4_max_message_size_count"]; got != wantCount {
+			t.Errorf("%s: observed %v sizes, want %v", tt.name, got, wantCount)
+		}
+		if got := delta["dhcpv4_max_message_size_sum"]; got != float64(tt.size) {
+			t.Errorf("%s: observed %v bytes, want %d", tt.name, got, tt.size)
+		}
+	}
+}
+
+func TestDirectRequests(t *testing.T) {
+	state, _ := newTestState(t)
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		req        dhcpv6.DHCPv6
+		wantDirect float64
+		wantRelay  float64
+	}{
+		{"direct", solicit, 1, 0},
+		{"relayed", relayed(t, solicit, 1), 0, 1},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(func() { state.Handler6(tt.req, nil) })
+		if got := delta["dhcpv6_direct_requests_total"]; got != tt.wantDirect {
+			t.Errorf("%s: direct requests increased by %v, want %v", tt.name, got, tt.wantDirect)
+		}
+		if got := delta["dhcpv6_from_relays_total"]; got != tt.wantRelay {
+			t.Errorf("%s: relayed requests increased by %v, want %v", tt.name, got, tt.wantRelay)
+		}
+	}
+}
+
+func TestClientFQDN(t *testing.T) {
+	state, _ := newTestState(t)
+	name := &rfc1035label.Labels{Labels: []string{"host.example.com"}}
+	tests := []struct {
+		name string
+		fqdn *dhcpv6.OptFQDN
+		want string
+	}{
+		{"no FQDN", nil, ""},
+		{"client updates", &dhcpv6.OptFQDN{Flags: 0, DomainName: name}, "false"},
+		{"server updates", &dhcpv6.OptFQDN{Flags: 0x01, DomainName: name}, "true"},
+	}
+	for _, tt := range tests {
+		solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.fqdn != nil {
+			solicit.AddOption(tt.fqdn)
+		}
+		delta := statsutil.Delta(func() { state.Handler6(solicit, nil) })
+		for _, update := range []string{"true", "false"} {
+			want := 0.0
+			if update == tt.want {
+				want = 1
+			}
+			key := `dhcpv6_client_fqdn_total{server_update="` + update + `"}`
+			if got := delta[key]; got != want {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestTransactionIDAnomaly(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		name    string
+		xid     dhcpv6.TransactionID
+		relayed bool
+		want    float64
+	}{
+		{"random", dhcpv6.TransactionID{0x12, 0x34, 0x56}, false, 0},
+		{"zero", dhcpv6.TransactionID{}, false, 1},
+		// the client's transaction ID counts, not the relay's lack of one
+		{"relayed random", dhcpv6.TransactionID{0x12, 0x34, 0x56}, true, 0},
+		{"relayed zero", dhcpv6.TransactionID{}, true, 1},
+	}
+	for _, tt := range tests {
+		solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+		if err != nil {
+			t.Fatal(err)
+		}
+		solicit.TransactionID = tt.xid
+		var req dhcpv6.DHCPv6 = solicit
+		if tt.relayed {
+			req = relayed(t, solicit, 1)
+		}
+		delta := statsutil.Delta(func() { state.Handler6(req, nil) })
+		if got := delta["dhcpv6_txid_anomaly_total"]; got != tt.want {
+			t.Errorf("%s: transaction ID anomalies increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRelayUnspecifiedLink(t *testing.T) {
+	state, _ := newTestState(t)
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		inner net.IP
+		outer net.IP
+		want  float64
+	}{
+		{"specified", net.ParseIP("2001:db8::1"), nil, 0},
+		{"unspecified", net.IPv6unspecified, nil, 1},
+		// only the relay next to the client selects the link
+		{"unspecified outer relay", net.ParseIP("2001:db8::1"), net.IPv6unspecified, 0},
+		{"unspecified inner relay", net.IPv6unspecified, net.ParseIP("2001:db8::1"), 1},
+	}
+	for _, tt := range tests {
+		req, err := dhcpv6.EncapsulateRelay(solicit, dhcpv6.MessageTypeRelayForward, tt.inner, net.ParseIP("fe80::1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.outer != nil {
+			if req, err = dhcpv6.EncapsulateRelay(req, dhcpv6.MessageTypeRelayForward, tt.outer, net.ParseIP("fe80::2")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		delta := statsutil.Delta(func() { state.Handler6(req, nil) })
+		if got := delta["dhcpv6_relay_unspecified_link_total"]; got != tt.want {
+			t.Errorf("%s: unspecified links increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoredOpcode(t *testing.T) {
+	state, _ := newTestState(t)
+	tests := []struct {
+		name   string
+		opcode dhcpv4.OpcodeType
+		want   string
+	}{
+		{"request", dhcpv4.OpcodeBootRequest, ""},
+		{"reply", dhcpv4.OpcodeBootReply, "2"},
+		{"invalid", dhcpv4.OpcodeType(7), "7"},
+	}
+	for _, tt := range tests {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.OpCode = tt.opcode
+		delta := statsutil.Delta(func() { state.Handler4(req, nil) })
+		var ignored float64
+		for key, value := range delta {
+			if strings.HasPrefix(key, "dhcpv4_ignored_opcode_total{") {
+				ignored += value
+			}
+		}
+		if tt.want == "" {
+			if ignored != 0 {
+				t.Errorf("%s: ignored op codes increased by %v, want 0", tt.name, ignored)
+			}
+			continue
+		}
+		key := `dhcpv4_ignored_opcode_total{opcode="` + tt.want + `"}`
+		if got := delta[key]; got != 1 || ignored != 1 {
+			t.Errorf("%s: %s increased by %v of %v, want 1 of 1", tt.name, key, got, ignored)
+		}
+		if got := delta[`dhcpv4_requests_total{type="ignored"}`]; got != 1 {
+			t.Errorf("%s: ignored requests increased by %v, want 1", tt.name, got)
+		}
+	}
+}
+
+func TestMapGauges(t *testing.T) {
+	state, clock := newTestState(t, "new_client_grace=1m")
+	discovers := make([]*dhcpv4.DHCPv4, 3)
+	for i := range discovers {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		discovers[i] = req
+	}
+	request, err := dhcpv4.NewDiscovery(discovers[0].ClientHWAddr, dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.TransactionID = discovers[0].TransactionID
+	steps := []struct {
+		name        string
+		advance     time.Duration
+		do          func()
+		wantPending float64
+		wantWindow  float64
+	}{
+		{"discovers", 0, func() {
+			for _, req := range discovers {
+				state.Handler4(req, nil)
+			}
+		}, 3, 3},
+		// the client was already remembered
+		{"request", time.Second, func() { state.Handler4(request, nil) }, -1, 0},
+		{"prune", 2 * time.Minute, func() {
+			state.sweepPending()
+			state.pruneClients()
+		}, -2, -3},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		delta := statsutil.Delta(step.do)
+		if got := delta["dhcp_pending_requests"]; got != step.wantPending {
+			t.Errorf("%s: pending requests changed by %v, want %v", step.name, got, step.wantPending)
+		}
+		if got := delta["dhcp_window_entries"]; got != step.wantWindow {
+			t.Errorf("%s: window entries changed by %v, want %v", step.name, got, step.wantWindow)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package requeststats
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"dhcpserver/statsutil"
+)
+
+// we count at most this many keys per category, lumping the rest into
+// statsutil.OtherLabel
+const maxTalkers = 4096
+
+// the categories of top talkers, in the order we write them
+var talkerCategories = []string{"relay", "circuit_id", "type"}
+
+// TopTalkers counts requests by relay, circuit ID and message type.
+type TopTalkers struct {
+	sync.Mutex
+	counts map[string]map[string]uint64
+}
+
+// Count counts a request for key in category.
+func (t *TopTalkers) Count(category, key string) {
+	t.Lock()
+	defer t.Unlock()
+	t.add(category, key, 1)
+}
+
+// add adds n requests for key in category. The caller must hold the lock.
+func (t *TopTalkers) add(category, key string, n uint64) {
+	if t.counts == nil {
+		t.counts = make(map[string]map[string]uint64)
+	}
+	keys, ok := t.counts[category]
+	if !ok {
+		keys = make(map[string]uint64)
+		t.counts[category] = keys
+	}
+	if _, known := keys[key]; !known && len(keys) >= maxTalkers {
+		key = statsutil.OtherLabel
+	}
+	keys[key] += n
+}
+
+// merge adds other's counts to t.
+func (t *TopTalkers) merge(other *TopTalkers) {
+	t.Lock()
+	defer t.Unlock()
+	other.Lock()
+	defer other.Unlock()
+	for category, keys := range other.counts {
+		for key, count := range keys {
+			t.add(category, key, count)
+		}
+	}
+}
+
+// WriteCSV writes the n most frequent keys in each category as CSV rows
+// of category, key and count.
+func (t *TopTalkers) WriteCSV(w io.Writer, n int) error {
+	type talker struct {
+		key   string
+		count uint64
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"category", "key", "count"}); err != nil {
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, category := range talkerCategories {
+		var talkers []talker
+		for key, count := range t.counts[category] {
+			talkers = append(talkers, talker{key, count})
+		}
+		sort.Slice(talkers, func(i, j int) bool {
+			if talkers[i].count != talkers[j].count {
+				return talkers[i].count > talkers[j].count
+			}
+			return talkers[i].key < talkers[j].key
+		})
+		if len(talkers) > n {
+			talkers = talkers[:n]
+		}
+		for _, tk := range talkers {
+			if err := cw.Write([]string{category, tk.key, strconv.FormatUint(tk.count, 10)}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteTopTalkersCSV writes the n top relays, circuit IDs and message
+// types this instance has seen as CSV.
+func (state *PluginState) WriteTopTalkersCSV(w io.Writer, n int) error {
+	return state.talkers.WriteCSV(w, n)
+}
+
+// every instance, so ServeTopTalkers can report on both families
+var (
+	instancesMu sync.Mutex
+	instances   []*PluginState
+)
+
+// the number of top talkers ServeTopTalkers reports by default
+const defaultTopTalkers = 10
+
+// ServeTopTalkers is an http.HandlerFunc that writes the top talkers
+// across every instance as CSV. The n query parameter sets how many.
+func ServeTopTalkers(w http.ResponseWriter, r *http.Request) {
+	n := defaultTopTalkers
+	if value := r.URL.Query().Get("n"); len(value) > 0 {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	var merged TopTalkers
+	instancesMu.Lock()
+	for _, state := range instances {
+		merged.merge(&state.talkers)
+	}
+	instancesMu.Unlock()
+	w.Header().Set("Content-Type", "text/csv")
+	if err := merged.WriteCSV(w, n); err != nil {
+		log.Errorf("could not write top talkers: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package requeststats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"dhcpserver/statsutil"
+)
+
+func TestTopTalkersWriteCSV(t *testing.T) {
+	var talkers TopTalkers
+	counts := []struct {
+		category, key string
+		n             int
+	}{
+		{"relay", "192.0.2.1", 3},
+		{"relay", "192.0.2.2", 5},
+		{"relay", "192.0.2.3", 1},
+		{"type", "DISCOVER", 2},
+		{"type", "REQUEST", 2},
+	}
+	for _, c := range counts {
+		for i := 0; i < c.n; i++ {
+			talkers.Count(c.category, c.key)
+		}
+	}
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{1, "category,key,count\nrelay,192.0.2.2,5\ntype,DISCOVER,2\n"},
+		{2, "category,key,count\nrelay,192.0.2.2,5\nrelay,192.0.2.1,3\ntype,DISCOVER,2\ntype,REQUEST,2\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := talkers.WriteCSV(&b, tt.n); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.String(); got != tt.want {
+			t.Errorf("WriteCSV(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestTopTalkersBounded(t *testing.T) {
+	var talkers TopTalkers
+	for i := 0; i < maxTalkers; i++ {
+		talkers.Count("circuit_id", strconv.Itoa(i))
+	}
+	talkers.Count("circuit_id", "one too many")
+	talkers.Count("circuit_id", "and another")
+	talkers.Count("circuit_id", "0")
+	keys := talkers.counts["circuit_id"]
+	if len(keys) != maxTalkers+1 {
+		t.Errorf("tracking %d circuit IDs, want %d", len(keys), maxTalkers+1)
+	}
+	if keys[statsutil.OtherLabel] != 2 {
+		t.Errorf("%s = %d, want 2", statsutil.OtherLabel, keys[statsutil.OtherLabel])
+	}
+	if keys["0"] != 2 {
+		t.Errorf("known circuit ID counted %d times, want 2", keys["0"])
+	}
+}
+
+func TestServeTopTalkers(t *testing.T) {
+	v4, _ := newTestState(t)
+	v6, _ := newTestState(t)
+	v4.talkers.Count("relay", "192.0.2.1")
+	v6.talkers.Count("relay", "2001:db8::1")
+	v6.talkers.Count("relay", "2001:db8::1")
+	instancesMu.Lock()
+	saved := instances
+	instances = []*PluginState{v4, v6}
+	instancesMu.Unlock()
+	defer func() {
+		instancesMu.Lock()
+		instances = saved
+		instancesMu.Unlock()
+	}()
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"", http.StatusOK, "category,key,count\nrelay,2001:db8::1,2\nrelay,192.0.2.1,1\n"},
+		{"?n=1", http.StatusOK, "category,key,count\nrelay,2001:db8::1,2\n"},
+		{"?n=0", http.StatusBadRequest, ""},
+		{"?n=many", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		ServeTopTalkers(w, httptest.NewRequest("GET", "/toptalkers"+tt.query, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %q status = %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusOK && w.Body.String() != tt.wantBody {
+			t.Errorf("GET %q = %q, want %q", tt.query, w.Body.String(), tt.wantBody)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package responsestats
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"dhcpserver/statsutil"
+)
+
+// we remember at most this many recent log lines
+const maxDedupEntries = 4096
+
+var logsuppressed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dhcp_log_lines_suppressed_total",
+	Help: "Total number of log lines suppressed as duplicates within the dedup_logs window",
+})
+
+// LogDedup suppresses log lines identical to one logged within Window.
+type LogDedup struct {
+	sync.Mutex
+	statsutil.Clock
+	Window time.Duration
+	logged map[uint64]time.Time
+}
+
+// NewLogDedup returns a LogDedup with the given window.
+func NewLogDedup(window time.Duration) *LogDedup {
+	return &LogDedup{
+		Clock:  statsutil.RealClock,
+		Window: window,
+		logged: make(map[uint64]time.Time),
+	}
+}
+
+// Suppress reports whether line duplicates one logged within the window,
+// and otherwise remembers it as logged now.
+func (d *LogDedup) Suppress(line string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	key := h.Sum64()
+	now := d.Now()
+	d.Lock()
+	defer d.Unlock()
+	last, known := d.logged[key]
+	if known && now.Sub(last) < d.Window {
+		logsuppressed.Inc()
+		return true
+	}
+	if !known && len(d.logged) >= maxDedupEntries {
+		for k, t := range d.logged {
+			if now.Sub(t) >= d.Window {
+				delete(d.logged, k)
+				statsutil.DedupEntries.Dec()
+			}
+		}
+		if len(d.logged) >= maxDedupEntries {
+			// better to log too much than to lose a line
+			return false
+		}
+	}
+	if !known {
+		statsutil.DedupEntries.Inc()
+	}
+	d.logged[key] = now
+	return false
+}
+
+// Wrap returns a StringLogger that passes lines to logger unless they are
+// suppressed.
+func (d *LogDedup) Wrap(logger StringLogger) StringLogger {
+	return func(s string) {
+		if !d.Suppress(s) {
+			logger(s)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package responsestats
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"dhcpserver/statsutil"
+)
+
+func TestLogDedup(t *testing.T) {
+	clock := statsutil.NewMockClock()
+	dedup := NewLogDedup(time.Minute)
+	dedup.Clock = clock
+	var logged []string
+	logger := dedup.Wrap(func(s string) { logged = append(logged, s) })
+	steps := []struct {
+		advance time.Duration
+		line    string
+	}{
+		{0, "a"},
+		{time.Second, "a"},
+		{time.Second, "b"},
+		{30 * time.Second, "a"},
+		// a minute after "a" was last logged, not last suppressed
+		{30 * time.Second, "a"},
+		{time.Second, "b"},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		logger(step.line)
+	}
+	if want := []string{"a", "b", "a", "b"}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged %q, want %q", logged, want)
+	}
+}
+
+func TestLogDedupBounded(t *testing.T) {
+	clock := statsutil.NewMockClock()
+	dedup := NewLogDedup(time.Minute)
+	dedup.Clock = clock
+	for i := 0; i < maxDedupEntries; i++ {
+		dedup.Suppress(strconv.Itoa(i))
+	}
+	// with no room, a new line is logged but not remembered
+	for i := 0; i < 2; i++ {
+		if dedup.Suppress("new") {
+			t.Errorf("line suppressed while the cache is full")
+		}
+	}
+	if len(dedup.logged) != maxDedupEntries {
+		t.Errorf("cache holds %d lines, want %d", len(dedup.logged), maxDedupEntries)
+	}
+	// once the old lines expire they make room
+	clock.Advance(time.Minute)
+	if dedup.Suppress("new") || !dedup.Suppress("new") {
+		t.Errorf("new line not remembered after the cache expired")
+	}
+	if len(dedup.logged) != 1 {
+		t.Errorf("cache holds %d lines after expiry, want 1", len(dedup.logged))
+	}
+}
+
+func TestDedupEntriesGauge(t *testing.T) {
+	clock := statsutil.NewMockClock()
+	dedup := NewLogDedup(time.Minute)
+	dedup.Clock = clock
+	steps := []struct {
+		advance time.Duration
+		lines   []string
+		want    float64
+	}{
+		{0, []string{"a", "b", "c"}, 3},
+		// suppressed and relogged lines are already remembered
+		{time.Second, []string{"a", "b"}, 0},
+		{2 * time.Minute, []string{"a"}, 0},
+		{0, []string{"d"}, 1},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		delta := statsutil.Delta(func() {
+			for _, line := range step.lines {
+				dedup.Suppress(line)
+			}
+		})
+		if got := delta["dhcp_dedup_entries"]; got != step.want {
+			t.Errorf("step %d: dedup entries changed by %v, want %v", i, got, step.want)
+		}
+	}
+	if got := len(dedup.logged); got != 4 {
+		t.Errorf("dedup remembers %d lines, want 4", got)
+	}
+}
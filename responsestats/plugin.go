@@ -7,8 +7,12 @@
 package responsestats
 
 import (
-	"bytes"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
         "github.com/prometheus/client_golang/prometheus"
         "github.com/prometheus/client_golang/prometheus/promauto"
@@ -19,6 +23,8 @@ import (
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/iana"
+
+	"dhcpserver/statsutil"
 )
 
 var log = logger.GetLogger("plugins/responsestats")
@@ -30,6 +36,18 @@ var Plugin = plugins.Plugin{
 }
 
 var (
+	handled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_responses_handled_total",
+		Help: "Handler invocations for responses, by family {v4, v6} X outcome {ok, error, dropped}; a DHCPv4 error is a request that isn't a BootRequest or a response that is missing or isn't a BootReply",
+	}, []string{"family", "outcome"})
+	captiveportal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_captive_portal_responses_total",
+		Help: "ACKs and Replies carrying a captive portal URI, by family {v4, v6}",
+	}, []string{"family"})
+	egressiface = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcp_responses_by_egress_iface_total",
+		Help: "Responses by the interface iface_map says they leave on, or unknown",
+	}, []string{"iface"})
 	v4types = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dhcpv4_responses_total",
 		Help: "DHCPv4 responses sent, by message type",
@@ -42,6 +60,46 @@ var (
 		Name: "dhcpv4_to_relays_total",
 		Help: "Total number of DHCPv4 responses sent to a relay",
 	})
+	v4staticroutes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_responses_with_static_routes_total",
+		Help: "Total number of DHCPv4 ACKs carrying a Classless Static Route option",
+	})
+	v4staticroutecount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_static_routes_sent_total",
+		Help: "Total number of classless static routes sent in DHCPv4 ACKs",
+	})
+	v4exceedsmtu = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_response_exceeds_mtu_total",
+		Help: "Total number of DHCPv4 responses that don't fit in one packet of the configured MTU",
+	})
+	v4allocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_allocations_total",
+		Help: "DHCPv4 ACKs allocating an address, by kind {new, renewal}",
+	}, []string{"kind"})
+	v4delivery = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_responses_by_delivery_total",
+		Help: "DHCPv4 responses, by how RFC 2131 4.1 says they are delivered {relay, unicast, broadcast}",
+	}, []string{"delivery"})
+	v4serverid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_responses_by_server_id_total",
+		Help: "DHCPv4 responses, by Server Identifier",
+	}, []string{"server_id"})
+	v4lifecycle = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_lifecycle_responses_total",
+		Help: "DHCPv4 responses to clients giving up a lease, by kind {decline, release}",
+	}, []string{"kind"})
+	v4offerhint = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_offers_for_requested_ip_total",
+		Help: "OFFERs to DISCOVERs hinting at an IP with option 50, by whether the OFFER honored the hint {true, false}",
+	}, []string{"honored"})
+	v4nakloops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv4_nak_loops_total",
+		Help: "Total number of times a client got nak_loop_threshold consecutive NAKs within the NAK window",
+	})
+	v4profiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv4_responses_by_profile_total",
+		Help: "DHCPv4 ACKs, by the profile_match profile whose signature options they carry",
+	}, []string{"profile"})
 	v6types = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dhcpv6_responses_total",
 		Help: "DHCPv6 responses sent, by message type",
@@ -50,12 +108,124 @@ var (
 		Name: "dhcpv6_to_relays_total",
 		Help: "Total number of DHCPv6 responses sent to a relay",
 	})
+	v6noserverid = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_response_missing_serverid_total",
+		Help: "Total number of DHCPv6 Advertise and Reply responses without a Server Identifier",
+	})
+	v6rapidcommithonored = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_rapid_commit_honored_total",
+		Help: "Total number of DHCPv6 Solicits with Rapid Commit answered with a Reply",
+	})
+	v6rapidcommitdeclined = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_rapid_commit_declined_total",
+		Help: "Total number of DHCPv6 Solicits with Rapid Commit answered with only an Advertise",
+	})
+	v6nopreference = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_advertise_without_preference_total",
+		Help: "Total number of DHCPv6 Advertise responses without a Preference option",
+	})
+	v6invalidlifetime = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_invalid_lifetime_total",
+		Help: "DHCPv6 IA addresses and prefixes sent with preferred lifetime > valid lifetime, by IA type",
+	}, []string{"ia_type"})
+	v6iafixupaddfailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_ia_fixup_add_failed_total",
+		Help: "Total number of IAs ia_fixup couldn't add a status code for because the response isn't a DHCPv6 message",
+	})
+	v6excessiveias = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_excessive_ias_total",
+		Help: "Total number of DHCPv6 requests dropped for carrying more than max_ias IAs",
+	})
+	v6zerolifetime = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_zero_lifetime_responses_total",
+		Help: "DHCPv6 IAs sent with a zero valid lifetime address or prefix, telling the client to stop using it, by IA type",
+	}, []string{"ia_type"})
+	v6exceedsmtu = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_response_exceeds_mtu_total",
+		Help: "Total number of DHCPv6 responses that don't fit in one packet of the configured MTU",
+	})
+	v6renewrebind = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_renew_rebind_outcomes_total",
+		Help: "DHCPv6 Renew and Rebind responses, by kind {renew, rebind} X outcome {retained, denied, no_ia}",
+	}, []string{"kind", "outcome"})
+	v6addrchanged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcpv6_address_changed_on_renew_total",
+		Help: "Total number of IA_NAs in Renew and Rebind responses allocating an address the client didn't hold",
+	})
+	v6orounsatisfied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_oro_unsatisfied_total",
+		Help: "DHCPv6 options requested in the ORO but missing from the Advertise or Reply, by option",
+	}, []string{"option"})
+	v6satisfiedratio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dhcpv6_ia_satisfied_ratio_ewma",
+		Help: "Exponentially weighted moving average of the fraction of requested IAs satisfied, by type, over the IAs ia_sample selects",
+	}, []string{"type"})
 	v6processed = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dhcpv6_ias_processed_total",
 		Help: "DHCPv6 Identity Associations processed, by type {IA_NA, IA_TA, IA_PD} X result {all, some, none}",
 	}, []string{"type", "result"})
+	v6iabyinterface = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_ia_success_by_interface_total",
+		Help: "DHCPv6 Identity Associations processed, by the innermost relay's Interface-ID X result {all, some, none}",
+	}, []string{"interface", "result"})
+	v6distinctprefixes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dhcpv6_distinct_delegated_prefixes",
+		Help: "Distinct prefixes delegated within the last day, by the innermost relay's Interface-ID",
+	}, []string{"interface"})
+	v6statuscodes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dhcpv6_status_codes_sent_total",
+		Help: "DHCPv6 status codes sent in responses, including those nested in IAs, by code",
+	}, []string{"code"})
 )
 
+// histograms are the histograms our buckets_ arguments can override
+var histograms = statsutil.NewHistograms("responsestats")
+
+var amplification = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcp_amplification_factor",
+	Help:    "Ratio of response size to request size, by family",
+	Buckets: []float64{0.5, 1, 1.5, 2, 3, 4, 6, 8, 12, 16},
+}, "family")
+
+var v6iafixupduration = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv6_ia_fixup_duration_seconds",
+	Help:    "Time spent matching requested IAs to response IAs, by IA type",
+	Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
+}, "type")
+
+var v4leasetime = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv4_granted_lease_seconds",
+	Help:    "Lease time granted in ACKs, by the client's user or vendor class",
+	Buckets: prometheus.ExponentialBuckets(60, 2, 14),
+}, "class")
+
+var v6iaidlowbyte = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv6_iaid_low_byte",
+	Help:    "Low byte of the IAIDs clients request, by IA type, if track_iaid_hist is set",
+	Buckets: prometheus.LinearBuckets(15, 16, 16),
+}, "type")
+
+var v4allleases = histograms.New(prometheus.HistogramOpts{
+	Name:    "dhcpv4_all_granted_leases_seconds",
+	Help:    "Lease time granted in every ACK that grants one",
+	Buckets: []float64{60, 300, 900, 1800, 3600, 2 * 3600, 4 * 3600, 8 * 3600, 12 * 3600, 86400, 2 * 86400, 7 * 86400, 30 * 86400},
+})
+
+// clients choose their class, so they could otherwise make this unbounded
+var v4classlabel = statsutil.BoundedLabel("client class", 100)
+
+// unknown option codes could otherwise make this unbounded
+var v6orolabel = statsutil.BoundedLabel("ORO option", 64)
+
+// we expect a few servers, but a misconfiguration could add more
+var v4serveridlabel = statsutil.BoundedLabel("server ID", 64)
+
+// one per downlink, which could be a lot of them
+var v6interfacelabel = statsutil.BoundedLabel("interface", 1024)
+
+// this also bounds the interfaces whose delegated prefixes we remember
+var v6pdinterfacelabel = statsutil.BoundedLabel("delegating interface", 1024)
+
 type OptionCode = dhcpv6.OptionCode
 
 type IdentityAssociation interface {
@@ -66,13 +236,40 @@ type IdentityAssociation interface {
 	New([4]byte) IdentityAssociation
 	Allocated()  bool
 	AddStatusUnavailable()
+	Lifetimes()  []Lifetime
+	// Option returns the dhcpv6 option, which is what responses must
+	// carry for other code to find it
+	Option()     dhcpv6.Option
+}
+
+// Lifetime holds the lifetimes of an address or prefix in an IA.
+type Lifetime struct {
+	Preferred time.Duration
+	Valid     time.Duration
+}
+
+func addressLifetimes(addrs []*dhcpv6.OptIAAddress) []Lifetime {
+	lifetimes := make([]Lifetime, len(addrs))
+	for idx, addr := range addrs {
+		lifetimes[idx] = Lifetime{addr.PreferredLifetime, addr.ValidLifetime}
+	}
+	return lifetimes
 }
 
 type OptIANA dhcpv6.OptIANA
 type OptIATA dhcpv6.OptIATA
 type OptIAPD dhcpv6.OptIAPD
 
+// noIAs is what the From* helpers return for no IAs, so most requests
+// don't allocate for the IA types they don't use. Its capacity is 0, so
+// appending to it never writes to it. We don't pool the converted slices
+// because ia_fixup's callers hold on to them.
+var noIAs = []IdentityAssociation{}
+
 func FromIANA(ia []*dhcpv6.OptIANA) []IdentityAssociation {
+	if len(ia) == 0 {
+		return noIAs
+	}
 	converted := make([]IdentityAssociation, len(ia))
 	for idx, iana := range ia {
 		converted[idx] = (*OptIANA)(iana)
@@ -81,6 +278,9 @@ func FromIANA(ia []*dhcpv6.OptIANA) []IdentityAssociation {
 }
 
 func FromIATA(ia []*dhcpv6.OptIATA) []IdentityAssociation {
+	if len(ia) == 0 {
+		return noIAs
+	}
 	converted := make([]IdentityAssociation, len(ia))
 	for idx, iata := range ia {
 		converted[idx] = (*OptIATA)(iata)
@@ -89,6 +289,9 @@ func FromIATA(ia []*dhcpv6.OptIATA) []IdentityAssociation {
 }
 
 func FromIAPD(ia []*dhcpv6.OptIAPD) []IdentityAssociation {
+	if len(ia) == 0 {
+		return noIAs
+	}
 	converted := make([]IdentityAssociation, len(ia))
 	for idx, iapd := range ia {
 		converted[idx] = (*OptIAPD)(iapd)
@@ -111,6 +314,9 @@ func (ia *OptIAPD) String() string { return (*(*dhcpv6.OptIAPD)(ia)).String() }
 func (ia *OptIANA) New(iaid [4]byte) IdentityAssociation { return &OptIANA{IaId: iaid} }
 func (ia *OptIATA) New(iaid [4]byte) IdentityAssociation { return &OptIATA{IaId: iaid} }
 func (ia *OptIAPD) New(iaid [4]byte) IdentityAssociation { return &OptIAPD{IaId: iaid} }
+func (ia *OptIANA) Option() dhcpv6.Option { return (*dhcpv6.OptIANA)(ia) }
+func (ia *OptIATA) Option() dhcpv6.Option { return (*dhcpv6.OptIATA)(ia) }
+func (ia *OptIAPD) Option() dhcpv6.Option { return (*dhcpv6.OptIAPD)(ia) }
 func (ia *OptIANA) Allocated() bool {return (*(*dhcpv6.OptIANA)(ia)).Options.OneAddress() != nil }
 func (ia *OptIATA) Allocated() bool {return (*(*dhcpv6.OptIATA)(ia)).Options.OneAddress() != nil }
 func (ia *OptIAPD) Allocated() bool {return len((*(*dhcpv6.OptIAPD)(ia)).Options.Prefixes()) > 0 }
@@ -124,52 +330,531 @@ func (ia *OptIAPD) AddStatusUnavailable() {
 	(*(*dhcpv6.OptIAPD)(ia)).Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoPrefixAvail})
 }
 
+// statusCodes returns every status code in options, including those
+// nested inside IAs and their addresses and prefixes.
+func statusCodes(options dhcpv6.Options) []iana.StatusCode {
+	var codes []iana.StatusCode
+	for _, opt := range options {
+		switch o := opt.(type) {
+		case *dhcpv6.OptStatusCode:
+			codes = append(codes, o.StatusCode)
+		case *dhcpv6.OptIANA:
+			codes = append(codes, statusCodes(o.Options.Options)...)
+		case *dhcpv6.OptIATA:
+			codes = append(codes, statusCodes(o.Options.Options)...)
+		case *dhcpv6.OptIAPD:
+			codes = append(codes, statusCodes(o.Options.Options)...)
+		case *dhcpv6.OptIAAddress:
+			codes = append(codes, statusCodes(o.Options.Options)...)
+		case *dhcpv6.OptIAPrefix:
+			codes = append(codes, statusCodes(o.Options.Options)...)
+		}
+	}
+	return codes
+}
+
+func (ia *OptIANA) Lifetimes() []Lifetime {
+	return addressLifetimes((*(*dhcpv6.OptIANA)(ia)).Options.Addresses())
+}
+func (ia *OptIATA) Lifetimes() []Lifetime {
+	return addressLifetimes((*(*dhcpv6.OptIATA)(ia)).Options.Addresses())
+}
+func (ia *OptIAPD) Lifetimes() []Lifetime {
+	prefixes := (*(*dhcpv6.OptIAPD)(ia)).Options.Prefixes()
+	lifetimes := make([]Lifetime, len(prefixes))
+	for idx, prefix := range prefixes {
+		lifetimes[idx] = Lifetime{prefix.PreferredLifetime, prefix.ValidLifetime}
+	}
+	return lifetimes
+}
+
+// requestContext describes the client and relay of a DHCPv6 request
+// for logging.
+func requestContext(req dhcpv6.DHCPv6, reqmsg *dhcpv6.Message) string {
+	duid := "<unspecified>"
+	if id := reqmsg.Options.ClientID(); id != nil {
+		duid = id.String()
+	}
+	linkstr := "<unspecified>"
+	intfstr := "<unspecified>"
+	if innermsg, err := dhcpv6.DecapsulateRelayIndex(req, -1); err == nil {
+		if inner, ok := innermsg.(*dhcpv6.RelayMessage); ok {
+			linkstr = inner.LinkAddr.String()
+			if intf := inner.Options.InterfaceID(); len(intf) > 0 {
+				intfstr = string(intf)
+			}
+		}
+	}
+	return fmt.Sprintf("[link=%s intf=%s] DUID %s", linkstr, intfstr, duid)
+}
+
+// wireBytes returns resp as the server will send it, encapsulated in a
+// Relay-Reply for each relay req passed through.
+func wireBytes(req, resp dhcpv6.DHCPv6) []byte {
+	relay, relayed := req.(*dhcpv6.RelayMessage)
+	msg, ok := resp.(*dhcpv6.Message)
+	if !relayed || !ok {
+		return resp.ToBytes()
+	}
+	wire, err := dhcpv6.NewRelayReplFromRelayForw(relay, msg)
+	if err != nil {
+		return resp.ToBytes()
+	}
+	return wire.ToBytes()
+}
+
+// relayInterface returns the Interface-ID of the innermost relay, or "none"
+// if req wasn't relayed or the relay didn't send one.
+func relayInterface(req dhcpv6.DHCPv6) string {
+	if innermsg, err := dhcpv6.DecapsulateRelayIndex(req, -1); err == nil {
+		if inner, ok := innermsg.(*dhcpv6.RelayMessage); ok {
+			if intf := inner.Options.InterfaceID(); len(intf) > 0 {
+				return statsutil.SanitizeLabel(string(intf))
+			}
+		}
+	}
+	return "none"
+}
+
 type StringLogger func(string)
 
+// default MTUs, and the IP and UDP header bytes that count against them
+const (
+	defaultMTU4 = 1500
+	defaultMTU6 = 1280
+	headers4    = 20 + 8
+	headers6    = 40 + 8
+)
+
+// Profile identifies ACKs from one of our allocation profiles by the
+// presence of all of its signature options.
+type Profile struct {
+	Name    string
+	Options []dhcpv4.OptionCode
+}
+
+// parseProfiles parses profile rules like voice:option176,data:option252+option43
+func parseProfiles(s string) ([]Profile, error) {
+	var profiles []Profile
+	for _, rule := range strings.Split(s, ",") {
+		name, signature, ok := strings.Cut(rule, ":")
+		if !ok || len(name) == 0 {
+			return nil, fmt.Errorf("invalid profile rule %q, expected name:optionN", rule)
+		}
+		profile := Profile{Name: name}
+		for _, opt := range strings.Split(signature, "+") {
+			code, err := strconv.ParseUint(strings.TrimPrefix(opt, "option"), 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid option %q in profile %s", opt, name)
+			}
+			profile.Options = append(profile.Options, dhcpv4.GenericOptionCode(code))
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// classifyProfile returns the name of the first profile whose signature
+// options are all present in resp, or "unclassified".
+func classifyProfile(profiles []Profile, resp *dhcpv4.DHCPv4) string {
+	for _, profile := range profiles {
+		matched := true
+		for _, code := range profile.Options {
+			if !resp.Options.Has(code) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return profile.Name
+		}
+	}
+	return "unclassified"
+}
+
+// IfaceRule maps relays in Subnet to the interface responses to them
+// leave on.
+type IfaceRule struct {
+	Subnet *net.IPNet
+	Iface  string
+}
+
+// parseIfaceMap parses rules like 10.99.0.0/16:eth1,2001:db8::/32:eth2
+func parseIfaceMap(s string) ([]IfaceRule, error) {
+	var rules []IfaceRule
+	for _, rule := range strings.Split(s, ",") {
+		// IPv6 CIDRs contain colons, so the interface follows the last one
+		idx := strings.LastIndex(rule, ":")
+		if idx < 0 || idx == len(rule)-1 {
+			return nil, fmt.Errorf("invalid iface_map rule %q, expected cidr:iface", rule)
+		}
+		_, subnet, err := net.ParseCIDR(rule[:idx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid iface_map rule %q: %v", rule, err)
+		}
+		rules = append(rules, IfaceRule{Subnet: subnet, Iface: rule[idx+1:]})
+	}
+	return rules, nil
+}
+
+// egressIface returns the interface of the first rule whose subnet
+// contains relay, or "unknown".
+func egressIface(rules []IfaceRule, relay net.IP) string {
+	if relay != nil && !relay.IsUnspecified() {
+		for _, rule := range rules {
+			if rule.Subnet.Contains(relay) {
+				return rule.Iface
+			}
+		}
+	}
+	return "unknown"
+}
+
+// relayPeerAddr returns the peer address of the outermost relay, the
+// hop our response goes back through, or nil if req wasn't relayed.
+func relayPeerAddr(req dhcpv6.DHCPv6) net.IP {
+	if relay, ok := req.(*dhcpv6.RelayMessage); ok {
+		return relay.PeerAddr
+	}
+	return nil
+}
+
+// clientClass returns the first user class req carries, else its vendor
+// class identifier, else "none".
+func clientClass(req *dhcpv4.DHCPv4) string {
+	if classes := req.UserClass(); len(classes) > 0 && len(classes[0]) > 0 {
+		return statsutil.SanitizeLabel(classes[0])
+	}
+	if class := req.ClassIdentifier(); len(class) > 0 {
+		return statsutil.SanitizeLabel(class)
+	}
+	return "none"
+}
+
+// we track consecutive NAKs for at most maxNAKClients clients; a run of
+// NAKs ends if the client goes nakWindow without one
+const (
+	maxNAKClients       = 4096
+	nakWindow           = 5 * time.Minute
+	defaultNAKThreshold = 3
+)
+
+// delivery returns how RFC 2131 4.1 says resp to req is delivered: to
+// the relay, unicast to the client, or broadcast.
+func delivery(req, resp *dhcpv4.DHCPv4) string {
+	if len(req.GatewayIPAddr) > 0 && !req.GatewayIPAddr.IsUnspecified() {
+		return "relay"
+	}
+	if resp.MessageType() == dhcpv4.MessageTypeNak {
+		return "broadcast"
+	}
+	if len(req.ClientIPAddr) > 0 && !req.ClientIPAddr.IsUnspecified() {
+		return "unicast"
+	}
+	if req.IsBroadcast() {
+		return "broadcast"
+	}
+	return "unicast"
+}
+
+// we remember at most maxDelegatedPrefixes prefixes per interface, each
+// for pdWindow after we last delegated it, pruning every interface once
+// per pdPruneInterval
+const (
+	maxDelegatedPrefixes = 65536
+	pdWindow             = 24 * time.Hour
+	pdPruneInterval      = time.Minute
+)
+
+// prefixSet is the prefixes recently delegated behind one interface, and
+// when we last delegated each
+type prefixSet map[string]time.Time
+
+// pruneSet forgets the prefixes behind intf we haven't delegated within
+// pdWindow, and forgets intf, gauge included, once none are left. The
+// caller must hold the lock.
+func (state *PluginState) pruneSet(intf string, now time.Time) {
+	set := state.delegated[intf]
+	for prefix, last := range set {
+		if now.Sub(last) > pdWindow {
+			delete(set, prefix)
+			statsutil.WindowEntries.Dec()
+		}
+	}
+	if len(set) == 0 {
+		delete(state.delegated, intf)
+		v6distinctprefixes.DeleteLabelValues(intf)
+		return
+	}
+	v6distinctprefixes.WithLabelValues(intf).Set(float64(len(set)))
+}
+
+// prunePrefixes prunes every interface, so the gauges of interfaces that
+// stop delegating still decay.
+func (state *PluginState) prunePrefixes() {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	for intf := range state.delegated {
+		state.pruneSet(intf, now)
+	}
+}
+
+// prefixesDelegated records the prefixes delegated behind intf and
+// updates its gauge.
+func (state *PluginState) prefixesDelegated(intf string, prefixes []string) {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	set, ok := state.delegated[intf]
+	if !ok {
+		set = make(prefixSet)
+	} else if len(set) >= maxDelegatedPrefixes {
+		state.pruneSet(intf, now)
+	}
+	// pruning may have forgotten intf
+	state.delegated[intf] = set
+	for _, prefix := range prefixes {
+		if _, known := set[prefix]; !known {
+			if len(set) >= maxDelegatedPrefixes {
+				continue
+			}
+			statsutil.WindowEntries.Inc()
+		}
+		set[prefix] = now
+	}
+	v6distinctprefixes.WithLabelValues(intf).Set(float64(len(set)))
+}
+
+// nakRun is a client's run of consecutive NAKs
+type nakRun struct {
+	count int
+	last  time.Time
+}
+
+// each sampled response moves the satisfied ratio EWMA this far
+const ewmaWeight = 0.05
+
 type PluginState struct {
-	//sync.Mutex
+	sync.Mutex
+	statsutil.Clock
+	statsutil.Snapshotter
+	statsutil.TypeLabeler
 	Logger StringLogger
+	// MTU overrides the default MTU for the family if nonzero
+	MTU int
+	// IASample selects the IA results that feed the satisfied ratio EWMA
+	IASample *statsutil.Sampler
+	satisfiedEWMA map[string]float64
+	// Profiles classify DHCPv4 ACKs if not empty
+	Profiles []Profile
+	// IfaceMap, if not empty, counts responses by egress interface
+	IfaceMap []IfaceRule
+	// Recorder, if not nil, captures the pairs RecordSample selects
+	Recorder     *statsutil.Recorder
+	RecordSample *statsutil.Sampler
+	// MaxIAs, if nonzero, is the most IAs a request can carry before we
+	// drop it
+	MaxIAs int
+	// NAKThreshold is the number of consecutive NAKs that makes a loop
+	NAKThreshold int
+	naks         map[string]nakRun
+	delegated    map[string]prefixSet
+	unsatisfied  map[string]unsatisfiedScore
+	// AmplificationThreshold, if nonzero, logs responses more than this
+	// many times larger than their request
+	AmplificationThreshold float64
+	// TrackIAIDs records the low byte of requested IAIDs, for debugging
+	// IAID collisions
+	TrackIAIDs bool
 }
 
-func ia_fixup(resp *dhcpv6.DHCPv6, request_ias, response_ias []IdentityAssociation) (string, int) {
-	satisfied := 0
-	unsatisfied := 0
-	newstatus := 0
-	for _, reqia := range request_ias {
+// nakSeen tracks runs of consecutive NAKs to mac and reports whether this
+// NAK makes the run reach NAKThreshold. Any other response ends the run.
+func (state *PluginState) nakSeen(mac string, nak bool) bool {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	run, known := state.naks[mac]
+	if !nak {
+		if known {
+			delete(state.naks, mac)
+			statsutil.WindowEntries.Dec()
+		}
+		return false
+	}
+	if known && now.Sub(run.last) > nakWindow {
+		run.count = 0
+	}
+	if !known && len(state.naks) >= maxNAKClients {
+		for m, r := range state.naks {
+			if now.Sub(r.last) > nakWindow {
+				delete(state.naks, m)
+				statsutil.WindowEntries.Dec()
+			}
+		}
+		if len(state.naks) >= maxNAKClients {
+			return false
+		}
+	}
+	if !known {
+		statsutil.WindowEntries.Inc()
+	}
+	run.count++
+	run.last = now
+	state.naks[mac] = run
+	return run.count == state.NAKThreshold
+}
+
+// updateSatisfiedRatio feeds result into the EWMA for iatype if IASample
+// selects it.
+func (state *PluginState) updateSatisfiedRatio(iatype string, result FixupResult) {
+	total := result.Satisfied + result.Unsatisfied
+	if total == 0 || !state.IASample.Sample() {
+		return
+	}
+	ratio := float64(result.Satisfied) / float64(total)
+	state.Lock()
+	defer state.Unlock()
+	if ewma, ok := state.satisfiedEWMA[iatype]; ok {
+		ratio = ewmaWeight*ratio + (1-ewmaWeight)*ewma
+	}
+	state.satisfiedEWMA[iatype] = ratio
+	v6satisfiedratio.WithLabelValues(iatype).Set(ratio)
+}
+
+// amplificationFactor returns the ratio of the response size to the request
+// size, or 0 for an empty request.
+func amplificationFactor(req, resp []byte) float64 {
+	if len(req) == 0 {
+		return 0
+	}
+	return float64(len(resp)) / float64(len(req))
+}
+
+// checkAmplification records the amplification factor of a response and
+// logs it if it exceeds AmplificationThreshold.
+func (state *PluginState) checkAmplification(family string, req, resp []byte) {
+	factor := amplificationFactor(req, resp)
+	amplification.WithLabelValues(family).Observe(factor)
+	if state.AmplificationThreshold > 0 && factor > state.AmplificationThreshold {
+		log.Warningf("%d byte %s request got %d byte response, amplification %.1f exceeds %.1f",
+			len(req), family, len(resp), factor, state.AmplificationThreshold)
+	}
+}
+
+// mtu returns the configured MTU, or def if none is configured.
+func (state *PluginState) mtu(def int) int {
+	if state.MTU > 0 {
+		return state.MTU
+	}
+	return def
+}
+
+// addressChanged returns whether respia allocates a valid address that isn't
+// one of the addresses the client holds in reqia. It returns false if reqia
+// carries no addresses, since then there's nothing to compare with.
+func addressChanged(reqia, respia *dhcpv6.OptIANA) bool {
+	held := reqia.Options.Addresses()
+	if len(held) == 0 {
+		return false
+	}
+	for _, addr := range respia.Options.Addresses() {
+		if addr.ValidLifetime == 0 {
+			// the server withdrawing an old address
+			continue
+		}
 		found := false
-		iaid := reqia.Id()
-		for _, respia := range response_ias {
-			respiaid := respia.Id()
-			if bytes.Compare(iaid[:], respiaid[:]) == 0 {
-				if respia.Allocated() {
-					satisfied++
-				} else {
-					unsatisfied++
-				}
+		for _, old := range held {
+			if old.IPv6Addr.Equal(addr.IPv6Addr) {
 				found = true
 				break
 			}
 		}
 		if !found {
-			unsatisfied++
-			newstatus++
+			return true
+		}
+	}
+	return false
+}
+
+// FixupResult summarizes how the response satisfied the requested IAs.
+// Quantifier is one of {all, some, none} and Added is the number of
+// IAs for which ia_fixup added a status code to the response.
+type FixupResult struct {
+	Satisfied   int
+	Unsatisfied int
+	Added       int
+	Quantifier  string
+}
+
+// quantify sets Quantifier from the satisfied and unsatisfied counts.
+func (result *FixupResult) quantify() {
+	if result.Unsatisfied == 0 {
+		result.Quantifier = "all"
+	} else if result.Satisfied == 0 {
+		result.Quantifier = "none"
+	} else {
+		result.Quantifier = "some"
+	}
+}
+
+func ia_fixup(resp *dhcpv6.DHCPv6, request_ias, response_ias []IdentityAssociation) FixupResult {
+	var result FixupResult
+	// index the response IAs by IAID so clients requesting many IAs
+	// don't cost us quadratic time; the first IA with an IAID wins
+	byid := make(map[[4]byte]IdentityAssociation, len(response_ias))
+	for _, respia := range response_ias {
+		if _, ok := byid[respia.Id()]; !ok {
+			byid[respia.Id()] = respia
+		}
+	}
+	for _, reqia := range request_ias {
+		iaid := reqia.Id()
+		if respia, found := byid[iaid]; found {
+			if respia.Allocated() {
+				result.Satisfied++
+			} else {
+				result.Unsatisfied++
+			}
+		} else {
+			result.Unsatisfied++
+			// Handler6 has already checked, but don't panic if we're
+			// ever given something else
+			if msg, ok := (*resp).(*dhcpv6.Message); !ok || msg == nil {
+				v6iafixupaddfailed.Inc()
+				continue
+			}
+			result.Added++
 			newresp := reqia.New(iaid)
 			newresp.AddStatusUnavailable()
-			(*resp).AddOption(newresp)
+			(*resp).AddOption(newresp.Option())
 		}
 	}
-	if unsatisfied == 0 {
-		return "all", newstatus
-	} else if satisfied == 0 {
-		return "none", newstatus
+	result.quantify()
+	return result
+}
+
+// singleIAFixup is ia_fixup for the common case of one request IA and one
+// response IA with the same IAID, which needs no matching.
+func singleIAFixup(respia IdentityAssociation) FixupResult {
+	var result FixupResult
+	if respia.Allocated() {
+		result.Satisfied = 1
+	} else {
+		result.Unsatisfied = 1
 	}
-	return "some", newstatus
+	result.quantify()
+	return result
 }
 
 func (state *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	outcome := "ok"
+	defer func() { handled.WithLabelValues("v6", outcome).Inc() }()
 	respmsg, ok := resp.(*dhcpv6.Message)
 	if !ok {
 		v6types.WithLabelValues("error").Inc()
+		outcome = "error"
 		log.Errorf("response message format bug: %v", respmsg)
 		return nil, true
 	}
@@ -179,39 +864,191 @@ func (state *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool
 		_, ok := req.(*dhcpv6.Message)
 		if !ok {
 			v6types.WithLabelValues("error").Inc()
+			outcome = "error"
 			log.Errorf("request message format bug: %v", req)
 			return nil, true
 		}
 	}
 
-	v6types.WithLabelValues(respmsg.MessageType.String()).Inc()
+	v6types.WithLabelValues(state.TypeLabel(respmsg.MessageType)).Inc()
+	if len(state.IfaceMap) > 0 {
+		egressiface.WithLabelValues(egressIface(state.IfaceMap, relayPeerAddr(req))).Inc()
+	}
+	if respmsg.MessageType == dhcpv6.MessageTypeAdvertise || respmsg.MessageType == dhcpv6.MessageTypeReply {
+		if respmsg.Options.ServerID() == nil {
+			// clients will discard this response
+			v6noserverid.Inc()
+			log.Errorf("%s response without a Server Identifier: %s", respmsg.MessageType, respmsg)
+		}
+	}
+	if respmsg.MessageType == dhcpv6.MessageTypeReply && respmsg.GetOneOption(dhcpv6.OptionCaptivePortal) != nil {
+		captiveportal.WithLabelValues("v6").Inc()
+	}
+	if respmsg.MessageType == dhcpv6.MessageTypeAdvertise && respmsg.GetOneOption(dhcpv6.OptionPreference) == nil {
+		// clients treat this as preference 0
+		v6nopreference.Inc()
+	}
 	reqmsg, err := req.GetInnerMessage()
 	if err != nil {
 		v6types.WithLabelValues("error").Inc()
+		outcome = "error"
 		log.Errorf("could not decapsulate inner request message: %v", err)
 		return nil, true
 	}
+	if reqmsg.Type() == dhcpv6.MessageTypeSolicit && reqmsg.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+		switch respmsg.MessageType {
+		case dhcpv6.MessageTypeReply:
+			v6rapidcommithonored.Inc()
+		case dhcpv6.MessageTypeAdvertise:
+			// by policy, or because we're out of addresses
+			v6rapidcommitdeclined.Inc()
+		}
+	}
+	if respmsg.MessageType == dhcpv6.MessageTypeAdvertise || respmsg.MessageType == dhcpv6.MessageTypeReply {
+		for _, code := range reqmsg.Options.RequestedOptions() {
+			if respmsg.GetOneOption(code) == nil {
+				v6orounsatisfied.WithLabelValues(v6orolabel(code.String())).Inc()
+			}
+		}
+	}
 
+	iatypes := []struct {
+		name            string
+		reqias, respias []IdentityAssociation
+	}{
+		{"IA_NA", FromIANA(reqmsg.Options.IANA()), FromIANA(respmsg.Options.IANA())},
+		{"IA_TA", FromIATA(reqmsg.Options.IATA()), FromIATA(respmsg.Options.IATA())},
+		{"IA_PD", FromIAPD(reqmsg.Options.IAPD()), FromIAPD(respmsg.Options.IAPD())},
+	}
+	if state.MaxIAs > 0 {
+		count := 0
+		for _, iatype := range iatypes {
+			count += len(iatype.reqias)
+		}
+		if count > state.MaxIAs {
+			// don't let a malicious client make us match them all
+			v6excessiveias.Inc()
+			outcome = "dropped"
+			log.Warningf("dropping request with %d IAs, more than %d: %s", count, state.MaxIAs, requestContext(req, reqmsg))
+			return nil, true
+		}
+	}
+	all_requested := 0
 	all_adds := 0
-	if len(reqmsg.Options.IANA()) > 0 {
-		quantifier, adds := ia_fixup(&resp, FromIANA(reqmsg.Options.IANA()), FromIANA(respmsg.Options.IANA()))
-		v6processed.WithLabelValues("IA_NA", quantifier).Inc()
-		all_adds = all_adds + adds
+	all_unsatisfied := 0
+	intf := ""
+	for _, iatype := range iatypes {
+		if len(iatype.reqias) == 0 {
+			continue
+		}
+		if state.TrackIAIDs {
+			for _, reqia := range iatype.reqias {
+				id := reqia.Id()
+				v6iaidlowbyte.WithLabelValues(iatype.name).Observe(float64(id[3]))
+			}
+		}
+		start := time.Now()
+		var result FixupResult
+		if len(iatype.reqias) == 1 && len(iatype.respias) == 1 && iatype.reqias[0].Id() == iatype.respias[0].Id() {
+			result = singleIAFixup(iatype.respias[0])
+		} else {
+			result = ia_fixup(&resp, iatype.reqias, iatype.respias)
+		}
+		v6iafixupduration.WithLabelValues(iatype.name).Observe(time.Since(start).Seconds())
+		v6processed.WithLabelValues(iatype.name, result.Quantifier).Inc()
+		if len(intf) == 0 {
+			intf = v6interfacelabel(relayInterface(req))
+		}
+		v6iabyinterface.WithLabelValues(intf, result.Quantifier).Inc()
+		state.updateSatisfiedRatio(iatype.name, result)
+		all_requested = all_requested + len(iatype.reqias)
+		all_adds = all_adds + result.Added
+		all_unsatisfied = all_unsatisfied + result.Unsatisfied
+		if result.Added > 0 {
+			state.Logger(fmt.Sprintf("[denied %d %s] %s", result.Added, iatype.name, requestContext(req, reqmsg)))
+		}
+	}
+	// once per response, however many IA types went unsatisfied
+	if duid := reqmsg.Options.ClientID(); duid != nil && all_unsatisfied > 0 {
+		state.unsatisfiedSeen(duid.String())
+	}
+	kind := ""
+	switch reqmsg.Type() {
+	case dhcpv6.MessageTypeRenew:
+		kind = "renew"
+	case dhcpv6.MessageTypeRebind:
+		kind = "rebind"
+	}
+	if len(kind) > 0 {
+		switch {
+		case all_requested == 0:
+			// nothing to retain or deny
+			v6renewrebind.WithLabelValues(kind, "no_ia").Inc()
+		case all_unsatisfied == 0:
+			v6renewrebind.WithLabelValues(kind, "retained").Inc()
+		default:
+			v6renewrebind.WithLabelValues(kind, "denied").Inc()
+		}
+		for _, reqia := range reqmsg.Options.IANA() {
+			for _, respia := range respmsg.Options.IANA() {
+				if respia.IaId == reqia.IaId {
+					if addressChanged(reqia, respia) {
+						v6addrchanged.Inc()
+						log.Warningf("%s of %s changed address: %s", kind, reqia, respia)
+					}
+					break
+				}
+			}
+		}
+	}
+	if size := len(wireBytes(req, resp)) + headers6; size > state.mtu(defaultMTU6) {
+		v6exceedsmtu.Inc()
+		log.Warningf("%d byte response exceeds MTU %d: %s", size, state.mtu(defaultMTU6), resp)
+	}
+	// resp isn't relay encapsulated yet, so compare it with the inner request
+	state.checkAmplification("v6", reqmsg.ToBytes(), resp.ToBytes())
+	var respias []IdentityAssociation
+	for _, iatype := range iatypes {
+		respias = append(respias, iatype.respias...)
+	}
+	for _, ia := range respias {
+		zero := false
+		for _, lifetime := range ia.Lifetimes() {
+			if lifetime.Preferred > lifetime.Valid {
+				v6invalidlifetime.WithLabelValues(ia.Code().String()).Inc()
+				log.Errorf("preferred lifetime %s > valid lifetime %s in %s", lifetime.Preferred, lifetime.Valid, ia)
+			}
+			if lifetime.Valid == 0 {
+				zero = true
+			}
+		}
+		if zero {
+			v6zerolifetime.WithLabelValues(ia.Code().String()).Inc()
+		}
 	}
-	if len(reqmsg.Options.IATA()) > 0 {
-		quantifier, adds := ia_fixup(&resp, FromIATA(reqmsg.Options.IATA()), FromIATA(respmsg.Options.IATA()))
-		v6processed.WithLabelValues("IA_TA", quantifier).Inc()
-		all_adds = all_adds + adds
+	if respmsg.MessageType == dhcpv6.MessageTypeReply {
+		var prefixes []string
+		for _, iapd := range respmsg.Options.IAPD() {
+			for _, prefix := range iapd.Options.Prefixes() {
+				if prefix.Prefix != nil && prefix.ValidLifetime > 0 {
+					prefixes = append(prefixes, prefix.Prefix.String())
+				}
+			}
+		}
+		if len(prefixes) > 0 {
+			state.prefixesDelegated(v6pdinterfacelabel(relayInterface(req)), prefixes)
+		}
 	}
-	if len(reqmsg.Options.IAPD()) > 0 {
-		quantifier, adds := ia_fixup(&resp, FromIAPD(reqmsg.Options.IAPD()), FromIAPD(respmsg.Options.IAPD()))
-		v6processed.WithLabelValues("IA_PD", quantifier).Inc()
-		all_adds = all_adds + adds
+	for _, code := range statusCodes(respmsg.Options.Options) {
+		v6statuscodes.WithLabelValues(code.String()).Inc()
 	}
 	options := ""
 	for _, opt := range respmsg.Options.Options {
 		options += fmt.Sprintf(" %v", opt.String())
 	}
+	if state.Recorder != nil && state.RecordSample.Sample() {
+		state.Recorder.Record(6, req.ToBytes(), resp.ToBytes())
+	}
 	if all_adds > 0 {
 		state.Logger(fmt.Sprintf("[added %d statuscodes] %s %s", all_adds, resp, options))
 	} else {
@@ -221,9 +1058,29 @@ func (state *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool
 }
 
 func (state *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	outcome := "ok"
+	defer func() { handled.WithLabelValues("v4", outcome).Inc() }()
 	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		outcome = "error"
+		return resp, false
+	}
+	if resp == nil || resp.OpCode != dhcpv4.OpcodeBootReply {
+		// nothing we could count, but the rest of the chain may cope
+		outcome = "error"
+		log.Errorf("response message format bug: %v", resp)
 		return resp, false
 	}
+	// the server usually sends nothing to a DECLINE or RELEASE, and
+	// nothing it sends allocates a lease, so we don't log one
+	lifecycle := false
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDecline, dhcpv4.MessageTypeRelease:
+		v4lifecycle.WithLabelValues(strings.ToLower(req.MessageType().String())).Inc()
+		lifecycle = true
+	}
+	if state.Recorder != nil && state.RecordSample.Sample() {
+		state.Recorder.Record(4, req.ToBytes(), resp.ToBytes())
+	}
 	mac := req.ClientHWAddr
 	has_yiaddr := len(resp.YourIPAddr) > 0 && !resp.YourIPAddr.IsUnspecified()
 	if resp.MessageType() == dhcpv4.MessageTypeOffer || resp.MessageType() == dhcpv4.MessageTypeAck {
@@ -233,12 +1090,58 @@ func (state *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bo
 			v4processed.WithLabelValues("none").Inc()
 		}
 	}
-	v4types.WithLabelValues(resp.MessageType().String()).Inc()
+	v4types.WithLabelValues(state.TypeLabel(resp.MessageType())).Inc()
+	v4delivery.WithLabelValues(delivery(req, resp)).Inc()
+	if len(state.IfaceMap) > 0 {
+		egressiface.WithLabelValues(egressIface(state.IfaceMap, req.GatewayIPAddr)).Inc()
+	}
+	if serverid := resp.ServerIdentifier(); serverid != nil {
+		v4serverid.WithLabelValues(v4serveridlabel(serverid.String())).Inc()
+	}
+	if hint := req.RequestedIPAddress(); hint != nil && resp.MessageType() == dhcpv4.MessageTypeOffer {
+		v4offerhint.WithLabelValues(strconv.FormatBool(hint.Equal(resp.YourIPAddr))).Inc()
+	}
+	if resp.MessageType() == dhcpv4.MessageTypeAck && has_yiaddr {
+		// only a client renewing or rebinding a lease fills in ciaddr
+		if req.MessageType() == dhcpv4.MessageTypeRequest && len(req.ClientIPAddr) > 0 && !req.ClientIPAddr.IsUnspecified() {
+			v4allocations.WithLabelValues("renewal").Inc()
+		} else {
+			v4allocations.WithLabelValues("new").Inc()
+		}
+	}
+	if state.nakSeen(mac.String(), resp.MessageType() == dhcpv4.MessageTypeNak) {
+		v4nakloops.Inc()
+		log.Warningf("MAC %s got %d NAKs in a row", mac, state.NAKThreshold)
+	}
+	if size := len(resp.ToBytes()) + headers4; size > state.mtu(defaultMTU4) {
+		v4exceedsmtu.Inc()
+		log.Warningf("%d byte response exceeds MTU %d: %s", size, state.mtu(defaultMTU4), resp)
+	}
+	state.checkAmplification("v4", req.ToBytes(), resp.ToBytes())
+	// ACKs to INFORMs don't grant a lease, so they carry no lease time
+	if resp.MessageType() == dhcpv4.MessageTypeAck && resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+		v4allleases.WithLabelValues().Observe(resp.IPAddressLeaseTime(0).Seconds())
+	}
+	if lease := resp.IPAddressLeaseTime(0); resp.MessageType() == dhcpv4.MessageTypeAck && has_yiaddr && lease > 0 {
+		v4leasetime.WithLabelValues(v4classlabel(clientClass(req))).Observe(lease.Seconds())
+	}
+	if resp.MessageType() == dhcpv4.MessageTypeAck && len(state.Profiles) > 0 {
+		v4profiles.WithLabelValues(classifyProfile(state.Profiles, resp)).Inc()
+	}
+	// RFC 8910 reassigned option 114 from URL to the captive portal URI
+	if resp.MessageType() == dhcpv4.MessageTypeAck && resp.Options.Has(dhcpv4.OptionURL) {
+		captiveportal.WithLabelValues("v4").Inc()
+	}
+	if resp.MessageType() == dhcpv4.MessageTypeAck && resp.Options.Has(dhcpv4.OptionClasslessStaticRoute) {
+		v4staticroutes.Inc()
+		// ClasslessStaticRoute() returns nil if the option doesn't parse
+		v4staticroutecount.Add(float64(len(resp.ClasslessStaticRoute())))
+	}
 	rai := req.RelayAgentInfo()
 	req_has_giaddr := len(req.GatewayIPAddr) > 0 && !req.GatewayIPAddr.IsUnspecified()
 	if rai == nil || !req_has_giaddr {
 		// not a relay message
-		if has_yiaddr {
+		if has_yiaddr && !lifecycle {
 			if len(resp.GatewayIPAddr) == 0 || resp.GatewayIPAddr.IsUnspecified() {
 				state.Logger(fmt.Sprintf("MAC %s allocated %s", mac, resp.YourIPAddr))
 			} else {
@@ -259,7 +1162,7 @@ func (state *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bo
 			intfstr = "<unspecified>"
 		}
 	}
-	if has_yiaddr {
+	if has_yiaddr && !lifecycle {
 		state.Logger(fmt.Sprintf("[relay=%s link=%s intf=%s] MAC %s allocated %s", peerstr, linkstr, intfstr, mac, resp.YourIPAddr))
 	}
 
@@ -271,6 +1174,12 @@ func setup6(args ...string) (handler.Handler6, error) {
 	if err := state.FromArgs(args...); err != nil {
 		return nil, err
 	}
+	// only DHCPv6 delegates prefixes
+	statsutil.Every(state.Clock, pdPruneInterval, state.prunePrefixes)
+	// only DHCPv6 tracks unsatisfied clients
+	instancesMu.Lock()
+	instances = append(instances, &state)
+	instancesMu.Unlock()
 	return state.Handler6, nil
 }
 
@@ -283,7 +1192,128 @@ func setup4(args ...string) (handler.Handler4, error) {
 }
 
 func (state *PluginState) FromArgs(args ...string) error {
-	if len(args) > 0 && args[0] == "silent" {
+	args, fileKeys, err := statsutil.ExpandConfigArgs(args)
+	if err != nil {
+		return err
+	}
+	if args, err = histograms.ApplyArgs(args); err != nil {
+		return err
+	}
+	state.Clock = statsutil.RealClock
+	state.IASample = &statsutil.Sampler{N: 1}
+	state.NAKThreshold = defaultNAKThreshold
+	state.naks = make(map[string]nakRun)
+	state.delegated = make(map[string]prefixSet)
+	state.unsatisfied = make(map[string]unsatisfiedScore)
+	state.satisfiedEWMA = make(map[string]float64)
+	silent := false
+	recordDir := ""
+	var dedupWindow time.Duration
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "silent":
+			silent = true
+		case "mtu":
+			mtu, err := strconv.Atoi(value)
+			if err != nil || mtu <= 0 {
+				return fmt.Errorf("invalid mtu %q", value)
+			}
+			state.MTU = mtu
+		case "amplification_threshold":
+			threshold, err := strconv.ParseFloat(value, 64)
+			if err != nil || threshold <= 0 {
+				return fmt.Errorf("invalid amplification_threshold %q", value)
+			}
+			state.AmplificationThreshold = threshold
+		case "max_ias":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid max_ias %q", value)
+			}
+			state.MaxIAs = n
+		case "nak_loop_threshold":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid nak_loop_threshold %q", value)
+			}
+			state.NAKThreshold = n
+		case "dedup_logs":
+			window, err := time.ParseDuration(value)
+			if err != nil || window <= 0 {
+				return fmt.Errorf("invalid dedup_logs %q", value)
+			}
+			dedupWindow = window
+		case "ia_sample":
+			sampler, err := statsutil.ParseSampler(value)
+			if err != nil {
+				return err
+			}
+			state.IASample = sampler
+		case "track_iaid_hist":
+			track := true
+			if len(value) > 0 {
+				var err error
+				if track, err = strconv.ParseBool(value); err != nil {
+					return fmt.Errorf("invalid track_iaid_hist %q", value)
+				}
+			}
+			state.TrackIAIDs = track
+		case "profile_match":
+			profiles, err := parseProfiles(value)
+			if err != nil {
+				return err
+			}
+			state.Profiles = profiles
+		case "iface_map":
+			rules, err := parseIfaceMap(value)
+			if err != nil {
+				return err
+			}
+			state.IfaceMap = rules
+		case "statsd":
+			if _, err := statsutil.OpenStatsD(value); err != nil {
+				return fmt.Errorf("cannot send to statsd %s: %v", value, err)
+			}
+		case "heartbeat":
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return fmt.Errorf("invalid heartbeat %q", value)
+			}
+			statsutil.StartHeartbeat("responsestats", interval, state.Clock)
+		case "record_dir":
+			recordDir = value
+		case "sample":
+			sampler, err := statsutil.ParseSampler(value)
+			if err != nil {
+				return err
+			}
+			state.RecordSample = sampler
+		case "label_case":
+			if err := state.SetLabelCase(value); err != nil {
+				return err
+			}
+		default:
+			if fileKeys[key] {
+				return fmt.Errorf("unknown key %q in config file", key)
+			}
+			// configs written before we took arguments may pass others
+			log.Warningf("ignoring unknown argument %q", arg)
+		}
+	}
+	if len(recordDir) > 0 {
+		recorder, err := statsutil.OpenRecorder(recordDir)
+		if err != nil {
+			return fmt.Errorf("cannot record to %s: %v", recordDir, err)
+		}
+		state.Recorder = recorder
+		if state.RecordSample == nil {
+			state.RecordSample = &statsutil.Sampler{N: 1}
+		}
+	} else if state.RecordSample != nil {
+		return fmt.Errorf("sample requires record_dir")
+	}
+	if silent {
 		state.Logger = func (s string) {
 			log.Debug(s)
 		}
@@ -292,5 +1322,8 @@ func (state *PluginState) FromArgs(args ...string) error {
 			log.Info(s)
 		}
 	}
+	if dedupWindow > 0 {
+		state.Logger = NewLogDedup(dedupWindow).Wrap(state.Logger)
+	}
 	return nil
 }
@@ -0,0 +1,1485 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package responsestats
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"dhcpserver/statsutil"
+)
+
+// newTestState returns a PluginState configured from args, whose clock
+// is the returned MockClock and whose log lines are appended to lines.
+func newTestState(t *testing.T, args ...string) (*PluginState, *statsutil.MockClock, *[]string) {
+	t.Helper()
+	var state PluginState
+	if err := state.FromArgs(args...); err != nil {
+		t.Fatalf("FromArgs(%q): %v", args, err)
+	}
+	clock := statsutil.NewMockClock()
+	state.Clock = clock
+	var lines []string
+	state.Logger = func(s string) { lines = append(lines, s) }
+	return &state, clock, &lines
+}
+
+// testDUID identifies the client in the DHCPv6 messages tests build
+var testDUID = dhcpv6.Duid{
+	Type:          dhcpv6.DUID_LL,
+	HwType:        iana.HWTypeEthernet,
+	LinkLayerAddr: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55},
+}
+
+// v6Message returns a DHCPv6 message of msgType from or to testDUID
+// carrying options.
+func v6Message(t *testing.T, msgType dhcpv6.MessageType, options ...dhcpv6.Option) *dhcpv6.Message {
+	t.Helper()
+	msg, err := dhcpv6.NewMessage(dhcpv6.WithClientID(testDUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.MessageType = msgType
+	for _, opt := range options {
+		msg.AddOption(opt)
+	}
+	return msg
+}
+
+// relayed returns msg encapsulated in hops relays.
+func relayed(t *testing.T, msg dhcpv6.DHCPv6, hops int) dhcpv6.DHCPv6 {
+	t.Helper()
+	for i := 0; i < hops; i++ {
+		relay, err := dhcpv6.EncapsulateRelay(msg, dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::"+strconv.Itoa(i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg = relay
+	}
+	return msg
+}
+
+// v4Request returns a DHCPv4 request of msgType from testDUID's MAC,
+// built with modifiers.
+func v4Request(t *testing.T, msgType dhcpv4.MessageType, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	modifiers = append([]dhcpv4.Modifier{dhcpv4.WithMessageType(msgType), dhcpv4.WithHwAddr(testDUID.LinkLayerAddr)}, modifiers...)
+	req, err := dhcpv4.New(modifiers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// v4Reply returns a reply of msgType to req, built with modifiers.
+func v4Reply(t *testing.T, req *dhcpv4.DHCPv4, msgType dhcpv4.MessageType, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	modifiers = append([]dhcpv4.Modifier{dhcpv4.WithMessageType(msgType)}, modifiers...)
+	resp, err := dhcpv4.NewReplyFromRequest(req, modifiers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestFromArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"no args", nil, false},
+		{"silent", []string{"silent"}, false},
+		{"mtu", []string{"mtu=1400"}, false},
+		{"mtu zero", []string{"mtu=0"}, true},
+		{"mtu not a number", []string{"mtu=jumbo"}, true},
+		{"amplification_threshold", []string{"amplification_threshold=2.5"}, false},
+		{"amplification_threshold negative", []string{"amplification_threshold=-1"}, true},
+		{"max_ias zero", []string{"max_ias=0"}, true},
+		{"nak_loop_threshold zero", []string{"nak_loop_threshold=0"}, true},
+		{"dedup_logs", []string{"dedup_logs=1m"}, false},
+		{"dedup_logs zero", []string{"dedup_logs=0s"}, true},
+		{"ia_sample", []string{"ia_sample=1/10"}, false},
+		{"ia_sample invalid", []string{"ia_sample=10"}, true},
+		{"track_iaid_hist", []string{"track_iaid_hist"}, false},
+		{"track_iaid_hist invalid", []string{"track_iaid_hist=sometimes"}, true},
+		{"profile_match invalid", []string{"profile_match=voice"}, true},
+		{"iface_map invalid", []string{"iface_map=10.0.0.0/8"}, true},
+		{"heartbeat negative", []string{"heartbeat=-1s"}, true},
+		{"sample without record_dir", []string{"sample=1/10"}, true},
+		{"label_case invalid", []string{"label_case=title"}, true},
+		{"unknown bucket histogram", []string{"buckets_dhcp_no_such_histogram=1"}, true},
+		{"invalid buckets", []string{"buckets_dhcp_amplification_factor=2,1"}, true},
+		{"requeststats histogram", []string{"buckets_dhcp_request_option_count=1,4,16,64"}, true},
+		// configs written before we took arguments may pass others
+		{"unknown argument", []string{"no_such_argument=1", "bare"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state PluginState
+			if err := state.FromArgs(tt.args...); (err != nil) != tt.wantErr {
+				t.Errorf("FromArgs(%q) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		config  string
+		inline  []string
+		wantErr bool
+	}{
+		{"known keys", `{"max_ias": 8}`, nil, false},
+		{"unknown key in file", `{"max_ias": 8, "colour": "blue"}`, nil, true},
+		{"unknown inline arg", `{"max_ias": 8}`, []string{"colour=blue"}, false},
+	}
+	for idx, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("config%d.json", idx))
+		if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var state PluginState
+		err := state.FromArgs(append([]string{"config=" + path}, tt.inline...)...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: FromArgs error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWireBytes(t *testing.T) {
+	req := v6Message(t, dhcpv6.MessageTypeRequest)
+	resp := v6Message(t, dhcpv6.MessageTypeReply)
+	// each Relay-Reply adds its header and a Relay Message option header
+	const perHop = 34 + 4
+	for _, hops := range []int{0, 1, 3} {
+		if got, want := len(wireBytes(relayed(t, req, hops), resp)), len(resp.ToBytes())+hops*perHop; got != want {
+			t.Errorf("wireBytes through %d relays is %d bytes, want %d", hops, got, want)
+		}
+	}
+}
+
+func TestExceedsMTU6(t *testing.T) {
+	req := v6Message(t, dhcpv6.MessageTypeRequest)
+	resp := v6Message(t, dhcpv6.MessageTypeReply)
+	// exactly the size of the unencapsulated response
+	mtu := len(resp.ToBytes()) + headers6
+	state, _, _ := newTestState(t, "mtu="+strconv.Itoa(mtu))
+	tests := []struct {
+		hops int
+		want float64
+	}{
+		{0, 0},
+		{1, 1},
+	}
+	for _, tt := range tests {
+		got := statsutil.Delta(func() {
+			state.Handler6(relayed(t, req, tt.hops), resp)
+		})["dhcpv6_response_exceeds_mtu_total"]
+		if got != tt.want {
+			t.Errorf("through %d relays, counted %v responses exceeding the MTU, want %v", tt.hops, got, tt.want)
+		}
+	}
+}
+
+// testIANA returns an IA_NA with iaid holding addrs, each valid for an hour.
+func testIANA(iaid byte, addrs ...string) *dhcpv6.OptIANA {
+	iana := &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, iaid}}
+	for _, addr := range addrs {
+		iana.Options.Add(&dhcpv6.OptIAAddress{
+			IPv6Addr:          net.ParseIP(addr),
+			PreferredLifetime: time.Hour,
+			ValidLifetime:     time.Hour,
+		})
+	}
+	return iana
+}
+
+func TestRenewAddressChanged(t *testing.T) {
+	state, _, _ := newTestState(t)
+	tests := []struct {
+		name    string
+		reqias  []dhcpv6.Option
+		respias []dhcpv6.Option
+		want    float64
+	}{
+		{"kept", []dhcpv6.Option{testIANA(1, "2001:db8::10")}, []dhcpv6.Option{testIANA(1, "2001:db8::10")}, 0},
+		{"changed", []dhcpv6.Option{testIANA(1, "2001:db8::10")}, []dhcpv6.Option{testIANA(1, "2001:db8::20")}, 1},
+		{"nothing held", []dhcpv6.Option{testIANA(1)}, []dhcpv6.Option{testIANA(1, "2001:db8::20")}, 0},
+		// ia_fixup adds the IA_NA the response is missing, which we must
+		// still be able to read back
+		{"denied", []dhcpv6.Option{testIANA(1, "2001:db8::10")}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := v6Message(t, dhcpv6.MessageTypeRenew, tt.reqias...)
+			resp := v6Message(t, dhcpv6.MessageTypeReply, tt.respias...)
+			if got := statsutil.Delta(func() { state.Handler6(req, resp) })["dhcpv6_address_changed_on_renew_total"]; got != tt.want {
+				t.Errorf("address changes increased by %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIAFixupAddsDHCPv6Options(t *testing.T) {
+	var resp dhcpv6.DHCPv6 = v6Message(t, dhcpv6.MessageTypeReply)
+	reqias := FromIANA([]*dhcpv6.OptIANA{testIANA(1), testIANA(2)})
+	if result := ia_fixup(&resp, reqias, noIAs); result.Added != 2 {
+		t.Fatalf("ia_fixup added %d IAs, want 2", result.Added)
+	}
+	msg := resp.(*dhcpv6.Message)
+	// IANA() panics on an option that isn't a *dhcpv6.OptIANA
+	if got := len(msg.Options.IANA()); got != 2 {
+		t.Errorf("response has %d IA_NAs, want 2", got)
+	}
+	if got := len(statusCodes(msg.Options.Options)); got != 2 {
+		t.Errorf("response has %d status codes, want 2", got)
+	}
+}
+
+func TestRenewRebindOutcomes(t *testing.T) {
+	state, _, _ := newTestState(t)
+	tests := []struct {
+		name    string
+		kind    dhcpv6.MessageType
+		reqias  []dhcpv6.Option
+		respias []dhcpv6.Option
+		want    string
+	}{
+		{"renew retained", dhcpv6.MessageTypeRenew, []dhcpv6.Option{testIANA(1, "2001:db8::10")}, []dhcpv6.Option{testIANA(1, "2001:db8::10")}, "renew,retained"},
+		{"renew denied", dhcpv6.MessageTypeRenew, []dhcpv6.Option{testIANA(1, "2001:db8::10")}, nil, "renew,denied"},
+		{"rebind partly denied", dhcpv6.MessageTypeRebind, []dhcpv6.Option{testIANA(1), testIANA(2)}, []dhcpv6.Option{testIANA(1, "2001:db8::10")}, "rebind,denied"},
+		// there is nothing to retain or deny
+		{"renew without IAs", dhcpv6.MessageTypeRenew, nil, nil, "renew,no_ia"},
+		{"rebind without IAs", dhcpv6.MessageTypeRebind, nil, nil, "rebind,no_ia"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, outcome, _ := strings.Cut(tt.want, ",")
+			key := `dhcpv6_renew_rebind_outcomes_total{kind="` + kind + `",outcome="` + outcome + `"}`
+			req := v6Message(t, tt.kind, tt.reqias...)
+			resp := v6Message(t, dhcpv6.MessageTypeReply, tt.respias...)
+			if got := statsutil.Delta(func() { state.Handler6(req, resp) })[key]; got != 1 {
+				t.Errorf("%s increased by %v, want 1", key, got)
+			}
+		})
+	}
+}
+
+func TestParseProfiles(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []Profile
+		wantErr bool
+	}{
+		{in: "voice:option176", want: []Profile{{"voice", []dhcpv4.OptionCode{dhcpv4.GenericOptionCode(176)}}}},
+		{in: "voice:option176,data:option252+option43", want: []Profile{
+			{"voice", []dhcpv4.OptionCode{dhcpv4.GenericOptionCode(176)}},
+			{"data", []dhcpv4.OptionCode{dhcpv4.GenericOptionCode(252), dhcpv4.GenericOptionCode(43)}},
+		}},
+		{in: "voice", wantErr: true},
+		{in: ":option176", wantErr: true},
+		{in: "voice:option256", wantErr: true},
+		{in: "voice:optionX", wantErr: true},
+		{in: "voice:option176+", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProfiles(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseProfiles(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseProfiles(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyProfile(t *testing.T) {
+	profiles, err := parseProfiles("voice:option176,data:option252+option43")
+	if err != nil {
+		t.Fatal(err)
+	}
+	option := func(code uint8) dhcpv4.Modifier {
+		return dhcpv4.WithGeneric(dhcpv4.GenericOptionCode(code), []byte{1})
+	}
+	tests := []struct {
+		name      string
+		modifiers []dhcpv4.Modifier
+		want      string
+	}{
+		{"voice", []dhcpv4.Modifier{option(176)}, "voice"},
+		{"data", []dhcpv4.Modifier{option(43), option(252)}, "data"},
+		{"first match wins", []dhcpv4.Modifier{option(43), option(252), option(176)}, "voice"},
+		{"partial signature", []dhcpv4.Modifier{option(252)}, "unclassified"},
+		{"none", nil, "unclassified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := dhcpv4.New(tt.modifiers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := classifyProfile(profiles, resp); got != tt.want {
+				t.Errorf("classifyProfile = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmplificationFactor(t *testing.T) {
+	tests := []struct {
+		req, resp int
+		want      float64
+	}{
+		{100, 300, 3},
+		{300, 100, 1.0 / 3},
+		{100, 0, 0},
+		{0, 300, 0},
+	}
+	for _, tt := range tests {
+		if got := amplificationFactor(make([]byte, tt.req), make([]byte, tt.resp)); got != tt.want {
+			t.Errorf("amplificationFactor(%d, %d) = %v, want %v", tt.req, tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestNAKSeen(t *testing.T) {
+	state, clock, _ := newTestState(t, "nak_loop_threshold=3")
+	steps := []struct {
+		advance time.Duration
+		mac     string
+		nak     bool
+		want    bool
+	}{
+		{0, "00:11:22:33:44:55", true, false},
+		{time.Second, "00:11:22:33:44:55", true, false},
+		{time.Second, "00:11:22:33:44:66", true, false},
+		{time.Second, "00:11:22:33:44:55", true, true},
+		// reported once per run
+		{time.Second, "00:11:22:33:44:55", true, false},
+		// an ACK ends the run
+		{time.Second, "00:11:22:33:44:66", false, false},
+		{time.Second, "00:11:22:33:44:66", true, false},
+		{time.Second, "00:11:22:33:44:66", true, false},
+		// as does a quiet spell
+		{nakWindow + time.Second, "00:11:22:33:44:66", true, false},
+		{time.Second, "00:11:22:33:44:66", true, false},
+		{time.Second, "00:11:22:33:44:66", true, true},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if got := state.nakSeen(step.mac, step.nak); got != step.want {
+			t.Errorf("step %d: nakSeen(%s, %v) = %v, want %v", i, step.mac, step.nak, got, step.want)
+		}
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	relay := dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1))
+	ciaddr := dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 10))
+	tests := []struct {
+		name string
+		req  []dhcpv4.Modifier
+		resp dhcpv4.MessageType
+		want string
+	}{
+		{"relayed", []dhcpv4.Modifier{relay, dhcpv4.WithBroadcast(true)}, dhcpv4.MessageTypeAck, "relay"},
+		{"relayed NAK", []dhcpv4.Modifier{relay}, dhcpv4.MessageTypeNak, "relay"},
+		{"NAK", []dhcpv4.Modifier{ciaddr}, dhcpv4.MessageTypeNak, "broadcast"},
+		{"renewing", []dhcpv4.Modifier{ciaddr, dhcpv4.WithBroadcast(true)}, dhcpv4.MessageTypeAck, "unicast"},
+		{"broadcast flag", []dhcpv4.Modifier{dhcpv4.WithBroadcast(true)}, dhcpv4.MessageTypeOffer, "broadcast"},
+		{"no broadcast flag", nil, dhcpv4.MessageTypeOffer, "unicast"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := dhcpv4.New(tt.req...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(tt.resp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := delivery(req, resp); got != tt.want {
+				t.Errorf("delivery = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIAFixup(t *testing.T) {
+	tests := []struct {
+		name    string
+		reqias  []*dhcpv6.OptIANA
+		respias []*dhcpv6.OptIANA
+		want    FixupResult
+	}{
+		{"all", []*dhcpv6.OptIANA{testIANA(1), testIANA(2)},
+			[]*dhcpv6.OptIANA{testIANA(2, "2001:db8::2"), testIANA(1, "2001:db8::1")},
+			FixupResult{Satisfied: 2, Quantifier: "all"}},
+		{"some", []*dhcpv6.OptIANA{testIANA(1), testIANA(2)},
+			[]*dhcpv6.OptIANA{testIANA(1, "2001:db8::1"), testIANA(2)},
+			FixupResult{Satisfied: 1, Unsatisfied: 1, Quantifier: "some"}},
+		{"missing", []*dhcpv6.OptIANA{testIANA(1), testIANA(2)},
+			[]*dhcpv6.OptIANA{testIANA(1, "2001:db8::1")},
+			FixupResult{Satisfied: 1, Unsatisfied: 1, Added: 1, Quantifier: "some"}},
+		{"none", []*dhcpv6.OptIANA{testIANA(1)}, nil,
+			FixupResult{Unsatisfied: 1, Added: 1, Quantifier: "none"}},
+		// the first response IA with an IAID is the one that counts
+		{"duplicate IAID", []*dhcpv6.OptIANA{testIANA(1)},
+			[]*dhcpv6.OptIANA{testIANA(1), testIANA(1, "2001:db8::1")},
+			FixupResult{Unsatisfied: 1, Quantifier: "none"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp dhcpv6.DHCPv6 = v6Message(t, dhcpv6.MessageTypeReply)
+			if got := ia_fixup(&resp, FromIANA(tt.reqias), FromIANA(tt.respias)); got != tt.want {
+				t.Errorf("ia_fixup = %+v, want %+v", got, tt.want)
+			}
+			if got := len(resp.(*dhcpv6.Message).Options.IANA()); got != tt.want.Added {
+				t.Errorf("response has %d IA_NAs added, want %d", got, tt.want.Added)
+			}
+		})
+	}
+}
+
+// benchmarkIAs returns n IA_NAs with distinct IAIDs, allocated if addr.
+func benchmarkIAs(n int, addr bool) []*dhcpv6.OptIANA {
+	ias := make([]*dhcpv6.OptIANA, n)
+	for i := range ias {
+		ias[i] = &dhcpv6.OptIANA{IaId: [4]byte{0, 0, byte(i >> 8), byte(i)}}
+		if addr {
+			ias[i].Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("2001:db8::1"), ValidLifetime: time.Hour})
+		}
+	}
+	return ias
+}
+
+func BenchmarkIAFixup(b *testing.B) {
+	for _, n := range []int{1, 16, 256, 1024} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			reqias := FromIANA(benchmarkIAs(n, false))
+			respias := benchmarkIAs(n, true)
+			// match the response IAs in reverse, the worst case for a scan
+			for i, j := 0, len(respias)-1; i < j; i, j = i+1, j-1 {
+				respias[i], respias[j] = respias[j], respias[i]
+			}
+			converted := FromIANA(respias)
+			var resp dhcpv6.DHCPv6 = &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ia_fixup(&resp, reqias, converted)
+			}
+		})
+	}
+}
+
+func TestSingleIAFixup(t *testing.T) {
+	tests := []struct {
+		name   string
+		respia *dhcpv6.OptIANA
+		want   FixupResult
+	}{
+		{"allocated", testIANA(1, "2001:db8::1"), FixupResult{Satisfied: 1, Quantifier: "all"}},
+		{"not allocated", testIANA(1), FixupResult{Unsatisfied: 1, Quantifier: "none"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := singleIAFixup((*OptIANA)(tt.respia))
+			if got != tt.want {
+				t.Errorf("singleIAFixup = %+v, want %+v", got, tt.want)
+			}
+			// the fast path must agree with the general one
+			var resp dhcpv6.DHCPv6 = v6Message(t, dhcpv6.MessageTypeReply)
+			reqias := FromIANA([]*dhcpv6.OptIANA{testIANA(1)})
+			if general := ia_fixup(&resp, reqias, FromIANA([]*dhcpv6.OptIANA{tt.respia})); general != got {
+				t.Errorf("ia_fixup = %+v, but singleIAFixup = %+v", general, got)
+			}
+		})
+	}
+}
+
+func BenchmarkSingleIA(b *testing.B) {
+	reqias := FromIANA(benchmarkIAs(1, false))
+	respias := FromIANA(benchmarkIAs(1, true))
+	b.Run("ia_fixup", func(b *testing.B) {
+		var resp dhcpv6.DHCPv6 = &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ia_fixup(&resp, reqias, respias)
+		}
+	})
+	b.Run("singleIAFixup", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			singleIAFixup(respias[0])
+		}
+	})
+}
+
+func TestFromIAs(t *testing.T) {
+	ianas := benchmarkIAs(3, false)
+	tests := []struct {
+		name string
+		got  []IdentityAssociation
+		want int
+	}{
+		{"IA_NA", FromIANA(ianas), 3},
+		{"no IA_NA", FromIANA(nil), 0},
+		{"IA_TA", FromIATA([]*dhcpv6.OptIATA{{IaId: [4]byte{1}}}), 1},
+		{"no IA_TA", FromIATA(nil), 0},
+		{"IA_PD", FromIAPD([]*dhcpv6.OptIAPD{{IaId: [4]byte{1}}, {IaId: [4]byte{2}}}), 2},
+		{"no IA_PD", FromIAPD([]*dhcpv6.OptIAPD{}), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.got) != tt.want {
+				t.Errorf("converted %d IAs, want %d", len(tt.got), tt.want)
+			}
+		})
+	}
+	converted := FromIANA(ianas)
+	for i, ia := range converted {
+		if ia.Option() != dhcpv6.Option(ianas[i]) {
+			t.Errorf("IA %d doesn't wrap the original option", i)
+		}
+	}
+	// most requests carry no IA_TA or IA_PD
+	allocs := testing.AllocsPerRun(100, func() {
+		FromIANA(nil)
+		FromIATA(nil)
+		FromIAPD(nil)
+	})
+	if allocs != 0 {
+		t.Errorf("converting no IAs allocated %v times, want 0", allocs)
+	}
+}
+
+func BenchmarkFromIANA(b *testing.B) {
+	for _, n := range []int{0, 1, 4} {
+		ianas := benchmarkIAs(n, false)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				FromIANA(ianas)
+			}
+		})
+	}
+}
+
+func TestLifecycleResponses(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tests := []struct {
+		name          string
+		reqType       dhcpv4.MessageType
+		wantLifecycle string
+		wantLogged    bool
+	}{
+		{"request", dhcpv4.MessageTypeRequest, "", true},
+		{"decline", dhcpv4.MessageTypeDecline, "decline", false},
+		{"release", dhcpv4.MessageTypeRelease, "release", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, _, lines := newTestState(t)
+			req, err := dhcpv4.New(dhcpv4.WithMessageType(tt.reqType), dhcpv4.WithHwAddr(mac))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := dhcpv4.NewReplyFromRequest(req,
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeAck), dhcpv4.WithYourIP(net.IPv4(192, 0, 2, 10)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lifecycleKey := `dhcpv4_lifecycle_responses_total{kind="` + tt.wantLifecycle + `"}`
+			typesKey := `dhcpv4_responses_total{type="ACK"}`
+			before := state.Snapshot()
+			state.Handler4(req, resp)
+			after := state.Snapshot()
+			if tt.wantLifecycle != "" && after[lifecycleKey]-before[lifecycleKey] != 1 {
+				t.Errorf("%s didn't increase", lifecycleKey)
+			}
+			// the rest of the response is still counted
+			if got := after[typesKey] - before[typesKey]; got != 1 {
+				t.Errorf("%s increased by %v, want 1", typesKey, got)
+			}
+			if logged := len(*lines) > 0; logged != tt.wantLogged {
+				t.Errorf("logged %q, want allocation logged %v", *lines, tt.wantLogged)
+			}
+		})
+	}
+}
+
+func TestPrefixesDelegated(t *testing.T) {
+	state, clock, _ := newTestState(t)
+	gauge := func(intf string) (float64, bool) {
+		value, ok := state.Snapshot()[`dhcpv6_distinct_delegated_prefixes{interface="`+intf+`"}`]
+		return value, ok
+	}
+	state.prefixesDelegated("eth0", []string{"2001:db8:1::/56", "2001:db8:2::/56"})
+	clock.Advance(12 * time.Hour)
+	state.prefixesDelegated("eth0", []string{"2001:db8:1::/56"})
+	state.prefixesDelegated("eth1", []string{"2001:db8:3::/56"})
+	steps := []struct {
+		advance time.Duration
+		want    map[string]float64
+	}{
+		{0, map[string]float64{"eth0": 2, "eth1": 1}},
+		// 2001:db8:2::/56 was delegated more than a day ago
+		{13 * time.Hour, map[string]float64{"eth0": 1, "eth1": 1}},
+		// neither interface has delegated for a day, so both go
+		{12 * time.Hour, map[string]float64{}},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		state.prunePrefixes()
+		for _, intf := range []string{"eth0", "eth1"} {
+			want, wantOK := step.want[intf]
+			if got, ok := gauge(intf); got != want || ok != wantOK {
+				t.Errorf("step %d: %s gauge = %v (exported %v), want %v (exported %v)", i, intf, got, ok, want, wantOK)
+			}
+			if _, ok := state.delegated[intf]; ok != wantOK {
+				t.Errorf("step %d: %s tracked %v, want %v", i, intf, ok, wantOK)
+			}
+		}
+	}
+	// an interface we forgot starts afresh
+	state.prefixesDelegated("eth0", []string{"2001:db8:1::/56"})
+	if got, _ := gauge("eth0"); got != 1 {
+		t.Errorf("eth0 gauge = %v after delegating again, want 1", got)
+	}
+}
+
+func TestDelegatedPrefixesByInterface(t *testing.T) {
+	state, _, _ := newTestState(t)
+	req := v6Message(t, dhcpv6.MessageTypeRequest, &dhcpv6.OptIAPD{IaId: [4]byte{1}})
+	relay, err := dhcpv6.EncapsulateRelay(req, dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.Options.Add(dhcpv6.OptInterfaceID([]byte("pd-test-port")))
+	iapd := &dhcpv6.OptIAPD{IaId: [4]byte{1}}
+	iapd.Options.Add(&dhcpv6.OptIAPrefix{Prefix: &net.IPNet{IP: net.ParseIP("2001:db8:4::"), Mask: net.CIDRMask(56, 128)}, ValidLifetime: time.Hour})
+	// a withdrawn prefix isn't delegated
+	iapd.Options.Add(&dhcpv6.OptIAPrefix{Prefix: &net.IPNet{IP: net.ParseIP("2001:db8:5::"), Mask: net.CIDRMask(56, 128)}})
+	resp := v6Message(t, dhcpv6.MessageTypeReply, iapd)
+	state.Handler6(relay, resp)
+	key := `dhcpv6_distinct_delegated_prefixes{interface="pd-test-port"}`
+	if got := state.Snapshot()[key]; got != 1 {
+		t.Errorf("%s = %v, want 1", key, got)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	state, _, _ := newTestState(t)
+	req := v6Message(t, dhcpv6.MessageTypeRequest, testIANA(1))
+	resp := v6Message(t, dhcpv6.MessageTypeReply, testIANA(1, "2001:db8::1"))
+	before := state.Snapshot()
+	state.Handler6(req, resp)
+	after := state.Snapshot()
+	tests := []struct {
+		key  string
+		want float64
+	}{
+		{`dhcp_responses_handled_total{family="v6",outcome="ok"}`, 1},
+		{`dhcpv6_ias_processed_total{result="all",type="IA_NA"}`, 1},
+		// histograms appear as their count
+		{`dhcp_amplification_factor_count{family="v6"}`, 1},
+		{`dhcpv6_ia_fixup_duration_seconds_count{type="IA_NA"}`, 1},
+	}
+	for _, tt := range tests {
+		if _, ok := after[tt.key]; !ok {
+			t.Errorf("snapshot is missing %s", tt.key)
+			continue
+		}
+		if got := after[tt.key] - before[tt.key]; got != tt.want {
+			t.Errorf("%s increased by %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParseIfaceMap(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "10.99.0.0/16:eth1", want: []string{"10.99.0.0/16:eth1"}},
+		{in: "10.99.0.0/16:eth1,2001:db8::/32:eth2", want: []string{"10.99.0.0/16:eth1", "2001:db8::/32:eth2"}},
+		{in: "10.99.0.0/16", wantErr: true},
+		{in: "10.99.0.0/16:", wantErr: true},
+		{in: "10.99.0.0:eth1", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		rules, err := parseIfaceMap(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseIfaceMap(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, rule := range rules {
+			got = append(got, rule.Subnet.String()+":"+rule.Iface)
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIfaceMap(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEgressIface(t *testing.T) {
+	rules, err := parseIfaceMap("10.99.0.0/16:eth1,10.0.0.0/8:eth0,2001:db8::/32:eth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		relay net.IP
+		want  string
+	}{
+		{net.ParseIP("10.99.1.1"), "eth1"},
+		{net.ParseIP("10.1.1.1"), "eth0"},
+		{net.ParseIP("2001:db8::1"), "eth2"},
+		{net.ParseIP("192.0.2.1"), "unknown"},
+		{net.IPv4zero, "unknown"},
+		{nil, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := egressIface(rules, tt.relay); got != tt.want {
+			t.Errorf("egressIface(%v) = %q, want %q", tt.relay, got, tt.want)
+		}
+	}
+}
+
+func TestRelayPeerAddr(t *testing.T) {
+	msg := v6Message(t, dhcpv6.MessageTypeSolicit)
+	if got := relayPeerAddr(msg); got != nil {
+		t.Errorf("relayPeerAddr of an unrelayed request = %v, want nil", got)
+	}
+	// our response goes back through the outermost relay
+	if got, want := relayPeerAddr(relayed(t, msg, 3)), net.ParseIP("fe80::3"); !got.Equal(want) {
+		t.Errorf("relayPeerAddr = %v, want %v", got, want)
+	}
+}
+
+func TestClientClass(t *testing.T) {
+	vendor := dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient"))
+	tests := []struct {
+		name      string
+		modifiers []dhcpv4.Modifier
+		want      string
+	}{
+		{"user class", []dhcpv4.Modifier{dhcpv4.WithUserClass("voip", true), vendor}, "voip"},
+		{"vendor class", []dhcpv4.Modifier{vendor}, "PXEClient"},
+		{"binary vendor class", []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClassIdentifier("a\x00b"))}, "610062"},
+		{"none", nil, "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := dhcpv4.New(tt.modifiers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := clientClass(req); got != tt.want {
+				t.Errorf("clientClass = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelCase(t *testing.T) {
+	discover, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := dhcpv4.NewReplyFromRequest(discover, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		labelCase string
+		v4, v6    string
+		notV6     string
+	}{
+		{"lower", "offer", "reply", "REPLY"},
+		{"preserve", "OFFER", "REPLY", "reply"},
+	}
+	for _, tt := range tests {
+		state, _, _ := newTestState(t, "label_case="+tt.labelCase)
+		delta := statsutil.Delta(func() {
+			state.Handler4(discover, offer)
+			state.Handler6(v6Message(t, dhcpv6.MessageTypeRequest), v6Message(t, dhcpv6.MessageTypeReply))
+		})
+		if got := delta[`dhcpv4_responses_total{type="`+tt.v4+`"}`]; got != 1 {
+			t.Errorf("label_case=%s: v4 type %s increased by %v, want 1", tt.labelCase, tt.v4, got)
+		}
+		if got := delta[`dhcpv6_responses_total{type="`+tt.v6+`"}`]; got != 1 {
+			t.Errorf("label_case=%s: v6 type %s increased by %v, want 1", tt.labelCase, tt.v6, got)
+		}
+		if got := delta[`dhcpv6_responses_total{type="`+tt.notV6+`"}`]; got != 0 {
+			t.Errorf("label_case=%s: v6 type %s increased by %v, want 0", tt.labelCase, tt.notV6, got)
+		}
+	}
+}
+
+func TestMaxIAs(t *testing.T) {
+	state, _, _ := newTestState(t, "max_ias=2")
+	tests := []struct {
+		name     string
+		ias      []dhcpv6.Option
+		wantDrop bool
+	}{
+		{"under the limit", []dhcpv6.Option{testIANA(1)}, false},
+		{"at the limit", []dhcpv6.Option{testIANA(1), &dhcpv6.OptIAPD{IaId: [4]byte{2}}}, false},
+		{"over the limit", []dhcpv6.Option{testIANA(1), testIANA(2), &dhcpv6.OptIAPD{IaId: [4]byte{3}}}, true},
+	}
+	for _, tt := range tests {
+		req := v6Message(t, dhcpv6.MessageTypeRequest, tt.ias...)
+		resp := v6Message(t, dhcpv6.MessageTypeReply)
+		var got dhcpv6.DHCPv6
+		var stop bool
+		delta := statsutil.Delta(func() { got, stop = state.Handler6(req, resp) })
+		if stop != tt.wantDrop || (got == nil) != tt.wantDrop {
+			t.Errorf("%s: Handler6 = %v, %v, want dropped %v", tt.name, got, stop, tt.wantDrop)
+		}
+		wantDropped, wantOK := 0.0, 1.0
+		if tt.wantDrop {
+			wantDropped, wantOK = 1, 0
+		}
+		if got := delta["dhcpv6_excessive_ias_total"]; got != wantDropped {
+			t.Errorf("%s: excessive IAs increased by %v, want %v", tt.name, got, wantDropped)
+		}
+		if got := delta[`dhcp_responses_handled_total{family="v6",outcome="dropped"}`]; got != wantDropped {
+			t.Errorf("%s: dropped outcomes increased by %v, want %v", tt.name, got, wantDropped)
+		}
+		if got := delta[`dhcp_responses_handled_total{family="v6",outcome="ok"}`]; got != wantOK {
+			t.Errorf("%s: ok outcomes increased by %v, want %v", tt.name, got, wantOK)
+		}
+	}
+}
+
+func TestHandledOutcomes(t *testing.T) {
+	state, _, _ := newTestState(t)
+	discover, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := dhcpv4.NewReplyFromRequest(discover, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notRequest, err := dhcpv4.NewReplyFromRequest(discover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		handle  func()
+		family  string
+		outcome string
+	}{
+		{"v4 offer", func() { state.Handler4(discover, offer) }, "v4", "ok"},
+		{"v4 nil response", func() { state.Handler4(discover, nil) }, "v4", "error"},
+		{"v4 response not a BootReply", func() { state.Handler4(discover, discover) }, "v4", "error"},
+		{"v4 request not a BootRequest", func() { state.Handler4(notRequest, offer) }, "v4", "error"},
+		{"v6 reply", func() {
+			state.Handler6(v6Message(t, dhcpv6.MessageTypeRequest), v6Message(t, dhcpv6.MessageTypeReply))
+		}, "v6", "ok"},
+		{"v6 nil response", func() { state.Handler6(v6Message(t, dhcpv6.MessageTypeRequest), nil) }, "v6", "error"},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(tt.handle)
+		for _, outcome := range []string{"ok", "error", "dropped"} {
+			want := 0.0
+			if outcome == tt.outcome {
+				want = 1
+			}
+			key := `dhcp_responses_handled_total{family="` + tt.family + `",outcome="` + outcome + `"}`
+			if got := delta[key]; got != want {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestStaticRoutes(t *testing.T) {
+	state, _, _ := newTestState(t)
+	_, dest, _ := net.ParseCIDR("198.51.100.0/24")
+	routes := dhcpv4.OptClasslessStaticRoute(
+		&dhcpv4.Route{Dest: dest, Router: net.IPv4(192, 0, 2, 1)},
+		&dhcpv4.Route{Dest: &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, Router: net.IPv4(192, 0, 2, 1)},
+	)
+	// we only count the classless routes of option 121, not option 33's
+	classful := dhcpv4.OptGeneric(dhcpv4.OptionStaticRoutingTable, []byte{198, 51, 100, 0, 192, 0, 2, 1})
+	tests := []struct {
+		name       string
+		respType   dhcpv4.MessageType
+		opts       []dhcpv4.Option
+		wantResps  float64
+		wantRoutes float64
+	}{
+		{"no routes", dhcpv4.MessageTypeAck, nil, 0, 0},
+		{"classless routes", dhcpv4.MessageTypeAck, []dhcpv4.Option{routes}, 1, 2},
+		{"classful routes", dhcpv4.MessageTypeAck, []dhcpv4.Option{classful}, 0, 0},
+		{"unparseable routes", dhcpv4.MessageTypeAck, []dhcpv4.Option{dhcpv4.OptGeneric(dhcpv4.OptionClasslessStaticRoute, []byte{33})}, 1, 0},
+		{"routes in an offer", dhcpv4.MessageTypeOffer, []dhcpv4.Option{routes}, 0, 0},
+	}
+	for _, tt := range tests {
+		req := v4Request(t, dhcpv4.MessageTypeRequest)
+		var mods []dhcpv4.Modifier
+		for _, opt := range tt.opts {
+			mods = append(mods, dhcpv4.WithOption(opt))
+		}
+		resp := v4Reply(t, req, tt.respType, mods...)
+		delta := statsutil.Delta(func() { state.Handler4(req, resp) })
+		if got := delta["dhcpv4_responses_with_static_routes_total"]; got != tt.wantResps {
+			t.Errorf("%s: responses with static routes increased by %v, want %v", tt.name, got, tt.wantResps)
+		}
+		if got := delta["dhcpv4_static_routes_sent_total"]; got != tt.wantRoutes {
+			t.Errorf("%s: static routes sent increased by %v, want %v", tt.name, got, tt.wantRoutes)
+		}
+	}
+}
+
+func TestStatusCodesSent(t *testing.T) {
+	state, _, _ := newTestState(t)
+	unavailable := testIANA(2)
+	unavailable.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoAddrsAvail})
+	tests := []struct {
+		name string
+		req  []dhcpv6.Option
+		resp []dhcpv6.Option
+		want map[string]float64
+	}{
+		{"none", []dhcpv6.Option{testIANA(1)}, []dhcpv6.Option{testIANA(1, "2001:db8::1")}, map[string]float64{}},
+		{"top level", nil, []dhcpv6.Option{&dhcpv6.OptStatusCode{StatusCode: iana.StatusUseMulticast}},
+			map[string]float64{"UseMulticast": 1}},
+		{"inside an IA", []dhcpv6.Option{testIANA(2)}, []dhcpv6.Option{unavailable}, map[string]float64{"NoAddrsAvail": 1}},
+		// ia_fixup adds a status code for each IA the server left out
+		{"added by ia_fixup", []dhcpv6.Option{testIANA(1), testIANA(3)}, []dhcpv6.Option{testIANA(1, "2001:db8::1")},
+			map[string]float64{"NoAddrsAvail": 1}},
+	}
+	for _, tt := range tests {
+		req := v6Message(t, dhcpv6.MessageTypeRequest, tt.req...)
+		resp := v6Message(t, dhcpv6.MessageTypeReply, tt.resp...)
+		delta := statsutil.Delta(func() { state.Handler6(req, resp) })
+		for _, code := range []string{"UseMulticast", "NoAddrsAvail", "Success"} {
+			key := `dhcpv6_status_codes_sent_total{code="` + code + `"}`
+			if got := delta[key]; got != tt.want[code] {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, tt.want[code])
+			}
+		}
+	}
+}
+
+func TestMissingServerID(t *testing.T) {
+	state, _, _ := newTestState(t)
+	serverID := dhcpv6.WithServerID(dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}})
+	tests := []struct {
+		name     string
+		respType dhcpv6.MessageType
+		serverID bool
+		want     float64
+	}{
+		{"reply with server ID", dhcpv6.MessageTypeReply, true, 0},
+		{"reply without server ID", dhcpv6.MessageTypeReply, false, 1},
+		{"advertise without server ID", dhcpv6.MessageTypeAdvertise, false, 1},
+		// only ADVERTISE and REPLY need one
+		{"reconfigure without server ID", dhcpv6.MessageTypeReconfigure, false, 0},
+	}
+	for _, tt := range tests {
+		resp := v6Message(t, tt.respType)
+		if tt.serverID {
+			serverID(resp)
+		}
+		delta := statsutil.Delta(func() { state.Handler6(v6Message(t, dhcpv6.MessageTypeRequest), resp) })
+		if got := delta["dhcpv6_response_missing_serverid_total"]; got != tt.want {
+			t.Errorf("%s: missing server IDs increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidLifetime(t *testing.T) {
+	state, _, _ := newTestState(t)
+	inverted := &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, 1}}
+	inverted.Options.Add(&dhcpv6.OptIAAddress{
+		IPv6Addr:          net.ParseIP("2001:db8::1"),
+		PreferredLifetime: 2 * time.Hour,
+		ValidLifetime:     time.Hour,
+	})
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/56")
+	invertedPD := &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 2}}
+	invertedPD.Options.Add(&dhcpv6.OptIAPrefix{
+		PreferredLifetime: time.Hour,
+		ValidLifetime:     time.Minute,
+		Prefix:            prefix,
+	})
+	tests := []struct {
+		name   string
+		ia     dhcpv6.Option
+		iaType string
+		want   float64
+	}{
+		{"valid address", testIANA(1, "2001:db8::1"), dhcpv6.OptionIANA.String(), 0},
+		{"inverted address", inverted, dhcpv6.OptionIANA.String(), 1},
+		{"inverted prefix", invertedPD, dhcpv6.OptionIAPD.String(), 1},
+	}
+	for _, tt := range tests {
+		req := v6Message(t, dhcpv6.MessageTypeRequest)
+		resp := v6Message(t, dhcpv6.MessageTypeReply, tt.ia)
+		delta := statsutil.Delta(func() { state.Handler6(req, resp) })
+		key := `dhcpv6_invalid_lifetime_total{ia_type="` + tt.iaType + `"}`
+		if got := delta[key]; got != tt.want {
+			t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, tt.want)
+		}
+	}
+}
+
+func TestDeniedLogsDUID(t *testing.T) {
+	state, _, lines := newTestState(t)
+	relay := relayed(t, v6Message(t, dhcpv6.MessageTypeRequest, testIANA(1), testIANA(2)), 1).(*dhcpv6.RelayMessage)
+	relay.AddOption(dhcpv6.OptInterfaceID([]byte("eth0")))
+	state.Handler6(relay, v6Message(t, dhcpv6.MessageTypeReply, testIANA(1, "2001:db8::1")))
+	want := "[denied 1 IA_NA] [link=2001:db8::1 intf=eth0] DUID " + testDUID.String()
+	for _, line := range *lines {
+		if line == want {
+			return
+		}
+	}
+	t.Errorf("logged %q, want %q", *lines, want)
+}
+
+func TestOROUnsatisfied(t *testing.T) {
+	state, _, _ := newTestState(t)
+	oro := dhcpv6.OptRequestedOption(dhcpv6.OptionDNSRecursiveNameServer, dhcpv6.OptionDomainSearchList)
+	dns := dhcpv6.OptDNS(net.ParseIP("2001:db8::53"))
+	tests := []struct {
+		name       string
+		respType   dhcpv6.MessageType
+		resp       []dhcpv6.Option
+		wantDNS    float64
+		wantSearch float64
+	}{
+		{"both omitted", dhcpv6.MessageTypeReply, nil, 1, 1},
+		{"DNS sent", dhcpv6.MessageTypeReply, []dhcpv6.Option{dns}, 0, 1},
+		{"advertise", dhcpv6.MessageTypeAdvertise, []dhcpv6.Option{dns}, 0, 1},
+		// only ADVERTISE and REPLY answer an ORO
+		{"reconfigure", dhcpv6.MessageTypeReconfigure, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		req := v6Message(t, dhcpv6.MessageTypeRequest, oro)
+		resp := v6Message(t, tt.respType, tt.resp...)
+		delta := statsutil.Delta(func() { state.Handler6(req, resp) })
+		dnsKey := `dhcpv6_oro_unsatisfied_total{option="` + dhcpv6.OptionDNSRecursiveNameServer.String() + `"}`
+		if got := delta[dnsKey]; got != tt.wantDNS {
+			t.Errorf("%s: %s increased by %v, want %v", tt.name, dnsKey, got, tt.wantDNS)
+		}
+		searchKey := `dhcpv6_oro_unsatisfied_total{option="` + dhcpv6.OptionDomainSearchList.String() + `"}`
+		if got := delta[searchKey]; got != tt.wantSearch {
+			t.Errorf("%s: %s increased by %v, want %v", tt.name, searchKey, got, tt.wantSearch)
+		}
+	}
+}
+
+func TestIASuccessByInterface(t *testing.T) {
+	state, _, _ := newTestState(t)
+	tests := []struct {
+		name   string
+		intf   string
+		reqIAs []dhcpv6.Option
+		resp   []dhcpv6.Option
+		result string
+	}{
+		{"unrelayed", "", []dhcpv6.Option{testIANA(1)}, []dhcpv6.Option{testIANA(1, "2001:db8::1")}, "all"},
+		{"relayed", "eth0", []dhcpv6.Option{testIANA(1)}, []dhcpv6.Option{testIANA(1, "2001:db8::1")}, "all"},
+		{"relayed and denied", "eth0", []dhcpv6.Option{testIANA(1)}, nil, "none"},
+		{"relayed and partly denied", "eth1", []dhcpv6.Option{testIANA(1), testIANA(2)}, []dhcpv6.Option{testIANA(1, "2001:db8::1")}, "some"},
+	}
+	for _, tt := range tests {
+		var req dhcpv6.DHCPv6 = v6Message(t, dhcpv6.MessageTypeRequest, tt.reqIAs...)
+		label := "none"
+		if tt.intf != "" {
+			relay := relayed(t, req, 1).(*dhcpv6.RelayMessage)
+			relay.AddOption(dhcpv6.OptInterfaceID([]byte(tt.intf)))
+			req, label = relay, tt.intf
+		}
+		resp := v6Message(t, dhcpv6.MessageTypeReply, tt.resp...)
+		delta := statsutil.Delta(func() { state.Handler6(req, resp) })
+		key := `dhcpv6_ia_success_by_interface_total{interface="` + label + `",result="` + tt.result + `"}`
+		if got := delta[key]; got != 1 {
+			t.Errorf("%s: %s increased by %v, want 1", tt.name, key, got)
+		}
+	}
+}
+
+func TestAllocations(t *testing.T) {
+	state, _, _ := newTestState(t)
+	yiaddr := dhcpv4.WithYourIP(net.IPv4(192, 0, 2, 10))
+	tests := []struct {
+		name     string
+		req      *dhcpv4.DHCPv4
+		respType dhcpv4.MessageType
+		yiaddr   bool
+		want     string
+	}{
+		{"new lease", v4Request(t, dhcpv4.MessageTypeRequest), dhcpv4.MessageTypeAck, true, "new"},
+		{"renewal", v4Request(t, dhcpv4.MessageTypeRequest, dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 10))), dhcpv4.MessageTypeAck, true, "renewal"},
+		{"ack to inform", v4Request(t, dhcpv4.MessageTypeInform, dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 10))), dhcpv4.MessageTypeAck, false, ""},
+		{"offer", v4Request(t, dhcpv4.MessageTypeDiscover), dhcpv4.MessageTypeOffer, true, ""},
+		{"nak", v4Request(t, dhcpv4.MessageTypeRequest), dhcpv4.MessageTypeNak, false, ""},
+	}
+	for _, tt := range tests {
+		var mods []dhcpv4.Modifier
+		if tt.yiaddr {
+			mods = append(mods, yiaddr)
+		}
+		resp := v4Reply(t, tt.req, tt.respType, mods...)
+		delta := statsutil.Delta(func() { state.Handler4(tt.req, resp) })
+		for _, kind := range []string{"new", "renewal"} {
+			want := 0.0
+			if kind == tt.want {
+				want = 1
+			}
+			key := `dhcpv4_allocations_total{kind="` + kind + `"}`
+			if got := delta[key]; got != want {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestAdvertiseWithoutPreference(t *testing.T) {
+	state, _, _ := newTestState(t)
+	preference := &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionPreference, OptionData: []byte{255}}
+	tests := []struct {
+		name     string
+		respType dhcpv6.MessageType
+		opts     []dhcpv6.Option
+		want     float64
+	}{
+		{"advertise with preference", dhcpv6.MessageTypeAdvertise, []dhcpv6.Option{preference}, 0},
+		{"advertise without preference", dhcpv6.MessageTypeAdvertise, nil, 1},
+		{"reply without preference", dhcpv6.MessageTypeReply, nil, 0},
+	}
+	for _, tt := range tests {
+		req := v6Message(t, dhcpv6.MessageTypeSolicit)
+		resp := v6Message(t, tt.respType, tt.opts...)
+		delta := statsutil.Delta(func() { state.Handler6(req, resp) })
+		if got := delta["dhcpv6_advertise_without_preference_total"]; got != tt.want {
+			t.Errorf("%s: advertises without preference increased by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestZeroLifetime(t *testing.T) {
+	state, _, _ := newTestState(t)
+	released := &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, 1}}
+	released.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("2001:db8::1")})
+	// one zero lifetime counts the IA once, however many it has
+	mixed := testIANA(2, "2001:db8::2")
+	mixed.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("2001:db8::3")})
+	mixed.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("2001:db8::4")})
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/56")
+	releasedPD := &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 3}}
+	releasedPD.Options.Add(&dhcpv6.OptIAPrefix{Prefix: prefix})
+	tests := []struct {
+		name   string
+		ia     dhcpv6.Option
+		iaType string
+		want   float64
+	}{
+		{"lease", testIANA(1, "2001:db8::1"), dhcpv6.OptionIANA.String(), 0},
+		{"zero lifetime address", released, dhcpv6.OptionIANA.String(), 1},
+		{"some zero lifetime addresses", mixed, dhcpv6.OptionIANA.String(), 1},
+		{"zero lifetime prefix", releasedPD, dhcpv6.OptionIAPD.String(), 1},
+	}
+	for _, tt := range tests {
+		req := v6Message(t, dhcpv6.MessageTypeRenew)
+		resp := v6Message(t, dhcpv6.MessageTypeReply, tt.ia)
+		delta := statsutil.Delta(func() { state.Handler6(req, resp) })
+		key := `dhcpv6_zero_lifetime_responses_total{ia_type="` + tt.iaType + `"}`
+		if got := delta[key]; got != tt.want {
+			t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, tt.want)
+		}
+	}
+}
+
+func TestServerID(t *testing.T) {
+	state, _, _ := newTestState(t)
+	tests := []struct {
+		name     string
+		serverID net.IP
+	}{
+		{"first server", net.IPv4(192, 0, 2, 1)},
+		{"second server", net.IPv4(192, 0, 2, 2)},
+		{"no server ID", nil},
+	}
+	for _, tt := range tests {
+		req := v4Request(t, dhcpv4.MessageTypeDiscover)
+		var mods []dhcpv4.Modifier
+		if tt.serverID != nil {
+			mods = append(mods, dhcpv4.WithServerIP(tt.serverID), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(tt.serverID)))
+		}
+		resp := v4Reply(t, req, dhcpv4.MessageTypeOffer, mods...)
+		delta := statsutil.Delta(func() { state.Handler4(req, resp) })
+		var counted float64
+		for key, value := range delta {
+			if strings.HasPrefix(key, "dhcpv4_responses_by_server_id_total{") {
+				counted += value
+			}
+		}
+		if tt.serverID == nil {
+			if counted != 0 {
+				t.Errorf("%s: responses by server ID increased by %v, want 0", tt.name, counted)
+			}
+			continue
+		}
+		key := `dhcpv4_responses_by_server_id_total{server_id="` + tt.serverID.String() + `"}`
+		if got := delta[key]; got != 1 || counted != 1 {
+			t.Errorf("%s: %s increased by %v of %v, want 1 of 1", tt.name, key, got, counted)
+		}
+	}
+}
+
+func TestIAFixupAddFailed(t *testing.T) {
+	var nilmsg *dhcpv6.Message
+	tests := []struct {
+		name string
+		resp dhcpv6.DHCPv6
+	}{
+		{"relay message", relayed(t, v6Message(t, dhcpv6.MessageTypeReply), 1)},
+		{"nil message", nilmsg},
+	}
+	for _, tt := range tests {
+		resp := tt.resp
+		reqias := FromIANA([]*dhcpv6.OptIANA{testIANA(1), testIANA(2)})
+		var got FixupResult
+		delta := statsutil.Delta(func() { got = ia_fixup(&resp, reqias, nil) })
+		want := FixupResult{Unsatisfied: 2, Quantifier: "none"}
+		if got != want {
+			t.Errorf("%s: ia_fixup = %+v, want %+v", tt.name, got, want)
+		}
+		if got := delta["dhcpv6_ia_fixup_add_failed_total"]; got != 2 {
+			t.Errorf("%s: add failures increased by %v, want 2", tt.name, got)
+		}
+	}
+	if relay := tests[0].resp.(*dhcpv6.RelayMessage); len(relay.Options.Get(dhcpv6.OptionIANA)) != 0 {
+		t.Errorf("IA_NA added to a relay message: %s", relay)
+	}
+}
+
+func TestRapidCommit(t *testing.T) {
+	state, _, _ := newTestState(t)
+	rapidCommit := &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit}
+	tests := []struct {
+		name         string
+		reqType      dhcpv6.MessageType
+		reqOpts      []dhcpv6.Option
+		respType     dhcpv6.MessageType
+		wantHonored  float64
+		wantDeclined float64
+	}{
+		{"honored", dhcpv6.MessageTypeSolicit, []dhcpv6.Option{rapidCommit}, dhcpv6.MessageTypeReply, 1, 0},
+		{"declined", dhcpv6.MessageTypeSolicit, []dhcpv6.Option{rapidCommit}, dhcpv6.MessageTypeAdvertise, 0, 1},
+		{"not asked", dhcpv6.MessageTypeSolicit, nil, dhcpv6.MessageTypeAdvertise, 0, 0},
+		// only a SOLICIT can ask for it
+		{"request", dhcpv6.MessageTypeRequest, []dhcpv6.Option{rapidCommit}, dhcpv6.MessageTypeReply, 0, 0},
+	}
+	for _, tt := range tests {
+		req := v6Message(t, tt.reqType, tt.reqOpts...)
+		resp := v6Message(t, tt.respType)
+		delta := statsutil.Delta(func() { state.Handler6(req, resp) })
+		if got := delta["dhcpv6_rapid_commit_honored_total"]; got != tt.wantHonored {
+			t.Errorf("%s: rapid commits honored increased by %v, want %v", tt.name, got, tt.wantHonored)
+		}
+		if got := delta["dhcpv6_rapid_commit_declined_total"]; got != tt.wantDeclined {
+			t.Errorf("%s: rapid commits declined increased by %v, want %v", tt.name, got, tt.wantDeclined)
+		}
+	}
+}
+
+func TestOffersForRequestedIP(t *testing.T) {
+	state, _, _ := newTestState(t)
+	hinted := net.IPv4(192, 0, 2, 10)
+	tests := []struct {
+		name     string
+		hint     net.IP
+		respType dhcpv4.MessageType
+		yiaddr   net.IP
+		want     string
+	}{
+		{"honored", hinted, dhcpv4.MessageTypeOffer, hinted, "true"},
+		{"not honored", hinted, dhcpv4.MessageTypeOffer, net.IPv4(192, 0, 2, 11), "false"},
+		{"no hint", nil, dhcpv4.MessageTypeOffer, hinted, ""},
+		{"ack", hinted, dhcpv4.MessageTypeAck, hinted, ""},
+	}
+	for _, tt := range tests {
+		var mods []dhcpv4.Modifier
+		if tt.hint != nil {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(tt.hint)))
+		}
+		req := v4Request(t, dhcpv4.MessageTypeDiscover, mods...)
+		resp := v4Reply(t, req, tt.respType, dhcpv4.WithYourIP(tt.yiaddr))
+		delta := statsutil.Delta(func() { state.Handler4(req, resp) })
+		for _, honored := range []string{"true", "false"} {
+			want := 0.0
+			if honored == tt.want {
+				want = 1
+			}
+			key := `dhcpv4_offers_for_requested_ip_total{honored="` + honored + `"}`
+			if got := delta[key]; got != want {
+				t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestCaptivePortal(t *testing.T) {
+	state, _, _ := newTestState(t)
+	uri := []byte("https://portal.example/")
+	portal4 := dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionURL, uri))
+	portal6 := &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionCaptivePortal, OptionData: uri}
+	tests := []struct {
+		name   string
+		handle func()
+		family string
+		want   float64
+	}{
+		{"v4 ack with portal", func() {
+			req := v4Request(t, dhcpv4.MessageTypeRequest)
+			state.Handler4(req, v4Reply(t, req, dhcpv4.MessageTypeAck, portal4))
+		}, "v4", 1},
+		{"v4 offer with portal", func() {
+			req := v4Request(t, dhcpv4.MessageTypeDiscover)
+			state.Handler4(req, v4Reply(t, req, dhcpv4.MessageTypeOffer, portal4))
+		}, "v4", 0},
+		{"v4 ack without portal", func() {
+			req := v4Request(t, dhcpv4.MessageTypeRequest)
+			state.Handler4(req, v4Reply(t, req, dhcpv4.MessageTypeAck))
+		}, "v4", 0},
+		{"v6 reply with portal", func() {
+			state.Handler6(v6Message(t, dhcpv6.MessageTypeRequest), v6Message(t, dhcpv6.MessageTypeReply, portal6))
+		}, "v6", 1},
+		{"v6 advertise with portal", func() {
+			state.Handler6(v6Message(t, dhcpv6.MessageTypeSolicit), v6Message(t, dhcpv6.MessageTypeAdvertise, portal6))
+		}, "v6", 0},
+		{"v6 reply without portal", func() {
+			state.Handler6(v6Message(t, dhcpv6.MessageTypeRequest), v6Message(t, dhcpv6.MessageTypeReply))
+		}, "v6", 0},
+	}
+	for _, tt := range tests {
+		delta := statsutil.Delta(tt.handle)
+		key := `dhcp_captive_portal_responses_total{family="` + tt.family + `"}`
+		if got := delta[key]; got != tt.want {
+			t.Errorf("%s: %s increased by %v, want %v", tt.name, key, got, tt.want)
+		}
+	}
+}
+
+func TestAllGrantedLeases(t *testing.T) {
+	state, _, _ := newTestState(t)
+	lease := dhcpv4.WithLeaseTime(3600)
+	tests := []struct {
+		name      string
+		respType  dhcpv4.MessageType
+		mods      []dhcpv4.Modifier
+		wantCount float64
+		wantSum   float64
+	}{
+		{"ack", dhcpv4.MessageTypeAck, []dhcpv4.Modifier{lease, dhcpv4.WithYourIP(net.IPv4(192, 0, 2, 10))}, 1, 3600},
+		// unlike dhcpv4_granted_lease_seconds, this counts leases without a yiaddr
+		{"ack without yiaddr", dhcpv4.MessageTypeAck, []dhcpv4.Modifier{lease}, 1, 3600},
+		{"ack without lease time", dhcpv4.MessageTypeAck, nil, 0, 0},
+		{"offer", dhcpv4.MessageTypeOffer, []dhcpv4.Modifier{lease}, 0, 0},
+	}
+	for _, tt := range tests {
+		req := v4Request(t, dhcpv4.MessageTypeRequest)
+		resp := v4Reply(t, req, tt.respType, tt.mods...)
+		delta := statsutil.Delta(func() { state.Handler4(req, resp) })
+		if got := delta["dhcpv4_all_granted_leases_seconds_count"]; got != tt.wantCount {
+			t.Errorf("%s: observed %v leases, want %v", tt.name, got, tt.wantCount)
+		}
+		if got := delta["dhcpv4_all_granted_leases_seconds_sum"]; got != tt.wantSum {
+			t.Errorf("%s: observed %vs of leases, want %vs", tt.name, got, tt.wantSum)
+		}
+	}
+}
+
+func TestIAIDLowByte(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantCount float64
+		wantSum   float64
+		wantPDSum float64
+	}{
+		{"tracked", []string{"track_iaid_hist"}, 2, 3 + 7, 9},
+		{"untracked", nil, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		state, _, _ := newTestState(t, tt.args...)
+		pd := &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 1, 9}}
+		req := v6Message(t, dhcpv6.MessageTypeRequest, testIANA(3), &dhcpv6.OptIANA{IaId: [4]byte{0xff, 0, 0, 7}}, pd)
+		delta := statsutil.Delta(func() { state.Handler6(req, v6Message(t, dhcpv6.MessageTypeReply)) })
+		if got := delta[`dhcpv6_iaid_low_byte_count{type="IA_NA"}`]; got != tt.wantCount {
+			t.Errorf("%s: observed %v IA_NA IAIDs, want %v", tt.name, got, tt.wantCount)
+		}
+		if got := delta[`dhcpv6_iaid_low_byte_sum{type="IA_NA"}`]; got != tt.wantSum {
+			t.Errorf("%s: IA_NA IAID low bytes sum to %v, want %v", tt.name, got, tt.wantSum)
+		}
+		if got := delta[`dhcpv6_iaid_low_byte_sum{type="IA_PD"}`]; got != tt.wantPDSum {
+			t.Errorf("%s: IA_PD IAID low bytes sum to %v, want %v", tt.name, got, tt.wantPDSum)
+		}
+	}
+}
+
+func TestIASample(t *testing.T) {
+	granted := v6Message(t, dhcpv6.MessageTypeReply, testIANA(1, "2001:db8::1"))
+	denied := v6Message(t, dhcpv6.MessageTypeReply, testIANA(1))
+	tests := []struct {
+		name string
+		args []string
+		// the ratio after each of granted, denied, granted, denied
+		want []float64
+	}{
+		{"every IA", nil, []float64{1, 0.95, 0.9525, 0.904875}},
+		// the first of every two is sampled, so only grants feed it
+		{"one in two", []string{"ia_sample=1/2"}, []float64{1, 1, 1, 1}},
+		{"one in three", []string{"ia_sample=1/3"}, []float64{1, 1, 1, 0.95}},
+	}
+	for _, tt := range tests {
+		state, _, _ := newTestState(t, tt.args...)
+		var processed float64
+		for i, want := range tt.want {
+			resp := granted
+			if i%2 == 1 {
+				resp = denied
+			}
+			delta := statsutil.Delta(func() { state.Handler6(v6Message(t, dhcpv6.MessageTypeRequest, testIANA(1)), resp) })
+			processed += delta[`dhcpv6_ias_processed_total{result="all",type="IA_NA"}`] + delta[`dhcpv6_ias_processed_total{result="none",type="IA_NA"}`]
+			if got := state.Snapshot()[`dhcpv6_ia_satisfied_ratio_ewma{type="IA_NA"}`]; math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s: after %d IAs the ratio is %v, want %v", tt.name, i+1, got, want)
+			}
+		}
+		// sampling doesn't affect the exact counts
+		if processed != float64(len(tt.want)) {
+			t.Errorf("%s: %v IAs processed, want %d", tt.name, processed, len(tt.want))
+		}
+	}
+}
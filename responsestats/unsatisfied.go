@@ -0,0 +1,137 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package responsestats
+
+import (
+	"encoding/csv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"dhcpserver/statsutil"
+)
+
+// we score at most maxUnsatisfiedClients clients, and a client's score
+// halves every unsatisfiedHalfLife it goes without another failure
+const (
+	maxUnsatisfiedClients = 4096
+	unsatisfiedHalfLife   = 10 * time.Minute
+)
+
+// unsatisfiedScore is a client's decaying count of unsatisfied IAs as of last
+type unsatisfiedScore struct {
+	score float64
+	last  time.Time
+}
+
+// at returns the score decayed to now.
+func (s unsatisfiedScore) at(now time.Time) float64 {
+	elapsed := now.Sub(s.last)
+	if elapsed <= 0 {
+		return s.score
+	}
+	return s.score * math.Exp2(-float64(elapsed)/float64(unsatisfiedHalfLife))
+}
+
+// UnsatisfiedClient is a client and its decaying count of responses that
+// satisfied none or only some of its IAs.
+type UnsatisfiedClient struct {
+	DUID  string
+	Score float64
+}
+
+// unsatisfiedSeen adds one to duid's score. When the table is full the
+// client with the lowest score makes way for it.
+func (state *PluginState) unsatisfiedSeen(duid string) {
+	now := state.Now()
+	state.Lock()
+	defer state.Unlock()
+	s, known := state.unsatisfied[duid]
+	if !known && len(state.unsatisfied) >= maxUnsatisfiedClients {
+		lowest, victim := math.Inf(1), ""
+		for key, other := range state.unsatisfied {
+			if score := other.at(now); score < lowest {
+				lowest, victim = score, key
+			}
+		}
+		delete(state.unsatisfied, victim)
+		statsutil.WindowEntries.Dec()
+	}
+	if !known {
+		statsutil.WindowEntries.Inc()
+	}
+	state.unsatisfied[duid] = unsatisfiedScore{score: s.at(now) + 1, last: now}
+}
+
+// TopUnsatisfied returns the n clients with the highest unsatisfied
+// scores, highest first.
+func (state *PluginState) TopUnsatisfied(n int) []UnsatisfiedClient {
+	now := state.Now()
+	state.Lock()
+	clients := make([]UnsatisfiedClient, 0, len(state.unsatisfied))
+	for duid, s := range state.unsatisfied {
+		clients = append(clients, UnsatisfiedClient{DUID: duid, Score: s.at(now)})
+	}
+	state.Unlock()
+	return topUnsatisfied(clients, n)
+}
+
+// topUnsatisfied returns the n clients with the highest scores, highest
+// first.
+func topUnsatisfied(clients []UnsatisfiedClient, n int) []UnsatisfiedClient {
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Score != clients[j].Score {
+			return clients[i].Score > clients[j].Score
+		}
+		return clients[i].DUID < clients[j].DUID
+	})
+	if len(clients) > n {
+		clients = clients[:n]
+	}
+	return clients
+}
+
+// every DHCPv6 instance, so ServeTopUnsatisfied can report on them all
+var (
+	instancesMu sync.Mutex
+	instances   []*PluginState
+)
+
+// the number of clients ServeTopUnsatisfied reports by default
+const defaultTopUnsatisfied = 10
+
+// ServeTopUnsatisfied is an http.HandlerFunc that writes the clients with
+// the highest unsatisfied scores across every instance as CSV. The n
+// query parameter sets how many.
+func ServeTopUnsatisfied(w http.ResponseWriter, r *http.Request) {
+	n := defaultTopUnsatisfied
+	if value := r.URL.Query().Get("n"); len(value) > 0 {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	var clients []UnsatisfiedClient
+	instancesMu.Lock()
+	for _, state := range instances {
+		clients = append(clients, state.TopUnsatisfied(n)...)
+	}
+	instancesMu.Unlock()
+	clients = topUnsatisfied(clients, n)
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"duid", "score"})
+	for _, client := range clients {
+		cw.Write([]string{client.DUID, strconv.FormatFloat(client.Score, 'f', 2, 64)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Errorf("could not write unsatisfied clients: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package responsestats
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func TestTopUnsatisfied(t *testing.T) {
+	state, clock, _ := newTestState(t)
+	for i := 0; i < 4; i++ {
+		state.unsatisfiedSeen("old")
+	}
+	clock.Advance(unsatisfiedHalfLife)
+	state.unsatisfiedSeen("new")
+	state.unsatisfiedSeen("new")
+	state.unsatisfiedSeen("once")
+	want := []UnsatisfiedClient{{"new", 2}, {"old", 2}, {"once", 1}}
+	if got := state.TopUnsatisfied(3); !reflect.DeepEqual(got, want) {
+		t.Errorf("TopUnsatisfied(3) = %v, want %v", got, want)
+	}
+	if got := state.TopUnsatisfied(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("TopUnsatisfied(1) = %v, want %v", got, want[:1])
+	}
+	// a failure adds to the decayed score
+	clock.Advance(unsatisfiedHalfLife)
+	state.unsatisfiedSeen("old")
+	if got := state.TopUnsatisfied(1); !reflect.DeepEqual(got, []UnsatisfiedClient{{"old", 2}}) {
+		t.Errorf("TopUnsatisfied(1) = %v, want old scoring 2", got)
+	}
+}
+
+func TestUnsatisfiedBounded(t *testing.T) {
+	state, clock, _ := newTestState(t)
+	state.unsatisfiedSeen("persistent")
+	for i := 0; i < maxUnsatisfiedClients-1; i++ {
+		clock.Advance(1)
+		state.unsatisfiedSeen(strconv.Itoa(i))
+	}
+	state.unsatisfiedSeen("persistent")
+	// the client with the lowest decayed score makes way
+	state.unsatisfiedSeen("latecomer")
+	if len(state.unsatisfied) != maxUnsatisfiedClients {
+		t.Errorf("tracking %d clients, want %d", len(state.unsatisfied), maxUnsatisfiedClients)
+	}
+	for _, duid := range []string{"persistent", "latecomer"} {
+		if _, ok := state.unsatisfied[duid]; !ok {
+			t.Errorf("%s was evicted", duid)
+		}
+	}
+	if _, ok := state.unsatisfied["0"]; ok {
+		t.Errorf("the oldest single failure wasn't evicted")
+	}
+}
+
+func TestUnsatisfiedOncePerResponse(t *testing.T) {
+	state, _, _ := newTestState(t)
+	req := v6Message(t, dhcpv6.MessageTypeRequest, testIANA(1), testIANA(2), &dhcpv6.OptIAPD{IaId: [4]byte{3}})
+	resp := v6Message(t, dhcpv6.MessageTypeReply)
+	state.Handler6(req, resp)
+	top := state.TopUnsatisfied(1)
+	if len(top) != 1 || top[0].DUID != testDUID.String() || top[0].Score != 1 {
+		t.Errorf("TopUnsatisfied(1) = %v, want %s scoring 1", top, testDUID.String())
+	}
+	// a fully satisfied client isn't tracked
+	state, _, _ = newTestState(t)
+	req = v6Message(t, dhcpv6.MessageTypeRequest, testIANA(1))
+	resp = v6Message(t, dhcpv6.MessageTypeReply, testIANA(1, "2001:db8::1"))
+	state.Handler6(req, resp)
+	if top := state.TopUnsatisfied(1); len(top) != 0 {
+		t.Errorf("TopUnsatisfied(1) = %v for a satisfied client", top)
+	}
+}
+
+func TestServeTopUnsatisfied(t *testing.T) {
+	a, _, _ := newTestState(t)
+	b, _, _ := newTestState(t)
+	a.unsatisfiedSeen("client-a")
+	b.unsatisfiedSeen("client-b")
+	b.unsatisfiedSeen("client-b")
+	instancesMu.Lock()
+	saved := instances
+	instances = []*PluginState{a, b}
+	instancesMu.Unlock()
+	defer func() {
+		instancesMu.Lock()
+		instances = saved
+		instancesMu.Unlock()
+	}()
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"", http.StatusOK, "duid,score\nclient-b,2.00\nclient-a,1.00\n"},
+		{"?n=1", http.StatusOK, "duid,score\nclient-b,2.00\n"},
+		{"?n=-1", http.StatusBadRequest, ""},
+		{"?n=all", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		ServeTopUnsatisfied(w, httptest.NewRequest("GET", "/unsatisfied"+tt.query, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %q status = %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusOK && w.Body.String() != tt.wantBody {
+			t.Errorf("GET %q = %q, want %q", tt.query, w.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestUnsatisfiedScoreDecay(t *testing.T) {
+	last := time.Unix(1700000000, 0)
+	s := unsatisfiedScore{score: 8, last: last}
+	tests := []struct {
+		elapsed int
+		want    float64
+	}{
+		{-1, 8},
+		{0, 8},
+		{1, 4},
+		{3, 1},
+	}
+	for _, tt := range tests {
+		now := last.Add(unsatisfiedHalfLife * time.Duration(tt.elapsed))
+		if got := s.at(now); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("score after %d half-lives = %v, want %v", tt.elapsed, got, tt.want)
+		}
+	}
+}
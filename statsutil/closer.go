@@ -0,0 +1,37 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"io"
+	"sync"
+)
+
+// coredhcp has no plugin shutdown hook, so plugins that hold resources
+// (sockets, goroutines) register them here and main closes them all on
+// the way out.
+var (
+	closersMu sync.Mutex
+	closers   []io.Closer
+)
+
+// RegisterCloser arranges for c to be closed by CloseAll.
+func RegisterCloser(c io.Closer) {
+	closersMu.Lock()
+	defer closersMu.Unlock()
+	closers = append(closers, c)
+}
+
+// CloseAll closes everything registered with RegisterCloser.
+func CloseAll() {
+	closersMu.Lock()
+	defer closersMu.Unlock()
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			log.Errorf("error during shutdown: %v", err)
+		}
+	}
+	closers = nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigArgPrefix introduces the path of a JSON file of plugin args.
+const ConfigArgPrefix = "config="
+
+// ExpandConfigArgs replaces a config=<path> arg with the args in the JSON
+// object in that file. Each key becomes key=value, except that true
+// becomes a bare key and false omits it. Each key appears once, since
+// some (control_socket, statsd, ...) open something every time: an
+// inline arg overrides the file's arg with the same key. It also returns
+// the keys of the args that came from the file, since a plugin ignores
+// unknown inline args for compatibility but must reject unknown keys in
+// its file.
+func ExpandConfigArgs(args []string) ([]string, map[string]bool, error) {
+	var fromFile, inline []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, ConfigArgPrefix) {
+			inline = append(inline, arg)
+			continue
+		}
+		if fromFile != nil {
+			return nil, nil, fmt.Errorf("more than one config arg")
+		}
+		path := strings.TrimPrefix(arg, ConfigArgPrefix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fromFile, err = ParseConfig(data); err != nil {
+			return nil, nil, fmt.Errorf("invalid config %s: %v", path, err)
+		}
+	}
+	fileKeys := make(map[string]bool, len(fromFile))
+	for _, arg := range fromFile {
+		key, _, _ := strings.Cut(arg, "=")
+		fileKeys[key] = true
+	}
+	for _, arg := range inline {
+		key, _, _ := strings.Cut(arg, "=")
+		delete(fileKeys, key)
+	}
+	return mergeArgs(append(fromFile, inline...)), fileKeys, nil
+}
+
+// mergeArgs keeps the last of the args with each key, in the position of
+// the first.
+func mergeArgs(args []string) []string {
+	merged := make([]string, 0, len(args))
+	index := make(map[string]int, len(args))
+	for _, arg := range args {
+		key, _, _ := strings.Cut(arg, "=")
+		if idx, ok := index[key]; ok {
+			merged[idx] = arg
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, arg)
+	}
+	return merged
+}
+
+// ParseConfig converts a JSON object to plugin args as ExpandConfigArgs
+// describes, sorted by key.
+func ParseConfig(data []byte) ([]string, error) {
+	var config map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{}
+	for _, key := range keys {
+		switch value := config[key].(type) {
+		case string:
+			args = append(args, key+"="+value)
+		case json.Number:
+			args = append(args, key+"="+value.String())
+		case bool:
+			if value {
+				args = append(args, key)
+			}
+		default:
+			return nil, fmt.Errorf("%s must be a string, number or boolean", strconv.Quote(key))
+		}
+	}
+	return args, nil
+}
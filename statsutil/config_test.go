@@ -0,0 +1,82 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", `{}`, []string{}, false},
+		{"sorted", `{"mtu": 1400, "label_case": "lower"}`, []string{"label_case=lower", "mtu=1400"}, false},
+		{"booleans", `{"silent": true, "drop_large_pd": false}`, []string{"silent"}, false},
+		{"number kept exact", `{"amplification_threshold": 2.50}`, []string{"amplification_threshold=2.50"}, false},
+		{"nested", `{"subnets": ["10.0.0.0/8"]}`, nil, true},
+		{"not an object", `[1]`, nil, true},
+		{"malformed", `{`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConfig([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConfig error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseConfig = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandConfigArgs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(`{"mtu": 1400, "silent": true, "statsd": "udp://127.0.0.1:8125"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		in       []string
+		want     []string
+		wantFile map[string]bool
+		wantErr  bool
+	}{
+		{"no config", []string{"mtu=1200", "silent"}, []string{"mtu=1200", "silent"}, map[string]bool{}, false},
+		{"file only", []string{"config=" + path}, []string{"mtu=1400", "silent", "statsd=udp://127.0.0.1:8125"},
+			map[string]bool{"mtu": true, "silent": true, "statsd": true}, false},
+		{"inline overrides file", []string{"statsd=udp://127.0.0.1:9125", "config=" + path, "max_ias=8"},
+			[]string{"mtu=1400", "silent", "statsd=udp://127.0.0.1:9125", "max_ias=8"},
+			map[string]bool{"mtu": true, "silent": true}, false},
+		{"repeated inline keeps last", []string{"mtu=1200", "mtu=1300"}, []string{"mtu=1300"}, map[string]bool{}, false},
+		{"missing file", []string{"config=" + filepath.Join(dir, "missing.json")}, nil, nil, true},
+		{"two configs", []string{"config=" + path, "config=" + path}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fileKeys, err := ExpandConfigArgs(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExpandConfigArgs error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExpandConfigArgs = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(fileKeys, tt.wantFile) {
+				t.Errorf("ExpandConfigArgs file keys = %v, want %v", fileKeys, tt.wantFile)
+			}
+		})
+	}
+}
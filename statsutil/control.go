@@ -0,0 +1,202 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricPrefix selects the metrics our plugins export.
+const MetricPrefix = "dhcp"
+
+// Sample is the value of one metric, or of a histogram's _count or _sum.
+type Sample struct {
+	Name   string
+	Labels [][2]string
+	Value  float64
+	// Gauge is false for counters and the parts of histograms, which
+	// only increase
+	Gauge bool
+}
+
+// Key returns the sample's name and labels as Prometheus writes them.
+func (s Sample) Key() string {
+	if len(s.Labels) == 0 {
+		return s.Name
+	}
+	labels := make([]string, len(s.Labels))
+	for idx, pair := range s.Labels {
+		labels[idx] = fmt.Sprintf("%s=%q", pair[0], pair[1])
+	}
+	return fmt.Sprintf("%s{%s}", s.Name, strings.Join(labels, ","))
+}
+
+// Gather returns the current value of every metric whose name starts
+// with MetricPrefix, including histograms not yet registered by a
+// plugin's setup.
+func Gather() ([]Sample, error) {
+	RegisterHistograms()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), MetricPrefix) {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			var labels [][2]string
+			for _, pair := range m.GetLabel() {
+				labels = append(labels, [2]string{pair.GetName(), pair.GetValue()})
+			}
+			name := family.GetName()
+			switch {
+			case m.Counter != nil:
+				samples = append(samples, Sample{name, labels, m.GetCounter().GetValue(), false})
+			case m.Gauge != nil:
+				samples = append(samples, Sample{name, labels, m.GetGauge().GetValue(), true})
+			case m.Histogram != nil:
+				samples = append(samples, Sample{name + "_count", labels, float64(m.GetHistogram().GetSampleCount()), false})
+				samples = append(samples, Sample{name + "_sum", labels, m.GetHistogram().GetSampleSum(), false})
+			}
+		}
+	}
+	return samples, nil
+}
+
+// Snapshot returns the current value of every metric whose name starts
+// with MetricPrefix, keyed by Sample.Key.
+func Snapshot() (map[string]float64, error) {
+	samples, err := Gather()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		snapshot[s.Key()] = s.Value
+	}
+	return snapshot, nil
+}
+
+// Snapshotter gives the plugin state that embeds it a Snapshot method.
+type Snapshotter struct{}
+
+// Snapshot returns the current value of every metric, keyed by name and
+// labels, or nothing if they can't be gathered. Every plugin instance
+// shares the metrics, so they cover both families and both plugins.
+func (Snapshotter) Snapshot() map[string]float64 {
+	snapshot, err := Snapshot()
+	if err != nil {
+		log.Errorf("could not gather metrics: %v", err)
+		return map[string]float64{}
+	}
+	return snapshot
+}
+
+// Delta runs f and returns how much each metric changed meanwhile, keyed
+// like Snapshot. Tests use it to see what a handler counted, since the
+// metrics are shared with every other test.
+func Delta(f func()) map[string]float64 {
+	before := Snapshotter{}.Snapshot()
+	f()
+	delta := Snapshotter{}.Snapshot()
+	for key, value := range delta {
+		delta[key] = value - before[key]
+	}
+	return delta
+}
+
+// WriteSnapshot writes the current value of every metric whose name
+// starts with MetricPrefix, one per line, sorted by name and labels.
+// Histograms are written as their _count and _sum.
+func WriteSnapshot(w io.Writer) error {
+	samples, err := Gather()
+	if err != nil {
+		return err
+	}
+	lines := make([]string, len(samples))
+	for idx, s := range samples {
+		lines[idx] = fmt.Sprintf("%s %g", s.Key(), s.Value)
+	}
+	sort.Strings(lines)
+	bw := bufio.NewWriter(w)
+	for _, line := range lines {
+		fmt.Fprintln(bw, line)
+	}
+	return bw.Flush()
+}
+
+// ControlSocket serves a snapshot of our metrics to every client that
+// connects to a Unix-domain socket.
+type ControlSocket struct {
+	Path     string
+	listener net.Listener
+}
+
+var (
+	controlSocketsMu sync.Mutex
+	controlSockets   = make(map[string]*ControlSocket)
+)
+
+// ServeControlSocket starts serving snapshots on a Unix socket at path,
+// or returns the ControlSocket already serving there. The socket is
+// removed by CloseAll.
+func ServeControlSocket(path string) (*ControlSocket, error) {
+	controlSocketsMu.Lock()
+	defer controlSocketsMu.Unlock()
+	if cs, ok := controlSockets[path]; ok {
+		return cs, nil
+	}
+	// a previous instance may have left its socket behind
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	cs := &ControlSocket{Path: path, listener: listener}
+	controlSockets[path] = cs
+	RegisterCloser(cs)
+	go cs.serve()
+	return cs, nil
+}
+
+func (cs *ControlSocket) serve() {
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			// the listener was closed
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := WriteSnapshot(conn); err != nil {
+				log.Debugf("could not write snapshot to %s: %v", cs.Path, err)
+			}
+		}()
+	}
+}
+
+// Close stops serving and removes the socket.
+func (cs *ControlSocket) Close() error {
+	controlSocketsMu.Lock()
+	delete(controlSockets, cs.Path)
+	controlSocketsMu.Unlock()
+	// closing a Unix listener also unlinks its socket
+	return cs.listener.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var testcontrol = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dhcp_test_control_total",
+	Help: "test",
+}, []string{"family"})
+
+func TestSampleKey(t *testing.T) {
+	tests := []struct {
+		sample Sample
+		want   string
+	}{
+		{Sample{Name: "dhcp_x_total"}, "dhcp_x_total"},
+		{Sample{Name: "dhcp_x_total", Labels: [][2]string{{"family", "v4"}}}, `dhcp_x_total{family="v4"}`},
+		{Sample{Name: "dhcp_x_total", Labels: [][2]string{{"a", "1"}, {"b", `"q"`}}}, `dhcp_x_total{a="1",b="\"q\""}`},
+	}
+	for _, tt := range tests {
+		if got := tt.sample.Key(); got != tt.want {
+			t.Errorf("Key() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	before, err := Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcontrol.WithLabelValues("v6").Add(2)
+	after, err := Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := `dhcp_test_control_total{family="v6"}`
+	if got := after[key] - before[key]; got != 2 {
+		t.Errorf("snapshot of %s increased by %v, want 2", key, got)
+	}
+	for key := range after {
+		if !strings.HasPrefix(key, MetricPrefix) {
+			t.Errorf("snapshot has %s, which isn't one of our metrics", key)
+		}
+	}
+	if got := (Snapshotter{}).Snapshot()[key]; got != after[key] {
+		t.Errorf("Snapshotter has %s = %v, want %v", key, got, after[key])
+	}
+}
+
+func TestDelta(t *testing.T) {
+	delta := Delta(func() { testcontrol.WithLabelValues("v4").Add(3) })
+	if got := delta[`dhcp_test_control_total{family="v4"}`]; got != 3 {
+		t.Errorf("delta = %v, want 3", got)
+	}
+	if got := delta[`dhcp_test_control_total{family="v6"}`]; got != 0 {
+		t.Errorf("unchanged metric delta = %v, want 0", got)
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	testcontrol.WithLabelValues("v4").Inc()
+	path := filepath.Join(t.TempDir(), "control.sock")
+	cs, err := ServeControlSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	found := false
+	for idx, line := range lines {
+		if idx > 0 && line < lines[idx-1] {
+			t.Errorf("snapshot isn't sorted: %q after %q", line, lines[idx-1])
+		}
+		if strings.HasPrefix(line, `dhcp_test_control_total{family="v4"} `) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("snapshot is missing dhcp_test_control_total: %s", data)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// These gauges expose the sizes of the plugins' internal maps so we can
+// alert on unbounded growth. Every plugin instance shares them, so
+// callers Inc() and Dec() them under the lock that guards the map rather
+// than Set() them.
+var (
+	DedupEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dhcp_dedup_entries",
+		Help: "Number of entries in the log line deduplication cache",
+	})
+	WindowEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dhcp_window_entries",
+		Help: "Number of entries in the sliding-window maps, such as relays by last-seen time",
+	})
+	PendingRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dhcp_pending_requests",
+		Help: "Number of requests held awaiting a later message from the same client",
+	})
+)
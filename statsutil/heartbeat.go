@@ -0,0 +1,60 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var heartbeats = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dhcp_plugin_heartbeat_total",
+	Help: "Heartbeats from plugins configured with heartbeat=, by plugin; if it stops advancing, the plugin is wedged",
+}, []string{"plugin"})
+
+// Heartbeat increments the heartbeat counter for a plugin on a timer,
+// independent of traffic.
+type Heartbeat struct {
+	Plugin   string
+	periodic *Periodic
+}
+
+var (
+	heartbeatsMu sync.Mutex
+	running      = make(map[string]*Heartbeat)
+)
+
+// StartHeartbeat beats for plugin on every tick of a clock's ticker for
+// interval until closed, or returns the Heartbeat already beating for
+// plugin, so that the DHCPv4 and DHCPv6 instances share one. CloseAll
+// closes it.
+func StartHeartbeat(plugin string, interval time.Duration, clock Clock) *Heartbeat {
+	heartbeatsMu.Lock()
+	defer heartbeatsMu.Unlock()
+	if hb, ok := running[plugin]; ok {
+		return hb
+	}
+	hb := &Heartbeat{Plugin: plugin}
+	hb.periodic = Every(clock, interval, hb.Beat)
+	running[plugin] = hb
+	RegisterCloser(hb)
+	return hb
+}
+
+// Beat increments the heartbeat counter once.
+func (hb *Heartbeat) Beat() {
+	heartbeats.WithLabelValues(hb.Plugin).Inc()
+}
+
+// Close stops the heartbeat.
+func (hb *Heartbeat) Close() error {
+	heartbeatsMu.Lock()
+	delete(running, hb.Plugin)
+	heartbeatsMu.Unlock()
+	return hb.periodic.Close()
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHeartbeat(t *testing.T) {
+	clock := NewMockClock()
+	hb := StartHeartbeat("test", time.Second, clock)
+	if again := StartHeartbeat("test", time.Second, nil); again != hb {
+		t.Errorf("StartHeartbeat didn't share the heartbeat for the plugin")
+	}
+	counter := heartbeats.WithLabelValues("test")
+	before := testutil.ToFloat64(counter)
+	for i := 0; i < 3; i++ {
+		clock.Tick()
+	}
+	// the ticker stops only after the last beat has finished
+	hb.Close()
+	clock.Wait()
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Errorf("heartbeats = %v, want 3", got)
+	}
+	if again := StartHeartbeat("test", time.Second, NewMockClock()); again == hb {
+		t.Errorf("StartHeartbeat returned a closed heartbeat")
+	} else {
+		again.Close()
+	}
+}
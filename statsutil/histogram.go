@@ -0,0 +1,175 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BucketsArgPrefix introduces a plugin argument that overrides the
+// buckets of a histogram, e.g. buckets_dhcp_request_option_count=1,5,10
+const BucketsArgPrefix = "buckets_"
+
+// Histogram is a HistogramVec whose buckets can be overridden by plugin
+// arguments at setup time, until its first observation.
+type Histogram struct {
+	mu     sync.Mutex
+	opts   prometheus.HistogramOpts
+	labels []string
+	vec    *prometheus.HistogramVec
+	used   bool
+}
+
+// Histograms are the histograms one plugin declares. Only that plugin's
+// buckets_ arguments can override their buckets.
+type Histograms struct {
+	Plugin string
+	byName map[string]*Histogram
+}
+
+var (
+	histogramsMu sync.Mutex
+	// every declared histogram, by name, whichever plugin declared it
+	histograms = make(map[string]*Histogram)
+)
+
+// NewHistograms returns an empty set of histograms for plugin.
+func NewHistograms(plugin string) *Histograms {
+	return &Histograms{Plugin: plugin, byName: make(map[string]*Histogram)}
+}
+
+// New declares a histogram with default buckets given by opts. Like
+// registering a metric twice, declaring a name twice panics, even in
+// different sets.
+func (hs *Histograms) New(opts prometheus.HistogramOpts, labels ...string) *Histogram {
+	h := &Histogram{opts: opts, labels: labels}
+	histogramsMu.Lock()
+	defer histogramsMu.Unlock()
+	if _, dup := histograms[opts.Name]; dup {
+		panic(fmt.Sprintf("histogram %s declared twice", opts.Name))
+	}
+	histograms[opts.Name] = h
+	hs.byName[opts.Name] = h
+	return h
+}
+
+// register registers the histogram if it isn't already, and creates the
+// one series of a histogram without labels. The caller must hold h.mu.
+func (h *Histogram) register() {
+	if h.vec != nil {
+		return
+	}
+	h.vec = promauto.NewHistogramVec(h.opts, h.labels)
+	if len(h.labels) == 0 {
+		h.vec.WithLabelValues()
+	}
+}
+
+// ApplyArgs applies every buckets_<metric>=<bounds> argument in args to
+// the set's histograms and returns the other arguments. It then registers
+// the set, so every histogram appears in /metrics before it is first used
+// but only once its buckets are final. A plugin's FromArgs calls it before
+// looking at its own arguments.
+func (hs *Histograms) ApplyArgs(args []string) ([]string, error) {
+	var rest []string
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		if !strings.HasPrefix(key, BucketsArgPrefix) {
+			rest = append(rest, arg)
+			continue
+		}
+		name := strings.TrimPrefix(key, BucketsArgPrefix)
+		h, ok := hs.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("%s has no histogram named %s", hs.Plugin, name)
+		}
+		buckets, err := ParseBuckets(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if err := h.SetBuckets(buckets); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range hs.byName {
+		h.mu.Lock()
+		h.register()
+		h.mu.Unlock()
+	}
+	return rest, nil
+}
+
+// RegisterHistograms registers every declared histogram that isn't
+// already registered.
+func RegisterHistograms() {
+	histogramsMu.Lock()
+	defer histogramsMu.Unlock()
+	for _, h := range histograms {
+		h.mu.Lock()
+		h.register()
+		h.mu.Unlock()
+	}
+}
+
+// WithLabelValues registers the histogram if necessary and returns the
+// Observer for the given label values.
+func (h *Histogram) WithLabelValues(lvs ...string) prometheus.Observer {
+	h.mu.Lock()
+	h.register()
+	h.used = true
+	vec := h.vec
+	h.mu.Unlock()
+	return vec.WithLabelValues(lvs...)
+}
+
+// SetBuckets overrides the buckets of a histogram that hasn't been used
+// yet, re-registering it if it is already registered.
+func (h *Histogram) SetBuckets(buckets []float64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.used {
+		return fmt.Errorf("histogram %s is already in use", h.opts.Name)
+	}
+	h.opts.Buckets = buckets
+	if h.vec != nil {
+		prometheus.Unregister(h.vec)
+		h.vec = nil
+		h.register()
+	}
+	return nil
+}
+
+// Buckets returns the buckets the histogram is (or will be) registered with.
+func (h *Histogram) Buckets() []float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.opts.Buckets == nil {
+		return prometheus.DefBuckets
+	}
+	return h.opts.Buckets
+}
+
+// ParseBuckets parses a comma-separated, strictly increasing list of
+// histogram bucket upper bounds.
+func ParseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %v", field, err)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be strictly increasing: %s", s)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
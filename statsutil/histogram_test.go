@@ -0,0 +1,124 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []float64
+		wantErr bool
+	}{
+		{in: "0.001,0.01,0.1,1", want: []float64{0.001, 0.01, 0.1, 1}},
+		{in: " 1 , 5 ,10", want: []float64{1, 5, 10}},
+		{in: "1", want: []float64{1}},
+		{in: "1,1", wantErr: true},
+		{in: "5,1", wantErr: true},
+		{in: "1,x", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBuckets(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBuckets(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseBuckets(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestApplyArgs(t *testing.T) {
+	mine := NewHistograms("mine")
+	h := mine.New(prometheus.HistogramOpts{
+		Name:    "dhcp_test_apply_args",
+		Help:    "test",
+		Buckets: []float64{1, 2},
+	})
+	theirs := NewHistograms("theirs")
+	other := theirs.New(prometheus.HistogramOpts{
+		Name:    "dhcp_test_apply_args_other",
+		Help:    "test",
+		Buckets: []float64{1, 2},
+	})
+	tests := []struct {
+		args     []string
+		wantRest []string
+		wantErr  bool
+	}{
+		{[]string{"max_prl=10", "buckets_dhcp_test_apply_args=1,5,10", "silent"}, []string{"max_prl=10", "silent"}, false},
+		{[]string{"buckets_dhcp_test_apply_args=10,5"}, nil, true},
+		{[]string{"buckets_dhcp_no_such_histogram=1"}, nil, true},
+		// another plugin's histogram is out of scope
+		{[]string{"buckets_dhcp_test_apply_args_other=5"}, nil, true},
+	}
+	for _, tt := range tests {
+		rest, err := mine.ApplyArgs(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ApplyArgs(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(rest, tt.wantRest) {
+			t.Errorf("ApplyArgs(%q) = %q, want %q", tt.args, rest, tt.wantRest)
+		}
+	}
+	if got, want := h.Buckets(), []float64{1, 5, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Buckets() = %v, want %v", got, want)
+	}
+	if got, want := other.Buckets(), []float64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("other plugin's Buckets() = %v, want %v", got, want)
+	}
+	snapshot, err := Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshot["dhcp_test_apply_args_count"]; !ok {
+		t.Errorf("ApplyArgs didn't register the histogram")
+	}
+}
+
+func TestHistogramBucketsAfterRegistration(t *testing.T) {
+	h := NewHistograms("test").New(prometheus.HistogramOpts{
+		Name: "dhcp_test_registered_histogram",
+		Help: "test",
+	})
+	RegisterHistograms()
+	snapshot, err := Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshot["dhcp_test_registered_histogram_count"]; !ok {
+		t.Errorf("registered histogram missing from snapshot")
+	}
+	// registered but unused, so the buckets can still change
+	if err := h.SetBuckets([]float64{1, 2, 3}); err != nil {
+		t.Errorf("SetBuckets before use: %v", err)
+	}
+	h.WithLabelValues().Observe(2)
+	if err := h.SetBuckets([]float64{4}); err == nil {
+		t.Errorf("SetBuckets after use succeeded")
+	}
+	if snapshot, _ = Snapshot(); snapshot["dhcp_test_registered_histogram_count"] != 1 {
+		t.Errorf("histogram count = %v, want 1", snapshot["dhcp_test_registered_histogram_count"])
+	}
+}
+
+func TestNewHistogramRejectsDuplicates(t *testing.T) {
+	opts := prometheus.HistogramOpts{Name: "dhcp_test_duplicate_histogram", Help: "test"}
+	NewHistograms("one").New(opts)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("declaring a histogram twice didn't panic")
+		}
+	}()
+	NewHistograms("another").New(opts)
+}
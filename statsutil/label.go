@@ -0,0 +1,105 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package statsutil holds helpers shared by the statistics plugins.
+
+package statsutil
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger("plugins/statsutil")
+
+// OtherLabel is the label value used once a BoundedLabel is full.
+const OtherLabel = "other"
+
+// sanitized label values are truncated to this many bytes
+const maxLabelLength = 64
+
+// SanitizeLabel makes a client-supplied string safe to use as a label
+// value. Strings that aren't printable UTF-8 are hex-encoded, and long
+// values are truncated.
+func SanitizeLabel(s string) string {
+	printable := utf8.ValidString(s)
+	for _, r := range s {
+		if !printable || !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+	if !printable {
+		s = hex.EncodeToString([]byte(s))
+	}
+	if len(s) > maxLabelLength {
+		s = s[:maxLabelLength]
+		// don't leave a partial rune at the end
+		for len(s) > 0 && !utf8.ValidString(s) {
+			s = s[:len(s)-1]
+		}
+	}
+	return s
+}
+
+// BoundedLabel returns a function that passes through at most max
+// distinct label values. Values first seen after the cap is reached
+// collapse to OtherLabel; values seen before keep their own label.
+// name identifies the label in the log line emitted when the cap is hit.
+func BoundedLabel(name string, max int) func(value string) string {
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	warned := false
+	return func(value string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := seen[value]; ok {
+			return value
+		}
+		if len(seen) >= max {
+			if !warned {
+				log.Warningf("label %s has %d distinct values, counting new values as %q", name, max, OtherLabel)
+				warned = true
+			}
+			return OtherLabel
+		}
+		seen[value] = struct{}{}
+		return value
+	}
+}
+
+// TypeLabeler renders message types as label values. Plugin state embeds
+// one and passes the value of its label_case argument to SetLabelCase.
+type TypeLabeler struct {
+	// LowerCaseTypes lowercases message type labels
+	LowerCaseTypes bool
+}
+
+// SetLabelCase handles label_case=lower, which lowercases message type
+// labels for dashboards built that way, and label_case=preserve.
+func (l *TypeLabeler) SetLabelCase(value string) error {
+	switch value {
+	case "lower":
+		l.LowerCaseTypes = true
+	case "preserve":
+		l.LowerCaseTypes = false
+	default:
+		return fmt.Errorf("invalid label_case %q, must be lower or preserve", value)
+	}
+	return nil
+}
+
+// TypeLabel returns the label value for a message type, honoring label_case.
+func (l TypeLabeler) TypeLabel(t fmt.Stringer) string {
+	if l.LowerCaseTypes {
+		return strings.ToLower(t.String())
+	}
+	return t.String()
+}
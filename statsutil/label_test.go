@@ -0,0 +1,85 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"printable", "eth0/1", "eth0/1"},
+		{"empty", "", ""},
+		{"control character", "a\x00b", "610062"},
+		{"invalid utf8", "\xff\xfe", "fffe"},
+		{"long", strings.Repeat("x", 100), strings.Repeat("x", maxLabelLength)},
+		{"long hex", strings.Repeat("\x01", 40), strings.Repeat("01", maxLabelLength/2)},
+		// 21 three-byte runes is 63 bytes, so the 22nd would be cut
+		{"partial rune", strings.Repeat("€", 30), strings.Repeat("€", 21)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeLabel(tt.in); got != tt.want {
+				t.Errorf("SanitizeLabel(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoundedLabel(t *testing.T) {
+	label := BoundedLabel("test", 2)
+	steps := []struct {
+		in   string
+		want string
+	}{
+		{"a", "a"},
+		{"b", "b"},
+		{"c", OtherLabel},
+		{"a", "a"},
+		{"d", OtherLabel},
+		{"b", "b"},
+	}
+	for _, step := range steps {
+		if got := label(step.in); got != step.want {
+			t.Errorf("label(%q) = %q, want %q", step.in, got, step.want)
+		}
+	}
+}
+
+func TestTypeLabeler(t *testing.T) {
+	tests := []struct {
+		labelCase string
+		want      string
+		wantErr   bool
+	}{
+		{"", "SOLICIT", false},
+		{"preserve", "SOLICIT", false},
+		{"lower", "solicit", false},
+		{"upper", "", true},
+	}
+	for _, tt := range tests {
+		var l TypeLabeler
+		if tt.labelCase != "" {
+			if err := l.SetLabelCase(tt.labelCase); (err != nil) != tt.wantErr {
+				t.Errorf("SetLabelCase(%q) error = %v, want error %v", tt.labelCase, err, tt.wantErr)
+			}
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got := l.TypeLabel(stringer("SOLICIT")); got != tt.want {
+			t.Errorf("label_case=%s: TypeLabel = %q, want %q", tt.labelCase, got, tt.want)
+		}
+	}
+}
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
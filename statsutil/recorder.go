@@ -0,0 +1,240 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Each record in a capture file is
+//
+//	family (1 byte: 4 or 6)
+//	request length (4 bytes, big endian), request bytes
+//	response length (4 bytes, big endian), response bytes
+//
+// where the requests and responses are DHCP packets as on the wire.
+
+const (
+	// at most this many records wait to be written; we drop the rest
+	recorderQueueDepth = 1024
+	// we start a new capture file once the current one is this large
+	DefaultMaxCaptureSize = 64 << 20
+	// no DHCP packet can be larger than a UDP datagram
+	maxPacketSize = 65535
+)
+
+var (
+	recorderwritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcp_recorder_records_total",
+		Help: "Total number of request/response pairs written to capture files",
+	})
+	recorderdropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcp_recorder_dropped_total",
+		Help: "Total number of request/response pairs dropped because the recorder queue was full",
+	})
+	recordererrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dhcp_recorder_errors_total",
+		Help: "Total number of request/response pairs that could not be written",
+	})
+)
+
+// Record is a request/response pair from a capture file.
+type Record struct {
+	Family   byte
+	Request  []byte
+	Response []byte
+}
+
+// Recorder asynchronously writes request/response pairs to capture files
+// in Dir, starting a new file whenever one reaches MaxFileSize. CloseAll
+// closes it.
+type Recorder struct {
+	Dir         string
+	MaxFileSize int64
+	queue       chan Record
+	done        chan struct{}
+	stopped     chan struct{}
+	file        *os.File
+	written     int64
+}
+
+var (
+	recordersMu sync.Mutex
+	recorders   = make(map[string]*Recorder)
+)
+
+// OpenRecorder returns the Recorder for dir, starting one if necessary, so
+// that every plugin recording to the same dir shares a writer.
+func OpenRecorder(dir string) (*Recorder, error) {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	if r, ok := recorders[dir]; ok {
+		return r, nil
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		Dir:         dir,
+		MaxFileSize: DefaultMaxCaptureSize,
+		queue:       make(chan Record, recorderQueueDepth),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	recorders[dir] = r
+	RegisterCloser(r)
+	go r.run()
+	return r, nil
+}
+
+// Record queues a request/response pair, dropping it if the queue is full.
+func (r *Recorder) Record(family byte, req, resp []byte) {
+	select {
+	case r.queue <- Record{family, req, resp}:
+	default:
+		recorderdropped.Inc()
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.stopped)
+	for {
+		select {
+		case rec := <-r.queue:
+			r.record(rec)
+		case <-r.done:
+			// write what's already queued, then stop
+			for {
+				select {
+				case rec := <-r.queue:
+					r.record(rec)
+				default:
+					if r.file != nil {
+						r.file.Close()
+						r.file = nil
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *Recorder) record(rec Record) {
+	if err := r.write(rec); err != nil {
+		recordererrors.Inc()
+		log.Errorf("could not record to %s: %v", r.Dir, err)
+		return
+	}
+	recorderwritten.Inc()
+}
+
+// encodeRecord returns rec as it appears in a capture file.
+func encodeRecord(rec Record) []byte {
+	buf := make([]byte, 0, 1+4+len(rec.Request)+4+len(rec.Response))
+	buf = append(buf, rec.Family)
+	for _, data := range [][]byte{rec.Request, rec.Response} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+		buf = append(buf, data...)
+	}
+	return buf
+}
+
+// write writes rec with a single Write, so readers never see part of a
+// record unless the write fails partway, in which case we truncate the
+// partial record or, failing that, abandon the file.
+func (r *Recorder) write(rec Record) error {
+	buf := encodeRecord(rec)
+	size := int64(len(buf))
+	if r.file == nil || r.written+size > r.MaxFileSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(buf)
+	if err == nil {
+		r.written += size
+		return nil
+	}
+	if n > 0 {
+		if terr := r.file.Truncate(r.written); terr != nil {
+			log.Errorf("could not truncate partial record, starting a new capture file: %v", terr)
+			r.file.Close()
+			r.file = nil
+		} else if _, serr := r.file.Seek(r.written, io.SeekStart); serr != nil {
+			r.file.Close()
+			r.file = nil
+		}
+	}
+	return err
+}
+
+// rotate closes the current capture file, if any, and starts a new one.
+func (r *Recorder) rotate() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	name := filepath.Join(r.Dir, fmt.Sprintf("capture-%d.rec", time.Now().UnixNano()))
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.written = 0
+	return nil
+}
+
+// Close writes the records already queued, closes the capture file and
+// stops recording; later records are dropped.
+func (r *Recorder) Close() error {
+	recordersMu.Lock()
+	if recorders[r.Dir] == r {
+		delete(recorders, r.Dir)
+	}
+	recordersMu.Unlock()
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	<-r.stopped
+	return nil
+}
+
+// ReadRecord reads the next record from a capture file, returning io.EOF
+// at the end of the file.
+func ReadRecord(rd io.Reader) (Record, error) {
+	var rec Record
+	var family [1]byte
+	if _, err := io.ReadFull(rd, family[:]); err != nil {
+		return rec, err
+	}
+	rec.Family = family[0]
+	for _, data := range []*[]byte{&rec.Request, &rec.Response} {
+		var header [4]byte
+		if _, err := io.ReadFull(rd, header[:]); err != nil {
+			return rec, io.ErrUnexpectedEOF
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length > maxPacketSize {
+			return rec, fmt.Errorf("record claims a %d byte packet", length)
+		}
+		*data = make([]byte, length)
+		if _, err := io.ReadFull(rd, *data); err != nil {
+			return rec, io.ErrUnexpectedEOF
+		}
+	}
+	return rec, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadRecord(t *testing.T) {
+	whole := encodeRecord(Record{Family: 6, Request: []byte{1, 2, 3}, Response: []byte{4, 5}})
+	oversized := []byte{4}
+	oversized = binary.BigEndian.AppendUint32(oversized, maxPacketSize+1)
+	tests := []struct {
+		name    string
+		in      []byte
+		want    Record
+		wantErr error
+	}{
+		{"whole", whole, Record{Family: 6, Request: []byte{1, 2, 3}, Response: []byte{4, 5}}, nil},
+		{"empty", nil, Record{}, io.EOF},
+		{"truncated header", whole[:3], Record{}, io.ErrUnexpectedEOF},
+		{"truncated packet", whole[:len(whole)-1], Record{}, io.ErrUnexpectedEOF},
+		{"oversized", oversized, Record{}, errors.New("record claims a 65536 byte packet")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadRecord(bytes.NewReader(tt.in))
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Errorf("ReadRecord error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadRecord = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	r, err := OpenRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := OpenRecorder(dir); again != r {
+		t.Errorf("OpenRecorder didn't share the recorder for %s", dir)
+	}
+	want := []Record{
+		{Family: 4, Request: []byte{1}, Response: []byte{2, 3}},
+		{Family: 6, Request: []byte{4, 5, 6}, Response: []byte{}},
+	}
+	for _, rec := range want {
+		r.Record(rec.Family, rec.Request, rec.Response)
+	}
+	// Close writes what's queued before closing the file
+	r.Close()
+	files, err := filepath.Glob(filepath.Join(dir, "capture-*.rec"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("capture files = %v, %v, want one", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []Record
+	for {
+		rec, err := ReadRecord(f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rec)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Sampler deterministically selects one in every N events.
+type Sampler struct {
+	N     uint64
+	count atomic.Uint64
+}
+
+// ParseSampler parses a sampling rate of the form 1/N.
+func ParseSampler(s string) (*Sampler, error) {
+	num, denom, ok := strings.Cut(s, "/")
+	if !ok || num != "1" {
+		return nil, fmt.Errorf("invalid sample rate %q, expected 1/N", s)
+	}
+	n, err := strconv.ParseUint(denom, 10, 64)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("invalid sample rate %q, expected 1/N", s)
+	}
+	return &Sampler{N: n}, nil
+}
+
+// Sample returns true for the first event and every Nth one thereafter.
+func (s *Sampler) Sample() bool {
+	return (s.count.Add(1)-1)%s.N == 0
+}
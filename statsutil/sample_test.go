@@ -0,0 +1,51 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import "testing"
+
+func TestParseSampler(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{in: "1/1", want: 1},
+		{in: "1/100", want: 100},
+		{in: "1/0", wantErr: true},
+		{in: "2/100", wantErr: true},
+		{in: "100", wantErr: true},
+		{in: "1/-5", wantErr: true},
+		{in: "1/x", wantErr: true},
+	}
+	for _, tt := range tests {
+		s, err := ParseSampler(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSampler(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && s.N != tt.want {
+			t.Errorf("ParseSampler(%q).N = %d, want %d", tt.in, s.N, tt.want)
+		}
+	}
+}
+
+func TestSamplerSample(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want []bool
+	}{
+		{1, []bool{true, true, true}},
+		{3, []bool{true, false, false, true, false, false, true}},
+	}
+	for _, tt := range tests {
+		s := &Sampler{N: tt.n}
+		for idx, want := range tt.want {
+			if got := s.Sample(); got != want {
+				t.Errorf("1/%d sampler event %d = %v, want %v", tt.n, idx, got, want)
+			}
+		}
+	}
+}
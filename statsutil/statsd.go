@@ -0,0 +1,212 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// We mirror our metrics to StatsD by gathering them every statsdInterval
+// and sending what changed: counters as the increase since the last
+// flush, gauges as their new value. Request handlers never touch the
+// sender, so it costs nothing per request, and nothing at all unless
+// configured. The price is that StatsD sees each counter's increments
+// summed over the interval rather than one at a time. A series that
+// appears between flushes, such as a new label value, is sent in full on
+// the next one, and a counter that went down was reset, so we send its
+// whole new value rather than lose the increments since the reset.
+const (
+	statsdInterval = 10 * time.Second
+	// at most this many packets wait to be sent; we drop the rest
+	statsdQueueDepth = 64
+	// stay under the smallest common MTU less IP and UDP headers
+	statsdMaxPacket = 1432
+)
+
+var statsddropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dhcp_statsd_dropped_total",
+	Help: "Total number of StatsD packets dropped because the queue was full or the send failed",
+})
+
+// StatsD periodically sends our metrics to a StatsD server. With the
+// dogstatsd scheme labels are sent as tags; otherwise they are appended
+// to the metric name.
+type StatsD struct {
+	URL   string
+	Tags  bool
+	conn  net.Conn
+	queue chan []byte
+	done  chan struct{}
+	last  map[string]float64
+}
+
+var (
+	statsdsMu sync.Mutex
+	statsds   = make(map[string]*StatsD)
+)
+
+// OpenStatsD starts sending to rawurl, of the form udp://host:port or
+// dogstatsd://host:port, or returns the StatsD already sending there.
+func OpenStatsD(rawurl string) (*StatsD, error) {
+	statsdsMu.Lock()
+	defer statsdsMu.Unlock()
+	if sd, ok := statsds[rawurl]; ok {
+		return sd, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "dogstatsd" {
+		return nil, fmt.Errorf("unsupported scheme %q, expected udp or dogstatsd", u.Scheme)
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	sd := &StatsD{
+		URL:   rawurl,
+		Tags:  u.Scheme == "dogstatsd",
+		conn:  conn,
+		queue: make(chan []byte, statsdQueueDepth),
+		done:  make(chan struct{}),
+		last:  make(map[string]float64),
+	}
+	statsds[rawurl] = sd
+	RegisterCloser(sd)
+	go sd.send()
+	go sd.run()
+	return sd, nil
+}
+
+// StatsDLines returns the StatsD lines for the samples that changed since
+// last, and updates last.
+func StatsDLines(samples []Sample, last map[string]float64, tags bool) []string {
+	var lines []string
+	for _, s := range samples {
+		key := s.Key()
+		previous, seen := last[key]
+		last[key] = s.Value
+		var line string
+		if s.Gauge {
+			if seen && previous == s.Value {
+				continue
+			}
+			line = statsdName(s, tags) + ":" + strconv.FormatFloat(s.Value, 'g', -1, 64) + "|g"
+		} else {
+			delta := s.Value - previous
+			if !seen || delta < 0 {
+				// a new or reset series counted up from zero
+				delta = s.Value
+			}
+			if delta <= 0 {
+				continue
+			}
+			line = statsdName(s, tags) + ":" + strconv.FormatFloat(delta, 'g', -1, 64) + "|c"
+		}
+		if tags && len(s.Labels) > 0 {
+			pairs := make([]string, len(s.Labels))
+			for idx, pair := range s.Labels {
+				pairs[idx] = pair[0] + ":" + statsdEscape(pair[1])
+			}
+			line += "|#" + strings.Join(pairs, ",")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// statsdName returns the name to send s as, with its labels appended
+// unless they are sent as tags.
+func statsdName(s Sample, tags bool) string {
+	if tags {
+		return s.Name
+	}
+	name := s.Name
+	for _, pair := range s.Labels {
+		name += "." + pair[0] + "." + statsdEscape(pair[1])
+	}
+	return name
+}
+
+// statsdEscape replaces the characters StatsD uses as separators.
+func statsdEscape(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', '.', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (sd *StatsD) run() {
+	ticker := time.NewTicker(statsdInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sd.done:
+			close(sd.queue)
+			return
+		case <-ticker.C:
+		}
+		samples, err := Gather()
+		if err != nil {
+			log.Errorf("could not gather metrics for %s: %v", sd.URL, err)
+			continue
+		}
+		var packet []byte
+		for _, line := range StatsDLines(samples, sd.last, sd.Tags) {
+			if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+				sd.enqueue(packet)
+				packet = nil
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+		if len(packet) > 0 {
+			sd.enqueue(packet)
+		}
+	}
+}
+
+// enqueue queues a packet, dropping it if the queue is full.
+func (sd *StatsD) enqueue(packet []byte) {
+	select {
+	case sd.queue <- packet:
+	default:
+		statsddropped.Inc()
+	}
+}
+
+func (sd *StatsD) send() {
+	for packet := range sd.queue {
+		if _, err := sd.conn.Write(packet); err != nil {
+			statsddropped.Inc()
+			log.Debugf("could not send to %s: %v", sd.URL, err)
+		}
+	}
+	sd.conn.Close()
+}
+
+// Close stops sending to the StatsD server.
+func (sd *StatsD) Close() error {
+	statsdsMu.Lock()
+	delete(statsds, sd.URL)
+	statsdsMu.Unlock()
+	close(sd.done)
+	return nil
+}
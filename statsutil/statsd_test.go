@@ -0,0 +1,115 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatsDLines(t *testing.T) {
+	typeLabel := [][2]string{{"type", "Solicit"}}
+	tests := []struct {
+		name    string
+		last    map[string]float64
+		samples []Sample
+		tags    bool
+		want    []string
+	}{
+		{
+			name:    "new counter sent in full",
+			last:    map[string]float64{},
+			samples: []Sample{{Name: "dhcp_x_total", Value: 5}},
+			want:    []string{"dhcp_x_total:5|c"},
+		},
+		{
+			name:    "counter delta",
+			last:    map[string]float64{"dhcp_x_total": 5},
+			samples: []Sample{{Name: "dhcp_x_total", Value: 8}},
+			want:    []string{"dhcp_x_total:3|c"},
+		},
+		{
+			name:    "unchanged counter",
+			last:    map[string]float64{"dhcp_x_total": 5},
+			samples: []Sample{{Name: "dhcp_x_total", Value: 5}},
+		},
+		{
+			name:    "reset counter sent in full",
+			last:    map[string]float64{"dhcp_x_total": 5},
+			samples: []Sample{{Name: "dhcp_x_total", Value: 2}},
+			want:    []string{"dhcp_x_total:2|c"},
+		},
+		{
+			name:    "gauge",
+			last:    map[string]float64{"dhcp_g": 5},
+			samples: []Sample{{Name: "dhcp_g", Value: 3, Gauge: true}},
+			want:    []string{"dhcp_g:3|g"},
+		},
+		{
+			name:    "unchanged gauge",
+			last:    map[string]float64{"dhcp_g": 3},
+			samples: []Sample{{Name: "dhcp_g", Value: 3, Gauge: true}},
+		},
+		{
+			name:    "labels in name",
+			last:    map[string]float64{},
+			samples: []Sample{{Name: "dhcpv6_requests_total", Labels: typeLabel, Value: 1}},
+			want:    []string{"dhcpv6_requests_total.type.Solicit:1|c"},
+		},
+		{
+			name:    "labels as tags",
+			last:    map[string]float64{},
+			samples: []Sample{{Name: "dhcpv6_requests_total", Labels: typeLabel, Value: 1}},
+			tags:    true,
+			want:    []string{"dhcpv6_requests_total:1|c|#type:Solicit"},
+		},
+		{
+			name:    "escaped label value",
+			last:    map[string]float64{},
+			samples: []Sample{{Name: "dhcp_r_total", Labels: [][2]string{{"relay", "10.0.0.1:67"}}, Value: 1}},
+			want:    []string{"dhcp_r_total.relay.10_0_0_1_67:1|c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StatsDLines(tt.samples, tt.last, tt.tags)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StatsDLines = %q, want %q", got, tt.want)
+			}
+			for _, s := range tt.samples {
+				if tt.last[s.Key()] != s.Value {
+					t.Errorf("last[%s] = %v, want %v", s.Key(), tt.last[s.Key()], s.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenStatsD(t *testing.T) {
+	tests := []struct {
+		url     string
+		tags    bool
+		wantErr bool
+	}{
+		{url: "udp://127.0.0.1:8125"},
+		{url: "dogstatsd://127.0.0.1:8126", tags: true},
+		{url: "tcp://127.0.0.1:8125", wantErr: true},
+		{url: "://", wantErr: true},
+	}
+	for _, tt := range tests {
+		sd, err := OpenStatsD(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("OpenStatsD(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if sd.Tags != tt.tags {
+			t.Errorf("OpenStatsD(%q).Tags = %v, want %v", tt.url, sd.Tags, tt.tags)
+		}
+		sd.Close()
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Subnets is a list of networks, e.g. the subnets a server serves.
+type Subnets []*net.IPNet
+
+// ParseSubnets parses a comma-separated list of CIDRs.
+func ParseSubnets(s string) (Subnets, error) {
+	var subnets Subnets
+	for _, field := range strings.Split(s, ",") {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("no subnets in %q", s)
+	}
+	return subnets, nil
+}
+
+// Contains returns true if ip is in any of the subnets.
+func (subnets Subnets) Contains(ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Family returns the subnets of one address family, or nil if there are
+// none.
+func (subnets Subnets) Family(v4 bool) Subnets {
+	var family Subnets
+	for _, subnet := range subnets {
+		if (subnet.IP.To4() != nil) == v4 {
+			family = append(family, subnet)
+		}
+	}
+	return family
+}
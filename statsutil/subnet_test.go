@@ -0,0 +1,66 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSubnets(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "10.0.0.0/8", want: 1},
+		{in: "10.0.0.0/8, 192.168.1.0/24,2001:db8::/32", want: 3},
+		{in: "10.0.0.0", wantErr: true},
+		{in: "10.0.0.0/8,", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		subnets, err := ParseSubnets(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSubnets(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if len(subnets) != tt.want {
+			t.Errorf("ParseSubnets(%q) has %d subnets, want %d", tt.in, len(subnets), tt.want)
+		}
+	}
+}
+
+func TestSubnetsContainsAndFamily(t *testing.T) {
+	subnets, err := ParseSubnets("10.99.0.0/16,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, v6 := subnets.Family(true), subnets.Family(false)
+	tests := []struct {
+		ip            string
+		all, in4, in6 bool
+	}{
+		{"10.99.1.1", true, true, false},
+		{"10.98.1.1", false, false, false},
+		{"2001:db8::1", true, false, true},
+		{"2001:db9::1", false, false, false},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if got := subnets.Contains(ip); got != tt.all {
+			t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.all)
+		}
+		if got := v4.Contains(ip); got != tt.in4 {
+			t.Errorf("Family(true).Contains(%s) = %v, want %v", tt.ip, got, tt.in4)
+		}
+		if got := v6.Contains(ip); got != tt.in6 {
+			t.Errorf("Family(false).Contains(%s) = %v, want %v", tt.ip, got, tt.in6)
+		}
+	}
+	if only4, _ := ParseSubnets("10.0.0.0/8"); only4.Family(false) != nil {
+		t.Errorf("Family(false) of IPv4 subnets isn't nil")
+	}
+}
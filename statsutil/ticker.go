@@ -0,0 +1,154 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and starts the tickers that drive periodic work.
+// Plugin state embeds one, so tests can substitute a MockClock.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a channel that delivers a tick every interval
+	// and a function that stops it.
+	NewTicker(interval time.Duration) (<-chan time.Time, func())
+}
+
+// RealClock is the Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// MockClock is a Clock for tests. Its time moves only when Advance is
+// called, and its tickers tick only when Tick is called.
+type MockClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers map[*mockTicker]bool
+	running sync.WaitGroup
+}
+
+type mockTicker struct {
+	interval time.Duration
+	ticks    chan time.Time
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+// NewMockClock returns a MockClock reading a fixed time.
+func NewMockClock() *MockClock {
+	return &MockClock{now: time.Unix(1700000000, 0), tickers: make(map[*mockTicker]bool)}
+}
+
+func (c *MockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *MockClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *MockClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	m := &mockTicker{interval: interval, ticks: make(chan time.Time), stopped: make(chan struct{})}
+	c.mu.Lock()
+	c.tickers[m] = true
+	c.mu.Unlock()
+	c.running.Add(1)
+	return m.ticks, func() {
+		m.once.Do(func() {
+			c.mu.Lock()
+			delete(c.tickers, m)
+			c.mu.Unlock()
+			close(m.stopped)
+			c.running.Done()
+		})
+	}
+}
+
+// Intervals returns the intervals of the running tickers.
+func (c *MockClock) Intervals() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var intervals []time.Duration
+	for m := range c.tickers {
+		intervals = append(intervals, m.interval)
+	}
+	return intervals
+}
+
+// Tick delivers a tick to every running ticker, returning once each has
+// been taken. The receiver may still be acting on it; Wait for that.
+func (c *MockClock) Tick() {
+	c.mu.Lock()
+	now := c.now
+	tickers := make([]*mockTicker, 0, len(c.tickers))
+	for m := range c.tickers {
+		tickers = append(tickers, m)
+	}
+	c.mu.Unlock()
+	for _, m := range tickers {
+		select {
+		case m.ticks <- now:
+		case <-m.stopped:
+		}
+	}
+}
+
+// Wait returns once every ticker the clock started has been stopped.
+func (c *MockClock) Wait() {
+	c.running.Wait()
+}
+
+// Periodic calls a function on every tick until closed.
+type Periodic struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// Every calls f on every tick of a clock's ticker for interval, or of a
+// real ticker if clock is nil, until CloseAll closes it. f should read
+// the time from the same clock rather than the tick.
+func Every(clock Clock, interval time.Duration, f func()) *Periodic {
+	if clock == nil {
+		clock = RealClock
+	}
+	p := &Periodic{done: make(chan struct{})}
+	ticks, stop := clock.NewTicker(interval)
+	RegisterCloser(p)
+	go func() {
+		defer stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticks:
+				f()
+			}
+		}
+	}()
+	return p
+}
+
+// Close stops calling the function.
+func (p *Periodic) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
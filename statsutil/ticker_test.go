@@ -0,0 +1,50 @@
+// Copyright 2023 Next Level Infrastructure, LLC
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package statsutil
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMockClock(t *testing.T) {
+	clock := NewMockClock()
+	start := clock.Now()
+	clock.Advance(time.Minute)
+	if got := clock.Now().Sub(start); got != time.Minute {
+		t.Errorf("clock advanced %v, want 1m", got)
+	}
+	ticks, stop := clock.NewTicker(time.Second)
+	go clock.Tick()
+	if tick := <-ticks; !tick.Equal(clock.Now()) {
+		t.Errorf("tick at %v, want %v", tick, clock.Now())
+	}
+	stop()
+	stop()
+	clock.Wait()
+	// with no ticker running, a tick goes nowhere
+	clock.Tick()
+}
+
+func TestEvery(t *testing.T) {
+	clock := NewMockClock()
+	calls := make(chan struct{}, 3)
+	p := Every(clock, time.Minute, func() { calls <- struct{}{} })
+	if got := clock.Intervals(); !reflect.DeepEqual(got, []time.Duration{time.Minute}) {
+		t.Errorf("ticker intervals = %v, want [1m]", got)
+	}
+	for i := 0; i < 3; i++ {
+		clock.Tick()
+		<-calls
+	}
+	p.Close()
+	clock.Wait()
+	// closing twice is harmless, since CloseAll closes it too
+	p.Close()
+	if got := clock.Intervals(); len(got) != 0 {
+		t.Errorf("tickers %v still running after Close", got)
+	}
+}